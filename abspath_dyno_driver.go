@@ -5,7 +5,6 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"os/exec"
 	"syscall"
@@ -14,8 +13,9 @@ import (
 
 var ErrNoSlugURL = errors.New("no slug specified")
 
-const profileRunnerText = `#!/bin/bash
-export PS1='\[\033[01;34m\]\w\[\033[00m\] \[\033[01;32m\]$ \[\033[00m\]'
+// profileScript sources the profile scripts of the stack and of the
+// application, then runs its arguments as a command.
+const profileScript = `export PS1='\[\033[01;34m\]\w\[\033[00m\] \[\033[01;32m\]$ \[\033[00m\]'
 
 if [ -d /etc/profile.d ]; then
   for i in /etc/profile.d/*.sh; do
@@ -35,10 +35,11 @@ if [ -d /app/.profile.d ]; then
   unset i
 fi
 
-rm $0
 exec bash -c "$*"
 `
 
+const profileRunnerText = "#!/bin/bash\nrm $0\n" + profileScript
+
 type profileRunner struct {
 	file *os.File
 }
@@ -68,76 +69,29 @@ func (pr *profileRunner) Args(args []string) []string {
 	return append([]string{pr.file.Name()}, args...)
 }
 
-type AbsPathDynoDriver struct {
+// InlineArgs runs args like Args does, passing the profile script to
+// bash rather than writing it to a file, for dynos that don't share
+// the file system of hsup.
+func (pr *profileRunner) InlineArgs(args []string) []string {
+	return append([]string{"/bin/bash", "-c", profileScript,
+		"profile-runner"}, args...)
 }
 
-func (dd *AbsPathDynoDriver) fetch(release *Release) error {
-	if release.slugURL == "" {
-		return ErrNoSlugURL
-	}
-
-	switch release.Where() {
-	case Local:
-		// No-op: the slug is already available on the file
-		// system.
-	case HTTP:
-		log.Printf("fetching slug URL %q", release.slugURL)
-
-		resp, err := http.Get(release.slugURL)
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
-
-		out, err := os.Create("/tmp/slug.tgz")
-		if err != nil {
-			return err
-		}
-		defer out.Close()
-
-		if _, err := io.Copy(out, resp.Body); err != nil {
-			return err
-		}
-
-		release.slugURL = "/tmp/slug.tgz"
-	}
+type AbsPathDynoDriver struct {
+}
 
-	return nil
+func (dd *AbsPathDynoDriver) ValidateApp(app *AppSerializable,
+	verr *ValidationError) {
+	validateSlug(app, verr)
+	validateZstd(app, verr)
 }
 
-func (dd *AbsPathDynoDriver) unpack(release *Release) error {
+func (dd *AbsPathDynoDriver) Build(release *Release) error {
 	if release.slugURL == "" {
 		return nil
 	}
 
-	if release.Where() != Local {
-		panic("by unpack, expect release slugURL to be " +
-			"transmogrified to a local path")
-	}
-
-	cmd := exec.Command("/bin/tar", "-C", "/app", "--strip-components=2", "-zxf",
-		release.slugURL)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (dd *AbsPathDynoDriver) Build(release *Release) (err error) {
-	if release.Where() == HTTP {
-		if err = dd.fetch(release); err != nil {
-			return err
-		}
-	}
-
-	if err = dd.unpack(release); err != nil {
-		return err
-	}
-
-	return nil
+	return unpackSlug(release, "/app")
 }
 
 func (dd *AbsPathDynoDriver) Start(ex *Executor) (err error) {
@@ -0,0 +1,469 @@
+package hsup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Paths of a source build within a container.  They are all below /tmp,
+// which is writable in every stack environment.
+const (
+	buildWorkInContainer       = "/tmp/hsup-build"
+	buildCacheInContainer      = "/tmp/hsup-cache"
+	buildBuildpacksInContainer = "/tmp/hsup-buildpacks"
+)
+
+// compileScript runs every buildpack in turn on the build directory,
+// as the Heroku build system does, keeping the output of bin/release
+// for hsup to read.
+const compileScript = `#!/bin/bash
+set -eo pipefail
+
+build=$1 cache=$2 env=$3 out=$4
+shift 4
+
+n=0
+for bp in "$@"; do
+  if ! name=$("$bp/bin/detect" "$build"); then
+    echo "buildpack $bp cannot build this app" >&2
+    exit 1
+  fi
+  echo "-----> $name app detected"
+  "$bp/bin/compile" "$build" "$cache" "$env"
+  "$bp/bin/release" "$build" > "$out/release-$n.yml"
+  n=$((n+1))
+done
+`
+
+// SourceBuild compiles application source into a slug with
+// buildpacks, the way the Heroku build system does, within the stack
+// environment of a dyno driver.  The simple driver runs buildpacks on
+// the host.
+type SourceBuild struct {
+	// Source is the application directory.  It is copied before
+	// building and left untouched.
+	Source string
+
+	// Buildpacks are local buildpack directories, all of which
+	// are run in order.
+	Buildpacks []string
+
+	// CacheDir is kept between builds of the same application.
+	CacheDir string
+
+	// Output is where the slug is written.
+	Output string
+
+	// Env is made available to buildpacks in their environment
+	// directory, and is part of the resulting application's
+	// environment.
+	Env map[string]string
+
+	AppName string
+	Stack   string
+	Driver  DynoDriver
+}
+
+// DefaultBuildCacheDir returns the build cache directory of an
+// application, in DefaultWorkDir or else in the temporary directory.
+func DefaultBuildCacheDir(appName string) (string, error) {
+	dir := filepath.Join(DefaultWorkDir, "build-cache", appName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		dir = filepath.Join(os.TempDir(), "hsup-build-cache", appName)
+		return dir, os.MkdirAll(dir, 0700)
+	}
+	return dir, nil
+}
+
+// Run compiles the source and writes the slug.  It returns the
+// application as it would be submitted to a control directory, with
+// the process types declared by the buildpacks and by the Procfile,
+// which takes precedence.
+func (sb *SourceBuild) Run() (*AppSerializable, error) {
+	if len(sb.Buildpacks) == 0 {
+		return nil, fmt.Errorf("at least one buildpack is required")
+	}
+
+	work, err := ioutil.TempDir("", "hsup-build-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(work)
+
+	build := filepath.Join(work, "build")
+	for _, dir := range []string{"env", "out"} {
+		if err := os.Mkdir(filepath.Join(work, dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+	if err := copyTree(sb.Source, build); err != nil {
+		return nil, err
+	}
+	for name, value := range sb.Env {
+		err := ioutil.WriteFile(filepath.Join(work, "env", name),
+			[]byte(value), 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = ioutil.WriteFile(filepath.Join(work, "compile"),
+		[]byte(compileScript), 0755)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(sb.CacheDir, 0700); err != nil {
+		return nil, err
+	}
+
+	if err := sb.compile(work); err != nil {
+		return nil, err
+	}
+
+	app := &AppSerializable{
+		Name:  sb.AppName,
+		Env:   make(map[string]string),
+		Stack: sb.Stack,
+	}
+	defaults := make(map[string]string)
+	for i := range sb.Buildpacks {
+		out, err := ioutil.ReadFile(filepath.Join(work, "out",
+			fmt.Sprintf("release-%d.yml", i)))
+		if err != nil {
+			return nil, err
+		}
+		types, config, err := parseBuildpackRelease(out)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range types {
+			defaults[k] = v
+		}
+		for k, v := range config {
+			app.Env[k] = v
+		}
+	}
+	for k, v := range sb.Env {
+		app.Env[k] = v
+	}
+
+	procfile, err := ioutil.ReadFile(filepath.Join(build, "Procfile"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if app.Processes, err = mergeProcessTypes(procfile, defaults); err != nil {
+		return nil, err
+	}
+
+	if app.Slug, err = filepath.Abs(sb.Output); err != nil {
+		return nil, err
+	}
+	if app.SlugChecksum, err = writeSlugFile(build, app.Slug); err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+// compile runs the compile script with the dyno driver as a one-off
+// process, with the build directory, cache and buildpacks bound into
+// its container, if any.
+func (sb *SourceBuild) compile(work string) error {
+	cache, err := filepath.Abs(sb.CacheDir)
+	if err != nil {
+		return err
+	}
+
+	_, onHost := sb.Driver.(*SimpleDynoDriver)
+	binds := make(map[string]string)
+	inside := func(host, container string) string {
+		if onHost {
+			return host
+		}
+		binds[host] = container
+		return container
+	}
+
+	w := inside(work, buildWorkInContainer)
+	args := []string{
+		filepath.Join(w, "compile"),
+		filepath.Join(w, "build"),
+		inside(cache, buildCacheInContainer),
+		filepath.Join(w, "env"),
+		filepath.Join(w, "out"),
+	}
+	for i, bp := range sb.Buildpacks {
+		abs, err := filepath.Abs(bp)
+		if err != nil {
+			return err
+		}
+		args = append(args, inside(abs,
+			filepath.Join(buildBuildpacksInContainer, strconv.Itoa(i))))
+	}
+
+	cmd := "bash"
+	for _, arg := range args {
+		cmd += " " + shellQuote(arg)
+	}
+
+	rel := &Release{
+		appName: sb.AppName,
+		config:  map[string]string{"PORT": DefaultPort},
+		stack:   sb.Stack,
+	}
+	if err := sb.Driver.Build(rel); err != nil {
+		return err
+	}
+
+	ex := &Executor{
+		Args:        []string{cmd},
+		DynoDriver:  sb.Driver,
+		ProcessID:   1,
+		ProcessType: "build",
+		Release:     rel,
+		Complete:    make(chan struct{}),
+		State:       Stopped,
+		OneShot:     true,
+		Status:      make(chan *ExitStatus),
+		NewInput:    make(chan DynoInput),
+		Binds:       binds,
+	}
+	if !onHost {
+		// The dyno user of the stack, whatever its uid, needs
+		// to write to the build directory and the cache.
+		ex.OwnedBinds = []string{work, cache}
+	}
+
+	log.Printf("compiling %s with %d buildpack(s)", sb.Source,
+		len(sb.Buildpacks))
+	switch s := runOneShot(ex); {
+	case s == nil:
+		return fmt.Errorf("could not start the build")
+	case s.Err != nil:
+		return fmt.Errorf("build failed: %v", s.Err)
+	case s.Code != 0:
+		return fmt.Errorf("build exited with code %d", s.Code)
+	}
+	return nil
+}
+
+// parseBuildpackRelease reads the "default_process_types" and
+// "config_vars" maps of the YAML document written by a buildpack's
+// bin/release.  Buildpacks only ever emit flat maps of strings, so
+// that is all that is understood.
+func parseBuildpackRelease(out []byte) (types, config map[string]string,
+	err error) {
+	types = make(map[string]string)
+	config = make(map[string]string)
+
+	var section map[string]string
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := s.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" ||
+			strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		indented := line[0] == ' ' || line[0] == '\t'
+		if indented && section == nil {
+			continue
+		}
+
+		parts := strings.SplitN(trimmed, ":", 2)
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("unexpected line in "+
+				"buildpack release: %q", line)
+		}
+		key, value := parts[0], strings.TrimSpace(parts[1])
+
+		if !indented {
+			switch key {
+			case "default_process_types":
+				section = types
+			case "config_vars":
+				section = config
+			default:
+				section = nil
+			}
+			continue
+		}
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') &&
+			value[len(value)-1] == value[0] {
+			if value[0] == '"' {
+				if unq, err := strconv.Unquote(value); err == nil {
+					value = unq
+				}
+			} else {
+				value = strings.Replace(value[1:len(value)-1],
+					"''", "'", -1)
+			}
+		}
+		section[key] = value
+	}
+
+	return types, config, s.Err()
+}
+
+// mergeProcessTypes returns the process types of a Procfile followed
+// by the buildpack defaults it does not override, in name order.
+func mergeProcessTypes(procfile []byte, defaults map[string]string) (
+	[]FormationSerializable, error) {
+	forms, err := parseProcfile(procfile)
+	if err != nil {
+		return nil, err
+	}
+
+	declared := make(map[string]bool)
+	for _, f := range forms {
+		declared[f.FType] = true
+	}
+
+	var names []string
+	for name := range defaults {
+		if !declared[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		forms = append(forms, FormationSerializable{
+			FArgs:     []string{defaults[name]},
+			FQuantity: 1,
+			FType:     name,
+		})
+	}
+	return forms, nil
+}
+
+// writeSlugFile archives a build directory into a slug at path and
+// returns its checksum.
+func writeSlugFile(dir, path string) (checksum string, err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	h := sha256.New()
+	if err := writeSlug(dir, io.MultiWriter(f, h)); err != nil {
+		return "", err
+	}
+	return formatChecksum(hex.EncodeToString(h.Sum(nil))), nil
+}
+
+// writeSlug writes the contents of dir as a gzipped tarball, with
+// entries prefixed by "./app/".
+func writeSlug(dir string, w io.Writer) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = "./app/" + filepath.ToSlash(rel)
+		if rel == "." {
+			hdr.Name = "./app"
+		}
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// copyTree copies a source directory, leaving out version control
+// metadata, as it is not part of slugs.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == ".git" {
+			return filepath.SkipDir
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(target, fi.Mode().Perm())
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case fi.Mode().IsRegular():
+			return copyFile(path, target, fi.Mode().Perm())
+		default:
+			return nil
+		}
+	})
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
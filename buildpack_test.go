@@ -0,0 +1,151 @@
+package hsup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const fakeBuildpackRelease = `---
+addons: []
+config_vars:
+  LANG: en_US.UTF-8
+  PATH: "/app/bin:/usr/bin:/bin"
+default_process_types:
+  web: ./bin/web
+  worker: ./bin/worker
+`
+
+func writeFakeBuildpack(t *testing.T, dir string) {
+	scripts := map[string]string{
+		"detect": "#!/bin/sh\n[ -f \"$1/hello.txt\" ] && echo Fake\n",
+		"compile": "#!/bin/sh\nset -e\nmkdir -p \"$1/bin\"\n" +
+			"echo compiled > \"$1/bin/web\"\n" +
+			"echo cached >> \"$2/runs\"\n",
+		"release": "#!/bin/sh\ncat <<'EOF'\n" + fakeBuildpackRelease +
+			"EOF\n",
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, script := range scripts {
+		err := ioutil.WriteFile(filepath.Join(dir, "bin", name),
+			[]byte(script), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParseBuildpackRelease(t *testing.T) {
+	types, config, err := parseBuildpackRelease([]byte(fakeBuildpackRelease))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(types, map[string]string{
+		"web":    "./bin/web",
+		"worker": "./bin/worker",
+	}) {
+		t.Fatalf("unexpected process types %v", types)
+	}
+	if !reflect.DeepEqual(config, map[string]string{
+		"LANG": "en_US.UTF-8",
+		"PATH": "/app/bin:/usr/bin:/bin",
+	}) {
+		t.Fatalf("unexpected config vars %v", config)
+	}
+}
+
+func TestSourceBuild(t *testing.T) {
+	tmp := newTmpDb(t)
+	defer os.RemoveAll(tmp)
+
+	source := filepath.Join(tmp, "source")
+	buildpack := filepath.Join(tmp, "buildpack")
+	writeFakeBuildpack(t, buildpack)
+	if err := os.MkdirAll(filepath.Join(source, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(source, "hello.txt"), []byte("hi"), 0644)
+	ioutil.WriteFile(filepath.Join(source, "Procfile"),
+		[]byte("worker: ./bin/worker --fast\n"), 0644)
+
+	sb := &SourceBuild{
+		Source:     source,
+		Buildpacks: []string{buildpack},
+		CacheDir:   filepath.Join(tmp, "cache"),
+		Output:     filepath.Join(tmp, "slug.tgz"),
+		AppName:    "myapp",
+		Stack:      "cedar-14",
+		Driver:     &SimpleDynoDriver{},
+	}
+	var app *AppSerializable
+	for i := 0; i < 2; i++ {
+		var err error
+		if app, err = sb.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runs, _ := ioutil.ReadFile(filepath.Join(tmp, "cache", "runs"))
+	if string(runs) != "cached\ncached\n" {
+		t.Fatalf("expected the cache to be kept, got %q", runs)
+	}
+
+	expected := []FormationSerializable{
+		{FArgs: []string{"./bin/worker --fast"}, FQuantity: 1,
+			FType: "worker"},
+		{FArgs: []string{"./bin/web"}, FQuantity: 1, FType: "web"},
+	}
+	if !reflect.DeepEqual(app.Processes, expected) {
+		t.Fatalf("unexpected processes %+v", app.Processes)
+	}
+	if app.Env["LANG"] != "en_US.UTF-8" {
+		t.Fatalf("expected config vars in the environment, got %v",
+			app.Env)
+	}
+	if err := VerifySlugFile(app.Slug, app.SlugChecksum); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(tmp, "app")
+	f, err := os.Open(app.Slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	err = extractSlug(f, SlugFormatTgz, dir, SlugStripComponents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if web, _ := ioutil.ReadFile(filepath.Join(dir, "bin", "web")); string(web) != "compiled\n" {
+		t.Fatalf("expected the compiled app in the slug, got %q", web)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); !os.IsNotExist(err) {
+		t.Fatal("expected .git to be left out of the slug")
+	}
+}
+
+func TestSourceBuildFailsDetection(t *testing.T) {
+	tmp := newTmpDb(t)
+	defer os.RemoveAll(tmp)
+
+	buildpack := filepath.Join(tmp, "buildpack")
+	writeFakeBuildpack(t, buildpack)
+	os.MkdirAll(filepath.Join(tmp, "source"), 0755)
+
+	sb := &SourceBuild{
+		Source:     filepath.Join(tmp, "source"),
+		Buildpacks: []string{buildpack},
+		CacheDir:   filepath.Join(tmp, "cache"),
+		Output:     filepath.Join(tmp, "slug.tgz"),
+		AppName:    "myapp",
+		Driver:     &SimpleDynoDriver{},
+	}
+	if _, err := sb.Run(); err == nil {
+		t.Fatal("expected the build to fail")
+	}
+}
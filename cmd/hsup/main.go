@@ -1,11 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -20,8 +22,28 @@ import (
 // CmdLogplexURL is non-nil when a logplex URL is specified on the
 // command line.  This has priority over the Control Directory variant
 // of the same setting.
+//
+// MultiApp is true when the control directory holds one subdirectory
+// per application, all of which are supervised by this hsup.
+//
+// SubInvocation is true when this hsup was started by another one,
+// e.g. inside a container, and handed a control file.
+//
+// SourceBuild is non-nil when "build --source" is to compile a slug
+// rather than build a release.
+//
+// StacksCommand is the subcommand of "stacks", which manages the stack
+// images of the libcontainer driver rather than running anything.
+//
+// DockerPrune is true for "docker prune", which removes superseded
+// images built by the docker driver.
 var (
 	CmdLogplexURL *url.URL
+	MultiApp      bool
+	SubInvocation bool
+	SourceBuild   *hsup.SourceBuild
+	StacksCommand string
+	DockerPrune   bool
 	controlApi    *hsup.ControlAPI
 )
 
@@ -44,22 +66,6 @@ func statuses(p *hsup.Processes) <-chan []*hsup.ExitStatus {
 	return out
 }
 
-func findDynoDriver(name string) (hsup.DynoDriver, error) {
-	switch name {
-	case "simple":
-		return &hsup.SimpleDynoDriver{}, nil
-	case "docker":
-		return &hsup.DockerDynoDriver{}, nil
-	case "abspath":
-		return &hsup.AbsPathDynoDriver{}, nil
-	case "libcontainer":
-		return hsup.NewLibContainerDynoDriver("/var/lib/hsup")
-	default:
-		return nil, fmt.Errorf("could not locate driver. "+
-			"specified by the user: %v", name)
-	}
-}
-
 func dumpOnSignal() {
 	signals := make(chan os.Signal)
 	signal.Notify(signals, syscall.SIGUSR1)
@@ -139,7 +145,17 @@ func (cr ExplicitConcResolver) Resolve(form hsup.Formation) int {
 	return cr[form.Type()]
 }
 
-func start(p *hsup.Processes, hs *hsup.Startup, args []string) (err error) {
+// releasePhase is true when the release phase command of a release
+// is to be run before rolling it out.  Sub-invocations are handed the
+// release phase as an ordinary formation to run instead.
+func releasePhase(hs *hsup.Startup) bool {
+	return hs.Action == hsup.Start && !SubInvocation
+}
+
+// build prepares a release for its processes to be started: it builds
+// the release and runs its release phase command.  Until this
+// succeeds, the processes of the previous release are left running.
+func build(p *hsup.Processes, hs *hsup.Startup) (err error) {
 	if !hs.SkipBuild {
 		if err = p.Dd.Build(p.Rel); err != nil {
 			log.Printf(
@@ -149,6 +165,22 @@ func start(p *hsup.Processes, hs *hsup.Startup, args []string) (err error) {
 		}
 	}
 
+	if releasePhase(hs) {
+		return p.RunReleasePhase(hs.StartNumber, logplexDefault(p),
+			hs.Binds)
+	}
+
+	return nil
+}
+
+// buildResult is the outcome of building the release of processes,
+// see build.
+type buildResult struct {
+	procs *hsup.Processes
+	err   error
+}
+
+func start(p *hsup.Processes, hs *hsup.Startup, args []string) {
 	switch hs.Action {
 	case hsup.Start:
 		var cr ConcResolver
@@ -160,6 +192,10 @@ func start(p *hsup.Processes, hs *hsup.Startup, args []string) (err error) {
 		}
 
 		for _, form := range p.Forms {
+			if releasePhase(hs) && form.Type() == hsup.ReleaseProcessType {
+				continue
+			}
+
 			conc := cr.Resolve(form)
 			log.Printf("formation quantity=%v type=%v\n",
 				conc, form.Type())
@@ -208,7 +244,19 @@ func start(p *hsup.Processes, hs *hsup.Startup, args []string) (err error) {
 	}
 
 	startParallel(p)
-	return nil
+}
+
+// reconcile lets the dyno driver clean up after an earlier run of hsup
+// once a release was rolled out.
+func reconcile(p *hsup.Processes, hs *hsup.Startup) {
+	r, ok := p.Dd.(hsup.Reconciler)
+	if !ok || hs.Action != hsup.Start {
+		return
+	}
+	if err := r.Reconcile(p.Rel); err != nil {
+		log.Printf("could not reconcile release %s: %v",
+			p.Rel.Name(), err)
+	}
 }
 
 func bindParse(bs string) map[string]string {
@@ -245,6 +293,19 @@ func fromOptions(dst *hsup.Startup) (args []string) {
 	bind := flag.String("bind", "",
 		"host paths that are available within the container, "+
 			"e.g. /tmp:/app/mytmp")
+	multiApp := flag.Bool("multi-app", false,
+		"supervise every app in a subdirectory of HSUP_CONTROL_DIR")
+	source := flag.String("source", "",
+		"with \"build\", compile a slug from the app source in this "+
+			"directory")
+	buildpacks := flag.String("buildpack", "",
+		"comma separated buildpack directories to compile --source with")
+	output := flag.String("output", "slug.tgz",
+		"where to write the slug compiled from --source")
+	cacheDir := flag.String("cache-dir", "",
+		"build cache directory for --source, kept per app by default")
+	stack := flag.String("stack", "cedar-14",
+		"the stack to compile --source on")
 	flag.Parse()
 	args = flag.Args()
 
@@ -270,13 +331,34 @@ func fromOptions(dst *hsup.Startup) (args []string) {
 		dst.Action = hsup.Build
 	case "start":
 		dst.Action = hsup.Start
+	case "stacks":
+		usage := "usage: stacks gc | stacks refresh | " +
+			"stacks register NAME VERSION PATH"
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(1)
+		}
+		switch {
+		case (args[1] == "gc" || args[1] == "refresh") && len(args) == 2:
+		case args[1] == "register" && len(args) == 5:
+		default:
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(1)
+		}
+		StacksCommand = args[1]
+	case "docker":
+		if len(args) != 2 || args[1] != "prune" {
+			fmt.Fprintln(os.Stderr, "\"docker\" only supports \"prune\"")
+			os.Exit(1)
+		}
+		DockerPrune = true
 	default:
 		fmt.Fprintf(os.Stderr, "Command not found: %v\n", args[0])
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	dynoDriver, err := findDynoDriver(*dynoDriverName)
+	dynoDriver, err := hsup.NewDriverByName(*dynoDriverName)
 	if err != nil {
 		log.Fatalln("could not initiate dyno driver:", err.Error())
 	}
@@ -286,6 +368,12 @@ func fromOptions(dst *hsup.Startup) (args []string) {
 	dst.OneShot = *oneShot
 	dst.StartNumber = *startNumber
 	dst.ControlSocket = *controlSocket
+	MultiApp = *multiApp
+
+	if MultiApp && (dst.Action != hsup.Start || dst.OneShot) {
+		log.Fatalln("--multi-app only supports \"start\" " +
+			"without --oneshot")
+	}
 
 	if *logplex != "" {
 		if CmdLogplexURL, err = url.Parse(*logplex); err != nil {
@@ -297,9 +385,123 @@ func fromOptions(dst *hsup.Startup) (args []string) {
 		dst.Binds = bindParse(*bind)
 	}
 
+	if *source != "" {
+		if dst.Action != hsup.Build {
+			log.Fatalln("--source only applies to \"build\"")
+		}
+		SourceBuild = sourceBuild(dst, *source, *buildpacks, *output,
+			*cacheDir, *stack)
+	}
+
 	return args[1:]
 }
 
+func sourceBuild(hs *hsup.Startup, source, buildpacks, output, cacheDir,
+	stack string) *hsup.SourceBuild {
+	if buildpacks == "" {
+		log.Fatalln("--source needs at least one --buildpack")
+	}
+
+	appName := hs.App.Name
+	if appName == "" {
+		abs, err := filepath.Abs(source)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		appName = filepath.Base(abs)
+	}
+
+	if cacheDir == "" {
+		var err error
+		if cacheDir, err = hsup.DefaultBuildCacheDir(appName); err != nil {
+			log.Fatalln("could not create build cache:", err)
+		}
+	}
+
+	return &hsup.SourceBuild{
+		Source:     source,
+		Buildpacks: strings.Split(buildpacks, ","),
+		CacheDir:   cacheDir,
+		Output:     output,
+		AppName:    appName,
+		Stack:      stack,
+		Driver:     hs.Driver,
+	}
+}
+
+// compileSource compiles a slug and prints the application to
+// stdout, ready to be written to a control directory.
+func compileSource(sb *hsup.SourceBuild) {
+	app, err := sb.Run()
+	if err != nil {
+		log.Fatalln("could not compile slug:", err)
+	}
+
+	out, err := json.MarshalIndent(app, "", "    ")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	os.Stdout.Write(append(out, '\n'))
+}
+
+// stacks runs a "stacks" subcommand on the stack images of the
+// libcontainer driver.
+func stacks(command string, args []string) {
+	switch command {
+	case "gc":
+		removed, err := hsup.GCStackImages(hsup.DefaultWorkDir)
+		for _, name := range removed {
+			log.Println("removed stack image", name)
+		}
+		if err != nil {
+			log.Fatalln("could not remove stack images:", err)
+		}
+		removed, err = hsup.GCReleaseLayers(hsup.DefaultWorkDir)
+		for _, name := range removed {
+			log.Println("removed release layer", name)
+		}
+		if err != nil {
+			log.Fatalln("could not remove release layers:", err)
+		}
+	case "refresh":
+		names, err := hsup.RefreshStacksManifest(hsup.DefaultWorkDir)
+		if err != nil {
+			log.Fatalln("could not refresh stacks manifest:", err)
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+	case "register":
+		err := hsup.RegisterStackImage(hsup.DefaultWorkDir, args[0],
+			args[1], args[2])
+		if err != nil {
+			log.Fatalln("could not register stack image:", err)
+		}
+	}
+}
+
+// readControl reads the control file of a sub-invocation, either from
+// a path or from an inherited file descriptor.
+func readControl(path, fd string) (*hsup.Startup, error) {
+	var f *os.File
+	if path != "" {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			return nil, err
+		}
+	} else {
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HSUP_CONTROL_FD %q: %v",
+				fd, err)
+		}
+		f = os.NewFile(uintptr(n), "control")
+	}
+	defer f.Close()
+
+	return hsup.ReadStartup(f)
+}
+
 func logplexDefault(p *hsup.Processes) *url.URL {
 	if CmdLogplexURL == nil {
 		return p.LogplexURL
@@ -313,36 +515,66 @@ func main() {
 		return
 	}
 	dumpOnSignal()
-	var err error
 	log.Println("Starting hsup")
 
-	controlGob := os.Getenv("HSUP_CONTROL_GOB")
+	controlFile := os.Getenv("HSUP_CONTROL_FILE")
+	controlFD := os.Getenv("HSUP_CONTROL_FD")
 	token := os.Getenv("HEROKU_ACCESS_TOKEN")
 	controlDir := os.Getenv("HSUP_CONTROL_DIR")
-
-	if token == "" && controlDir == "" && controlGob == "" {
-		// Omit mentioning "HSUP_CONTROL_GOB" as guidance to
-		// avoid this error even if it is technically accurate
-		// because it is only ever submitted by
-		// self-invocations of hsup, i.e. that is invariably a
-		// bug and not useful guidance for most humans.
-		log.Fatal("need HEROKU_ACCESS_TOKEN or HSUP_CONTROL_DIR")
-	}
+	appDir := os.Getenv("HSUP_APP_DIR")
+	SubInvocation = controlFile != "" || controlFD != ""
 
 	var hs hsup.Startup
 
 	var args []string
-	if controlGob != "" {
-		hs.FromBase64Gob(controlGob)
+	if SubInvocation {
+		sub, err := readControl(controlFile, controlFD)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		hs = *sub
 	} else {
 		args = fromOptions(&hs)
 	}
 
+	if SourceBuild != nil {
+		compileSource(SourceBuild)
+		return
+	}
+	if StacksCommand != "" {
+		stacks(StacksCommand, args[1:])
+		return
+	}
+	if DockerPrune {
+		removed, err := hsup.PruneDockerImages()
+		for _, name := range removed {
+			log.Println("removed image", name)
+		}
+		if err != nil {
+			log.Fatalln("could not prune docker images:", err)
+		}
+		return
+	}
+
+	if token == "" && controlDir == "" && appDir == "" && !SubInvocation {
+		// Omit mentioning "HSUP_CONTROL_FILE" and
+		// "HSUP_CONTROL_FD" as guidance to avoid this error
+		// even if it is technically accurate because they are
+		// only ever submitted by self-invocations of hsup,
+		// i.e. that is invariably a bug and not useful
+		// guidance for most humans.
+		log.Fatal("need HEROKU_ACCESS_TOKEN, HSUP_CONTROL_DIR " +
+			"or HSUP_APP_DIR")
+	}
+
 	var poller hsup.Notifier
 	switch {
-	case controlGob != "":
-		poller = &hsup.GobNotifier{Payload: controlGob}
+	case SubInvocation:
+		poller = &hsup.StartupNotifier{Hs: &hs}
 	case token != "":
+		if MultiApp {
+			log.Fatal("--multi-app needs HSUP_CONTROL_DIR")
+		}
 		if hs.App.Name == "" {
 			log.Fatal("specify --app")
 		}
@@ -351,19 +583,51 @@ func main() {
 		heroku.DefaultTransport.Password = token
 		cl := heroku.NewService(heroku.DefaultClient)
 		poller = &hsup.APIPoller{Cl: cl, Hs: &hs}
+	case appDir != "":
+		if MultiApp {
+			log.Fatal("--multi-app needs HSUP_CONTROL_DIR")
+		}
+		poller = &hsup.ProcfilePoller{Hs: &hs, Dir: appDir}
+	case controlDir != "" && MultiApp:
+		poller = &hsup.MultiDirPoller{Hs: &hs, Dir: controlDir}
 	case controlDir != "":
 		poller = &hsup.DirPoller{Hs: &hs, Dir: controlDir}
 	default:
 		panic("one of token or watch dir ought to have been defined")
 	}
 
-	procs := poller.Notify()
 	signals := make(chan os.Signal)
 	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	exitVal := supervise(poller, &hs, args, MultiApp, signals)
+	if controlApi != nil {
+		controlApi.Close()
+	}
+	os.Exit(exitVal)
+}
+
+// supervise rolls out the releases the poller notifies of, until hsup
+// is to exit: once one-shot processes all exited, on a deadly signal,
+// or when a release can't be started.  With multiApp, the releases are
+// those of several applications, see MultiApp.  It returns the exit
+// status of hsup.
+func supervise(poller hsup.Notifier, hs *hsup.Startup, args []string,
+	multiApp bool, signals <-chan os.Signal) int {
+	procs := poller.Notify()
+
+	// apps holds the processes of every supervised application by
+	// name.  Unless supervising multiple applications, there is
+	// only ever one, under the name "", so that a release
+	// renaming the application still replaces the previous one.
+	apps := make(map[string]*hsup.Processes)
 	var p *hsup.Processes
 
 	if hs.ControlSocket != "" {
-		controlApi, procs = hsup.NewControlAPI(hs.ControlSocket, procs)
+		newAPI := hsup.NewControlAPI
+		if multiApp {
+			newAPI = hsup.NewMultiAppControlAPI
+		}
+		controlApi = newAPI(hs.ControlSocket)
 		go func() {
 			if err := controlApi.Listen(); err != nil {
 				log.Fatal(err)
@@ -371,20 +635,97 @@ func main() {
 		}()
 	}
 
+	// Builds, and release phases, run in the background so that
+	// rolling out a release neither holds up other applications
+	// nor deadly signals.  latest holds the last release notified
+	// for every application, any other release being discarded
+	// once built, and building the applications with a build
+	// under way, so that an application only ever builds one
+	// release at a time.
+	builds := make(chan *buildResult)
+	done := make(chan struct{})
+	defer close(done)
+	latest := make(map[string]*hsup.Processes)
+	building := make(map[string]bool)
+	appName := func(p *hsup.Processes) string {
+		if multiApp {
+			return p.AppName()
+		}
+		return ""
+	}
+	buildAsync := func(p *hsup.Processes) {
+		building[appName(p)] = true
+		go func() {
+			r := &buildResult{procs: p, err: build(p, hs)}
+			select {
+			case builds <- r:
+			case <-done:
+			}
+		}()
+	}
+
+	var exits <-chan []*hsup.ExitStatus
 	for {
 		select {
 		case newProcs := <-procs:
-			if p != nil {
-				stopParallel(p)
-			}
-			p = newProcs
-			if err = start(p, &hs, args); err != nil {
+			name := appName(newProcs)
+			latest[name] = newProcs
+			if newProcs.Removed {
+				if old := apps[name]; old != nil {
+					log.Printf("stopping removed app %s", name)
+					stopParallel(old)
+					delete(apps, name)
+				}
 				if controlApi != nil {
-					controlApi.Close()
+					controlApi.SetProcesses(newProcs)
+				}
+				if !building[name] {
+					delete(latest, name)
+				}
+				continue
+			}
+			if !building[name] {
+				buildAsync(newProcs)
+			}
+		case r := <-builds:
+			newProcs := r.procs
+			name := appName(newProcs)
+			delete(building, name)
+			if next := latest[name]; next != newProcs {
+				log.Printf("not rolling out superseded release %s",
+					newProcs.Rel.Name())
+				if next.Removed {
+					delete(latest, name)
+				} else {
+					buildAsync(next)
 				}
-				log.Fatalln("could not start process:", err)
+				continue
 			}
-		case statv := <-statuses(p):
+			if err := r.err; err != nil {
+				_, isReleasePhase := err.(*hsup.ReleasePhaseError)
+				if isReleasePhase || multiApp {
+					// Keep the previous release, and
+					// other applications, running.
+					log.Printf("not rolling out release %s: %v",
+						newProcs.Rel.Name(), err)
+					continue
+				}
+				log.Println("could not start process:", err)
+				return 1
+			}
+
+			if old := apps[name]; old != nil {
+				stopParallel(old)
+			}
+			apps[name] = newProcs
+			p = newProcs
+			start(p, hs, args)
+			if controlApi != nil {
+				controlApi.SetProcesses(p)
+			}
+			reconcile(p, hs)
+			exits = statuses(p)
+		case statv := <-exits:
 			exitVal := 0
 			for i, s := range statv {
 				eName := p.Executors[i].Name()
@@ -401,26 +742,16 @@ func main() {
 						exitVal = s.Code
 					}
 				}
-				if controlApi != nil {
-					controlApi.Close()
-				}
-				os.Exit(exitVal)
-			}
-
-			if controlApi != nil {
-				controlApi.Close()
+				return exitVal
 			}
-			os.Exit(0)
+			return 0
 		case sig := <-signals:
 			log.Println("hsup caught a deadly signal:", sig)
-			if p != nil {
-				stopParallel(p)
+			for _, app := range apps {
+				stopParallel(app)
 			}
 			// TODO: capture the exit status from executors
-			if controlApi != nil {
-				controlApi.Close()
-			}
-			os.Exit(1)
+			return 1
 		}
 	}
 }
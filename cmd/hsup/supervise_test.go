@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/heroku/hsup"
+)
+
+// fakeNotifier notifies the supervisor of the releases a test rolls
+// out.
+type fakeNotifier struct {
+	procs chan *hsup.Processes
+}
+
+func (n *fakeNotifier) Notify() <-chan *hsup.Processes {
+	return n.procs
+}
+
+// supervisorHarness runs the supervisor loop of hsup in-process, on a
+// FakeDynoDriver, for tests to roll out releases to and watch the dynos
+// of.
+type supervisorHarness struct {
+	t        *testing.T
+	dd       *hsup.FakeDynoDriver
+	hs       *hsup.Startup
+	notifier *fakeNotifier
+	signals  chan os.Signal
+	exited   chan int
+}
+
+func newSupervisorHarness(t *testing.T, dd *hsup.FakeDynoDriver,
+	oneShot bool, args ...string) *supervisorHarness {
+	return newMultiAppHarness(t, dd, oneShot, false, args...)
+}
+
+// newMultiAppHarness is newSupervisorHarness, supervising several
+// applications with multiApp.
+func newMultiAppHarness(t *testing.T, dd *hsup.FakeDynoDriver,
+	oneShot, multiApp bool, args ...string) *supervisorHarness {
+	h := &supervisorHarness{
+		t:  t,
+		dd: dd,
+		hs: &hsup.Startup{
+			Action:      hsup.Start,
+			Driver:      dd,
+			OneShot:     oneShot,
+			StartNumber: 1,
+		},
+		notifier: &fakeNotifier{procs: make(chan *hsup.Processes)},
+		signals:  make(chan os.Signal),
+		exited:   make(chan int, 1),
+	}
+	go func() {
+		h.exited <- supervise(h.notifier, h.hs, args, multiApp,
+			h.signals)
+	}()
+	return h
+}
+
+// release rolls out a version of the "sushi" application, running
+// formations.
+func (h *supervisorHarness) release(version int,
+	formations ...hsup.FormationSerializable) {
+	hs := *h.hs
+	hs.App = hsup.AppSerializable{
+		Name:      "sushi",
+		Version:   version,
+		Processes: formations,
+	}
+	h.notifier.procs <- hs.Procs()
+}
+
+// eventually waits for cond to hold, failing the test with what
+// happened to dynos otherwise.
+func (h *supervisorHarness) eventually(what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("expected %s; events: %v", what,
+				h.dd.Events())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitFor waits for the dynos running to be those expected.
+func (h *supervisorHarness) waitFor(expected ...string) {
+	h.eventually(fmt.Sprintf("%q to run", expected), func() bool {
+		running := h.dd.Running()
+		return reflect.DeepEqual(running, expected) ||
+			len(running) == 0 && len(expected) == 0
+	})
+}
+
+// count returns how many times action happened to a dyno.
+func (h *supervisorHarness) count(dyno, action string) int {
+	var n int
+	for _, e := range h.dd.Events() {
+		if e.Dyno == dyno && e.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// exitCode waits for the supervisor to exit, and returns its status.
+func (h *supervisorHarness) exitCode() int {
+	select {
+	case code := <-h.exited:
+		return code
+	case <-time.After(5 * time.Second):
+		h.t.Fatalf("expected hsup to exit; events: %v", h.dd.Events())
+		return -1
+	}
+}
+
+// stop sends hsup a deadly signal, and waits for it to exit.
+func (h *supervisorHarness) stop() int {
+	h.signals <- syscall.SIGTERM
+	return h.exitCode()
+}
+
+func formation(processType string, quantity int) hsup.FormationSerializable {
+	return hsup.FormationSerializable{
+		FArgs:     []string{"./bin/" + processType},
+		FQuantity: quantity,
+		FType:     processType,
+	}
+}
+
+func TestSuperviseRestartsExitedDynos(t *testing.T) {
+	dd := &hsup.FakeDynoDriver{
+		ExitCodes: map[string][]int{"web.1": {1}},
+	}
+	h := newSupervisorHarness(t, dd, false)
+	h.release(1, formation("web", 1), formation("worker", 1))
+	h.eventually("web.1 to be restarted", func() bool {
+		return h.count("web.1", hsup.FakeStart) == 2
+	})
+	h.waitFor("sushi-1 web.1", "sushi-1 worker.1")
+
+	if err := dd.Exit("worker.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	h.eventually("worker.1 to be restarted", func() bool {
+		return h.count("worker.1", hsup.FakeStart) == 2
+	})
+	h.waitFor("sushi-1 web.1", "sushi-1 worker.1")
+	if code := h.stop(); code != 1 {
+		t.Fatalf("expected exit status 1, got %d", code)
+	}
+	h.waitFor()
+}
+
+func TestSuperviseScales(t *testing.T) {
+	h := newSupervisorHarness(t, &hsup.FakeDynoDriver{}, false,
+		"web=3", "worker=0")
+	h.release(1, formation("web", 1), formation("worker", 1))
+	h.waitFor("sushi-1 web.1", "sushi-1 web.2", "sushi-1 web.3")
+	h.stop()
+
+	// Without arguments, one dyno of each process type scaled up.
+	h = newSupervisorHarness(t, &hsup.FakeDynoDriver{}, false)
+	h.release(1, formation("web", 2), formation("worker", 0))
+	h.waitFor("sushi-1 web.1")
+	h.stop()
+}
+
+func TestSuperviseRollsOutReleases(t *testing.T) {
+	dd := &hsup.FakeDynoDriver{StopDelay: 10 * time.Millisecond}
+	h := newSupervisorHarness(t, dd, false)
+	h.release(1, formation("web", 1))
+	h.waitFor("sushi-1 web.1")
+
+	h.release(2, formation("web", 1))
+	h.waitFor("sushi-2 web.1")
+
+	// The dynos of a release stop before those of the next start.
+	stopped, started := -1, -1
+	for i, e := range dd.Events() {
+		switch {
+		case e.Release == "sushi-1" && e.Action == hsup.FakeExit:
+			stopped = i
+		case e.Release == "sushi-2" && e.Action == hsup.FakeStart:
+			started = i
+		}
+	}
+	if stopped < 0 {
+		t.Fatalf("expected sushi-1 to exit, got %v", dd.Events())
+	}
+	if started < stopped {
+		t.Fatalf("expected sushi-1 to stop first, got %v", dd.Events())
+	}
+	h.stop()
+}
+
+func TestSuperviseKeepsReleaseWhenReleasePhaseFails(t *testing.T) {
+	dd := &hsup.FakeDynoDriver{
+		ExitCodes: map[string][]int{"release.1": {0, 3}},
+	}
+	h := newSupervisorHarness(t, dd, false)
+	release := formation("release", 1)
+	h.release(1, formation("web", 1), release)
+	h.waitFor("sushi-1 web.1")
+
+	// Releases are rolled out in turn: once sushi-3 runs, sushi-2 was
+	// turned away.
+	h.release(2, formation("web", 1), release)
+	h.release(3, formation("web", 1))
+	h.waitFor("sushi-3 web.1")
+	for _, e := range dd.Events() {
+		if e.Release == "sushi-2" && (e.Dyno == "web.1" ||
+			e.Action == hsup.FakeReconcile) {
+			t.Fatalf("expected sushi-2 not to be rolled out, got %v",
+				dd.Events())
+		}
+	}
+	h.eventually("sushi-1 and sushi-3 to be reconciled", func() bool {
+		return h.count("", hsup.FakeReconcile) == 2
+	})
+	h.stop()
+}
+
+func TestSuperviseExitsWhenBuildFails(t *testing.T) {
+	dd := &hsup.FakeDynoDriver{
+		BuildErrs: map[string]error{"sushi-1": errors.New("no luck")},
+	}
+	h := newSupervisorHarness(t, dd, false)
+	h.release(1, formation("web", 1))
+	if code := h.exitCode(); code != 1 {
+		t.Fatalf("expected exit status 1, got %d", code)
+	}
+}
+
+func TestSuperviseOneShotExitCodes(t *testing.T) {
+	dd := &hsup.FakeDynoDriver{
+		ExitCodes: map[string][]int{"web.1": {3}, "worker.1": {5}},
+	}
+	h := newSupervisorHarness(t, dd, true, "web", "worker")
+	h.release(1, formation("web", 1), formation("worker", 1))
+	if code := h.exitCode(); code != 3 {
+		t.Fatalf("expected the exit status of web.1, 3, got %d; "+
+			"events: %v", code, dd.Events())
+	}
+}
+
+func TestSuperviseStopsRemovedApps(t *testing.T) {
+	dd := &hsup.FakeDynoDriver{}
+	h := newMultiAppHarness(t, dd, false, true)
+	h.release(1, formation("web", 1))
+	h.waitFor("sushi-1 web.1")
+
+	hs := *h.hs
+	hs.App = hsup.AppSerializable{Name: "sushi"}
+	removed := hs.Procs()
+	removed.Removed = true
+	h.notifier.procs <- removed
+	h.waitFor()
+	if n := h.count("", hsup.FakeBuild); n != 1 {
+		t.Fatalf("expected only sushi-1 to be built, got %v",
+			dd.Events())
+	}
+	h.stop()
+}
+
+func TestSuperviseBuildsInTheBackground(t *testing.T) {
+	dd := &hsup.FakeDynoDriver{
+		BuildDelays: map[string]time.Duration{"sushi-1": time.Hour},
+	}
+	h := newMultiAppHarness(t, dd, false, true)
+	h.release(1, formation("web", 1))
+
+	hs := *h.hs
+	hs.App = hsup.AppSerializable{
+		Name:      "ramen",
+		Version:   1,
+		Processes: []hsup.FormationSerializable{formation("web", 1)},
+	}
+	h.notifier.procs <- hs.Procs()
+	h.waitFor("ramen-1 web.1")
+	if code := h.stop(); code != 1 {
+		t.Fatalf("expected hsup to exit with 1, got %d", code)
+	}
+}
+
+func TestSuperviseDiscardsSupersededReleases(t *testing.T) {
+	dd := &hsup.FakeDynoDriver{
+		BuildDelays: map[string]time.Duration{
+			"sushi-1": 50 * time.Millisecond,
+		},
+	}
+	h := newSupervisorHarness(t, dd, false)
+	h.release(1, formation("web", 1))
+	h.release(2, formation("web", 1))
+	h.waitFor("sushi-2 web.1")
+	h.stop()
+	for _, e := range dd.Events() {
+		if e.Release == "sushi-1" && e.Action == hsup.FakeStart {
+			t.Fatalf("expected sushi-1 not to start, got %v",
+				dd.Events())
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,6 +22,12 @@ type StatusResponse struct {
 	Processes map[string]ProcessStatus
 }
 
+// MultiAppStatusResponse is the status of every application supervised
+// by a multi-app hsup, by name.
+type MultiAppStatusResponse struct {
+	Apps map[string]StatusResponse
+}
+
 type StopRequest struct {
 	Processes []string
 }
@@ -31,24 +38,51 @@ type StopResponse struct {
 
 type ControlAPI struct {
 	*http.ServeMux
-	processes *Processes
-	socket    string
-	listener  net.Listener
+	socket   string
+	listener net.Listener
+
+	// apps maps application names to their current processes.
+	// Unless multiApp is set, there is only ever one entry, under
+	// the name "", replaced by every new release.
+	multiApp    bool
+	appsProtect sync.RWMutex
+	apps        map[string]*Processes
 }
 
 var ErrSocketInUse = errors.New("socket in use")
 
 const SocketPerm os.FileMode = 0770
 
-func (c *ControlAPI) Tee(procs <-chan *Processes) <-chan *Processes {
-	out := make(chan *Processes)
-	go func() {
-		for {
-			p := <-procs
-			c.processes = p
-			out <- p
+// SetProcesses makes the API serve the processes of a release once it
+// was rolled out, replacing those of the previous release of the
+// application, or removes the application if p is Removed.
+func (c *ControlAPI) SetProcesses(p *Processes) {
+	c.appsProtect.Lock()
+	defer c.appsProtect.Unlock()
+
+	var name string
+	if c.multiApp {
+		name = p.AppName()
+	}
+	if p.Removed {
+		delete(c.apps, name)
+		return
+	}
+	c.apps[name] = p
+}
+
+// processes returns the processes of one application, or of all of
+// them when appName is "*".
+func (c *ControlAPI) processes(appName string) []*Processes {
+	c.appsProtect.RLock()
+	defer c.appsProtect.RUnlock()
+
+	var out []*Processes
+	for _, p := range c.apps {
+		if appName == "*" || appName == p.AppName() {
+			out = append(out, p)
 		}
-	}()
+	}
 	return out
 }
 
@@ -117,27 +151,93 @@ func (c *ControlAPI) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
+// handleStatus serves the status of all processes.  With multiple
+// applications, whose process types may well collide, it is keyed by
+// application.
 func (c *ControlAPI) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !c.multiApp {
+		c.serveStatus(w, r, c.processes("*"))
+		return
+	}
 	if r.Method != "GET" {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
 
-	resp := StatusResponse{make(map[string]ProcessStatus)}
-	for _, e := range c.processes.Executors {
-		address, port := e.IPInfo()
-		resp.Processes[e.ProcessType] = ProcessStatus{
-			IPAddress: address,
-			Port:      port,
-			Status:    e.State.String(),
-		}
+	resp := MultiAppStatusResponse{make(map[string]StatusResponse)}
+	for _, p := range c.processes("*") {
+		resp.Apps[p.AppName()] = processStatus([]*Processes{p})
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
+// handleControlStop stops processes by type.  With multiple
+// applications, stopping is scoped to one of them, under "/apps/".
 func (c *ControlAPI) handleControlStop(w http.ResponseWriter, r *http.Request) {
+	if c.multiApp {
+		http.Error(w, "stopping processes is scoped to an app "+
+			"with multiple apps: use /apps/<name>/control/stop",
+			http.StatusBadRequest)
+		return
+	}
+	c.serveControlStop(w, r, c.processes("*"))
+}
+
+// handleApp serves the status and control endpoints scoped to a single
+// application, e.g. "/apps/myapp/status".
+func (c *ControlAPI) handleApp(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/apps/"), "/", 2)
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	procs := c.processes(parts[0])
+	if len(procs) == 0 {
+		http.Error(w, "no such app: "+parts[0], http.StatusNotFound)
+		return
+	}
+
+	switch parts[1] {
+	case "status":
+		c.serveStatus(w, r, procs)
+	case "control/stop":
+		c.serveControlStop(w, r, procs)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (c *ControlAPI) serveStatus(w http.ResponseWriter, r *http.Request,
+	procs []*Processes) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(processStatus(procs))
+}
+
+func processStatus(procs []*Processes) StatusResponse {
+	resp := StatusResponse{make(map[string]ProcessStatus)}
+	for _, p := range procs {
+		for _, e := range p.Executors {
+			address, port := e.IPInfo()
+			resp.Processes[e.ProcessType] = ProcessStatus{
+				IPAddress: address,
+				Port:      port,
+				Status:    e.State.String(),
+			}
+		}
+	}
+	return resp
+}
+
+func (c *ControlAPI) serveControlStop(w http.ResponseWriter, r *http.Request,
+	procs []*Processes) {
 	if r.Method != "POST" {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
@@ -151,11 +251,13 @@ func (c *ControlAPI) handleControlStop(w http.ResponseWriter, r *http.Request) {
 
 	stopped := []string{}
 	for _, p := range stop.Processes {
-		for _, e := range c.processes.Executors {
-			if e.ProcessType == p {
-				log.Printf("Retiring %s", p)
-				e.Trigger(Retire)
-				stopped = append(stopped, p)
+		for _, procs := range procs {
+			for _, e := range procs.Executors {
+				if e.ProcessType == p {
+					log.Printf("Retiring %s", p)
+					e.Trigger(Retire)
+					stopped = append(stopped, p)
+				}
 			}
 		}
 	}
@@ -164,11 +266,30 @@ func (c *ControlAPI) handleControlStop(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(StopResponse{stopped})
 }
 
-func NewControlAPI(socket string, processes <-chan *Processes) (*ControlAPI, <-chan *Processes) {
-	api := &ControlAPI{http.NewServeMux(), nil, socket, nil}
+// NewControlAPI creates the API of an hsup listening on socket, serving
+// the processes it is told about, see SetProcesses.
+func NewControlAPI(socket string) *ControlAPI {
+	return newControlAPI(socket, false)
+}
+
+// NewMultiAppControlAPI is like NewControlAPI, but keeps track of the
+// processes of several applications at once, as emitted by
+// MultiDirPoller.
+func NewMultiAppControlAPI(socket string) *ControlAPI {
+	return newControlAPI(socket, true)
+}
+
+func newControlAPI(socket string, multiApp bool) *ControlAPI {
+	api := &ControlAPI{
+		ServeMux: http.NewServeMux(),
+		socket:   socket,
+		multiApp: multiApp,
+		apps:     make(map[string]*Processes),
+	}
 	api.HandleFunc("/control/stop", api.handleControlStop)
+	api.HandleFunc("/apps/", api.handleApp)
 	api.HandleFunc("/status", api.handleStatus)
 	api.HandleFunc("/health", api.handleHealth)
 
-	return api, api.Tee(processes)
+	return api
 }
@@ -15,8 +15,8 @@ import (
 )
 
 func TestControlApiGetStatus(t *testing.T) {
-	c, _ := NewControlAPI("", nil)
-	c.processes = &Processes{
+	c := NewControlAPI("")
+	c.SetProcesses(&Processes{
 		Executors: []*Executor{
 			{
 				ProcessType: "web",
@@ -29,7 +29,7 @@ func TestControlApiGetStatus(t *testing.T) {
 				IPInfo:      stubIPInfo("1.1.1.1", 6000),
 			},
 		},
-	}
+	})
 
 	w := httptest.NewRecorder()
 	r, err := http.NewRequest("GET", "http://example.com/status", nil)
@@ -60,8 +60,8 @@ func TestControlApiPostControlStop(t *testing.T) {
 		Processes: []string{"web", "worker"},
 	})
 
-	c, _ := NewControlAPI("", nil)
-	c.processes = &Processes{
+	c := NewControlAPI("")
+	c.SetProcesses(&Processes{
 		Executors: []*Executor{
 			{
 				ProcessType: "web",
@@ -72,9 +72,9 @@ func TestControlApiPostControlStop(t *testing.T) {
 				NewInput:    make(chan DynoInput),
 			},
 		},
-	}
+	})
 
-	for _, ex := range c.processes.Executors {
+	for _, ex := range c.processes("")[0].Executors {
 		go func(input chan DynoInput) {
 			<-input // drain channels
 		}(ex.NewInput)
@@ -96,10 +96,99 @@ func TestControlApiPostControlStop(t *testing.T) {
 	assert(t, "worker", response.StoppedProcesses[1])
 }
 
+func TestControlApiAppScopedStatus(t *testing.T) {
+	c := NewMultiAppControlAPI("")
+	for _, app := range []string{"sushi", "ramen"} {
+		c.SetProcesses(&Processes{
+			Rel: &Release{appName: app},
+			Executors: []*Executor{
+				{
+					ProcessType: app + "-web",
+					State:       Started,
+					IPInfo:      stubIPInfo("0.0.0.0", 5000),
+				},
+			},
+		})
+	}
+
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "http://example.com/apps/sushi/status", nil)
+	assert(t, nil, err)
+
+	c.ServeHTTP(w, r)
+	assert(t, http.StatusOK, w.Code)
+
+	var response StatusResponse
+	err = json.NewDecoder(w.Body).Decode(&response)
+	assert(t, nil, err)
+	assert(t, 1, len(response.Processes))
+	assert(t, "Started", response.Processes["sushi-web"].Status)
+
+	w = httptest.NewRecorder()
+	r, err = http.NewRequest("GET", "http://example.com/status", nil)
+	assert(t, nil, err)
+
+	c.ServeHTTP(w, r)
+	var all MultiAppStatusResponse
+	err = json.NewDecoder(w.Body).Decode(&all)
+	assert(t, nil, err)
+	assert(t, 2, len(all.Apps))
+	assert(t, "Started", all.Apps["ramen"].Processes["ramen-web"].Status)
+
+	w = httptest.NewRecorder()
+	r, err = http.NewRequest("GET", "http://example.com/apps/udon/status", nil)
+	assert(t, nil, err)
+
+	c.ServeHTTP(w, r)
+	assert(t, http.StatusNotFound, w.Code)
+
+	// Removed apps are no longer reported.
+	c.SetProcesses(&Processes{Rel: &Release{appName: "ramen"}, Removed: true})
+	w = httptest.NewRecorder()
+	r, err = http.NewRequest("GET", "http://example.com/apps/ramen/status", nil)
+	assert(t, nil, err)
+
+	c.ServeHTTP(w, r)
+	assert(t, http.StatusNotFound, w.Code)
+}
+
+func TestControlApiMultiAppStopIsScoped(t *testing.T) {
+	c := NewMultiAppControlAPI("")
+	for _, app := range []string{"sushi", "ramen"} {
+		c.SetProcesses(&Processes{
+			Rel: &Release{appName: app},
+			Executors: []*Executor{
+				{
+					ProcessType: "web",
+					NewInput:    make(chan DynoInput, 1),
+				},
+			},
+		})
+	}
+
+	stop := func(path string) *httptest.ResponseRecorder {
+		body := bytes.NewBuffer([]byte{})
+		json.NewEncoder(body).Encode(StopRequest{
+			Processes: []string{"web"},
+		})
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("POST", "http://example.com"+path, body)
+		assert(t, nil, err)
+		c.ServeHTTP(w, r)
+		return w
+	}
+
+	assert(t, http.StatusBadRequest, stop("/control/stop").Code)
+
+	w := stop("/apps/sushi/control/stop")
+	assert(t, http.StatusOK, w.Code)
+	assert(t, 1, len(c.processes("sushi")[0].Executors[0].NewInput))
+	assert(t, 0, len(c.processes("ramen")[0].Executors[0].NewInput))
+}
+
 func TestListenCreatesAndRemovesSocket(t *testing.T) {
 	socket := filepath.Join("/", "tmp", uuid.New()+".sock")
-	procs := make(chan *Processes)
-	api, _ := NewControlAPI(socket, procs)
+	api := NewControlAPI(socket)
 
 	go func(t *testing.T) {
 		if err := api.Listen(); !isAllowedError(err) {
@@ -134,7 +223,7 @@ func TestListenCreatesAndRemovesSocket(t *testing.T) {
 
 func TestListenErrorsSocketInUse(t *testing.T) {
 	socket := filepath.Join("/", "tmp", uuid.New()+".sock")
-	api, _ := NewControlAPI(socket, make(chan *Processes))
+	api := NewControlAPI(socket)
 	go func(t *testing.T) {
 		if err := api.Listen(); !isAllowedError(err) {
 			t.Fatal(err)
@@ -149,7 +238,7 @@ func TestListenErrorsSocketInUse(t *testing.T) {
 	})
 	assert(t, nil, err)
 
-	anotherApi, _ := NewControlAPI(socket, make(chan *Processes))
+	anotherApi := NewControlAPI(socket)
 	assert(t, ErrSocketInUse, anotherApi.Listen())
 }
 
@@ -161,7 +250,7 @@ func TestNewListenerReusesSocket(t *testing.T) {
 	_, err = os.Stat(socket)
 	assert(t, nil, err)
 
-	api, _ := NewControlAPI(socket, make(chan *Processes))
+	api := NewControlAPI(socket)
 
 	go func(t *testing.T) {
 		if err := api.Listen(); !isAllowedError(err) {
@@ -1,7 +1,10 @@
 package hsup
 
 import (
+	"io/ioutil"
 	"log"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -21,32 +24,119 @@ func newControlDir() interface{} {
 func (dp *DirPoller) Notify() <-chan *Processes {
 	out := make(chan *Processes)
 	dp.c = newConf(newControlDir, dp.Dir)
+	dp.c.validate = dp.Hs.validateApp
 	go dp.pollSynchronous(out)
 	return out
 }
 
 func (dp *DirPoller) pollSynchronous(out chan<- *Processes) {
 	for {
-		var hs Startup
-
-		newInfo, err := dp.c.Notify()
+		procs, err := pollConf(dp.c, dp.Hs, "")
 		if err != nil {
 			log.Println("Could not fetch new release information:",
 				err)
-			goto wait
+		} else if procs != nil {
+			out <- procs
 		}
 
-		if !newInfo {
-			goto wait
-		}
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// MultiDirPoller watches a control directory holding one subdirectory
+// per application, each laid out like the directory watched by
+// DirPoller.  Applications are named after their subdirectory, and
+// new releases of each are emitted independently.  Once the
+// subdirectory of an application is removed, Removed processes are
+// emitted for it.
+type MultiDirPoller struct {
+	Dir string
+	Hs  *Startup
+
+	confs map[string]*conf
+}
 
-		hs = Startup{
-			App:     *dp.c.Snapshot().(*AppSerializable),
-			Driver:  dp.Hs.Driver,
-			OneShot: dp.Hs.OneShot,
+func (mp *MultiDirPoller) Notify() <-chan *Processes {
+	out := make(chan *Processes)
+	mp.confs = make(map[string]*conf)
+	go mp.pollSynchronous(out)
+	return out
+}
+
+func (mp *MultiDirPoller) pollSynchronous(out chan<- *Processes) {
+	for {
+		for _, procs := range mp.pollOnce() {
+			out <- procs
 		}
-		out <- hs.Procs()
-	wait:
+
 		time.Sleep(10 * time.Second)
 	}
 }
+
+func (mp *MultiDirPoller) pollOnce() (updated []*Processes) {
+	entries, err := ioutil.ReadDir(mp.Dir)
+	if err != nil {
+		log.Println("Could not list applications:", err)
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	for _, fi := range entries {
+		name := fi.Name()
+		if !fi.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		seen[name] = true
+
+		c, ok := mp.confs[name]
+		if !ok {
+			c = newConf(newControlDir, filepath.Join(mp.Dir, name))
+			c.validate = mp.Hs.validateApp
+			mp.confs[name] = c
+		}
+
+		procs, err := pollConf(c, mp.Hs, name)
+		if err != nil {
+			log.Printf("Could not fetch new release information "+
+				"for %s: %v", name, err)
+			continue
+		}
+		if procs != nil {
+			updated = append(updated, procs)
+		}
+	}
+
+	for name := range mp.confs {
+		if seen[name] {
+			continue
+		}
+		delete(mp.confs, name)
+		updated = append(updated, &Processes{
+			Rel:     &Release{appName: name},
+			Dd:      mp.Hs.Driver,
+			Removed: true,
+		})
+	}
+
+	return updated
+}
+
+// pollConf returns the processes of a control directory when it holds
+// a new release, or nil when nothing changed.  A non-empty appName
+// overrides the name given in the control file.
+func pollConf(c *conf, tmpl *Startup, appName string) (*Processes, error) {
+	newInfo, err := c.Notify()
+	if err != nil || !newInfo {
+		return nil, err
+	}
+
+	hs := Startup{
+		App:     *c.Snapshot().(*AppSerializable),
+		Driver:  tmpl.Driver,
+		OneShot: tmpl.OneShot,
+	}
+	if appName != "" {
+		hs.App.Name = appName
+	}
+	return hs.Procs(), nil
+}
@@ -0,0 +1,61 @@
+package hsup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMultiDirPollerPerAppReleases(t *testing.T) {
+	name := newTmpDb(t)
+	defer os.RemoveAll(name)
+
+	for _, app := range []string{"sushi", "ramen"} {
+		if err := os.Mkdir(filepath.Join(name, app), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(name, "sushi", "new"),
+		defaultFixture.json, 0400)
+
+	mp := &MultiDirPoller{
+		Dir:   name,
+		Hs:    &Startup{Action: Start, Driver: &SimpleDynoDriver{}},
+		confs: make(map[string]*conf),
+	}
+
+	updated := mp.pollOnce()
+	if len(updated) != 1 || updated[0].AppName() != "sushi" {
+		t.Fatalf("expected a release of sushi only, got %v", updated)
+	}
+	if len(updated[0].Forms) != 2 {
+		t.Fatalf("expected sushi's processes, got %v", updated[0].Forms)
+	}
+
+	// A release of one app leaves the other alone.
+	ioutil.WriteFile(filepath.Join(name, "ramen", "new"),
+		anotherFixture.json, 0400)
+
+	updated = mp.pollOnce()
+	if len(updated) != 1 || updated[0].AppName() != "ramen" {
+		t.Fatalf("expected a release of ramen only, got %v", updated)
+	}
+
+	if updated = mp.pollOnce(); len(updated) != 0 {
+		t.Fatalf("expected no releases, got %v", updated)
+	}
+
+	// Removing the directory of an app has it stopped, once.
+	if err := os.RemoveAll(filepath.Join(name, "ramen")); err != nil {
+		t.Fatal(err)
+	}
+	updated = mp.pollOnce()
+	if len(updated) != 1 || updated[0].AppName() != "ramen" ||
+		!updated[0].Removed {
+		t.Fatalf("expected ramen to be removed, got %v", updated)
+	}
+	if updated = mp.pollOnce(); len(updated) != 0 {
+		t.Fatalf("expected no releases, got %v", updated)
+	}
+}
@@ -3,18 +3,70 @@ package hsup
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/fsouza/go-dockerclient"
 	"github.com/heroku/hsup/diag"
 )
 
+// DefaultDockerStackImages maps stacks to the Docker images their
+// dynos run on.
+var DefaultDockerStackImages = map[string]string{
+	"cedar-14":  "heroku/cedar:14",
+	"heroku-16": "heroku/heroku:16",
+	"heroku-18": "heroku/heroku:18",
+	"heroku-20": "heroku/heroku:20",
+	"heroku-22": "heroku/heroku:22",
+}
+
+// DockerStackImages returns the Docker image of every stack:
+// DefaultDockerStackImages, along with the comma separated
+// "stack=image" pairs of DOCKER_STACK_IMAGES, e.g.
+// "heroku-18=heroku/heroku:18-build,custom=example/stack:1".
+func DockerStackImages() (map[string]string, error) {
+	custom, err := envPairs("DOCKER_STACK_IMAGES", "stack=image")
+	if err != nil {
+		return nil, err
+	}
+	images := make(map[string]string)
+	for stack, image := range DefaultDockerStackImages {
+		images[stack] = image
+	}
+	for stack, image := range custom {
+		images[stack] = image
+	}
+	return images, nil
+}
+
+// envPairs parses the comma separated "key=value" pairs of an
+// environment variable, format describing them in errors.
+func envPairs(name, format string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return pairs, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid %s entry %q, expected %s",
+				name, pair, format)
+		}
+		pairs[parts[0]] = parts[1]
+	}
+	return pairs, nil
+}
+
 type DockerStackImage struct {
 	stack string
 	image docker.APIImages
@@ -22,12 +74,31 @@ type DockerStackImage struct {
 
 type Docker struct {
 	c            *docker.Client
+	api          *dockerAPI
 	cacheEnabled bool
+
+	// network is the Docker network dynos are attached to, rather
+	// than the default bridge.
+	network string
+
+	// hostPorts are the host ports the first dyno of each process
+	// type publishes its PORT on, the next ones taking the ports
+	// following it.  Dynos of other process types publish theirs on
+	// random host ports, unless attached to network.
+	hostPorts map[string]int
+
+	// sizes are the dyno sizes of process types, and defaultSize that
+	// of the others, if any.
+	sizes       map[string]DynoSize
+	defaultSize *DynoSize
 }
 
 func (d *Docker) Connect() (err error) {
 	// cache is disabled by default, unless explicitly enabled
 	d.cacheEnabled, _ = strconv.ParseBool(os.Getenv("DOCKER_IMAGE_CACHE"))
+	if err := d.configureDynos(); err != nil {
+		return err
+	}
 
 	endpoint := os.Getenv("DOCKER_HOST")
 	if endpoint == "" {
@@ -46,10 +117,60 @@ func (d *Docker) Connect() (err error) {
 		ca := certPath + "/ca.pem"
 		d.c, err = docker.NewTLSClient(endpoint, cert, key, ca)
 	}
+	if err != nil {
+		return err
+	}
+	d.api, err = newDockerAPI(endpoint, d.c)
 	return err
 }
 
-func (d *Docker) StackStat(stack string) (*DockerStackImage, error) {
+// configureDynos reads the networking and dyno sizes of dynos from
+// DOCKER_NETWORK, DOCKER_HOST_PORTS, DOCKER_DYNO_SIZE and
+// DOCKER_DYNO_SIZES.
+func (d *Docker) configureDynos() error {
+	d.network = os.Getenv("DOCKER_NETWORK")
+
+	ports, err := envPairs("DOCKER_HOST_PORTS", "type=port")
+	if err != nil {
+		return err
+	}
+	d.hostPorts = make(map[string]int)
+	for processType, port := range ports {
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p > 65535 {
+			return fmt.Errorf("invalid DOCKER_HOST_PORTS port %q "+
+				"of %s", port, processType)
+		}
+		d.hostPorts[processType] = p
+	}
+
+	d.sizes, d.defaultSize, err = readDynoSizes("DOCKER_DYNO_SIZE",
+		"DOCKER_DYNO_SIZES")
+	return err
+}
+
+// dynoSize returns the size of dynos of a process type, or nil when
+// their resources are not limited.
+func (d *Docker) dynoSize(processType string) *DynoSize {
+	if size, ok := d.sizes[processType]; ok {
+		return &size
+	}
+	return d.defaultSize
+}
+
+// hostPort returns the host port the dyno publishes its PORT on, or 0
+// to let Docker pick one.
+func (d *Docker) hostPort(processType string, processID int) int {
+	port, ok := d.hostPorts[processType]
+	if !ok {
+		return 0
+	}
+	return port + processID - 1
+}
+
+// StackStat looks up the Docker image of a stack, or returns nil if
+// it is not there.
+func (d *Docker) StackStat(stack, image string) (*DockerStackImage, error) {
 	si := DockerStackImage{
 		stack: stack,
 	}
@@ -59,10 +180,14 @@ func (d *Docker) StackStat(stack string) (*DockerStackImage, error) {
 		return nil, err
 	}
 
-	for _, image := range images {
-		for _, tag := range image.RepoTags {
-			if tag == stack {
-				si.image = image
+	// Docker tags images without one explicitly as "latest".
+	if _, tag := docker.ParseRepositoryTag(image); tag == "" {
+		image += ":latest"
+	}
+	for _, img := range images {
+		for _, tag := range img.RepoTags {
+			if tag == image {
+				si.image = img
 				return &si, nil
 			}
 		}
@@ -71,17 +196,161 @@ func (d *Docker) StackStat(stack string) (*DockerStackImage, error) {
 	return nil, nil
 }
 
+// PullStackImage pulls the Docker image of a stack.
+func (d *Docker) PullStackImage(stack, image string) (*DockerStackImage,
+	error) {
+	log.Printf("Pulling image %q of stack %q", image, stack)
+	repository, tag := docker.ParseRepositoryTag(image)
+	if tag == "" {
+		tag = "latest"
+	}
+	err := d.c.PullImage(docker.PullImageOptions{
+		Repository: repository,
+		Tag:        tag,
+	}, docker.AuthConfiguration{})
+	if err != nil {
+		return nil, fmt.Errorf("could not pull image %q of stack %q: %v",
+			image, stack, err)
+	}
+
+	si, err := d.StackStat(stack, image)
+	if err != nil {
+		return nil, err
+	}
+	if si == nil {
+		return nil, fmt.Errorf("image %q of stack %q not found after "+
+			"pulling it", image, stack)
+	}
+	return si, nil
+}
+
+// Labels of the images built by hsup, recording what they were built
+// from.
+const (
+	dockerLabelApp        = "com.heroku.hsup.app"
+	dockerLabelSlug       = "com.heroku.hsup.slug"
+	dockerLabelStackImage = "com.heroku.hsup.stack-image"
+	dockerLabelVersion    = "com.heroku.hsup.version"
+)
+
+// dockerImage names the image of a release after a digest of
+// everything it is built from: the slug, the stack image and the hsup
+// binary baked into it.  An image by that name is up to date, and any
+// change to its inputs results in another name.  The environment is
+// not one of them: it is handed to dynos when they start.
+type dockerImage struct {
+	name   string
+	labels map[string]string
+}
+
+func newDockerImage(si *DockerStackImage, release *Release,
+	hsupBytes, slug []byte) *dockerImage {
+	digest := func(b []byte) string {
+		sum := sha256.Sum256(b)
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+
+	slugID := release.slugChecksum
+	switch {
+	case release.slugURL == "":
+	case slugID == "" && slug != nil:
+		slugID = digest(slug)
+	case slugID == "":
+		slugID = release.slugURL
+	}
+	if slugID != "" {
+		slugID = fmt.Sprintf("%s %s %d", slugID, release.slugFormat,
+			release.slugStrip)
+	}
+
+	labels := map[string]string{
+		dockerLabelApp:        release.appName,
+		dockerLabelSlug:       slugID,
+		dockerLabelStackImage: si.image.ID,
+		dockerLabelVersion:    digest(hsupBytes),
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%s\n", k, labels[k])
+	}
+
+	return &dockerImage{
+		name: dockerRepository(release.appName) + ":" +
+			hex.EncodeToString(h.Sum(nil))[:16],
+		labels: labels,
+	}
+}
+
+// dockerRepository names the repository of the images of an app,
+// within what Docker accepts.
+func dockerRepository(appName string) string {
+	name := []byte(strings.ToLower(appName))
+	for i, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.') {
+			name[i] = '-'
+		}
+	}
+	if len(name) == 0 {
+		return "hsup/app"
+	}
+	return "hsup/" + string(name)
+}
+
+// dockerfileLabels returns LABEL instructions for a Dockerfile.
+func dockerfileLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for _, k := range keys {
+		v, _ := json.Marshal(labels[k])
+		fmt.Fprintf(&b, "LABEL %s=%s\n", k, v)
+	}
+	return b.String()
+}
+
 func (d *Docker) BuildSlugImage(si *DockerStackImage, release *Release) (
 	string, error) {
-	imageName := release.Name()
+	hsupBytes, err := ioutil.ReadFile(linuxAmd64Path())
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Println("make a Linux binary: `make`")
+		}
+		return "", err
+	}
+
+	// A local slug archive is made available in the build, as is
+	// one already fetched, see fetchSlug.
+	if release.slugURL != "" && release.Where() == Local &&
+		release.slugPath == "" {
+		if err := fetchSlug(release); err != nil {
+			return "", err
+		}
+	}
+	var slug []byte
+	if release.slugPath != "" {
+		if slug, err = ioutil.ReadFile(release.slugPath); err != nil {
+			return "", fmt.Errorf("could not read slug %s: %v",
+				release.slugPath, err)
+		}
+	}
+
+	image := newDockerImage(si, release, hsupBytes, slug)
 	if d.cacheEnabled {
-		// Exit early if the image is already around.
-		if _, err := d.c.InspectImage(imageName); err == nil {
-			// Successfully reuse the image that has -- probably
-			// -- been built before for the release in question.
-			// This avoids another long slug download, for
-			// instance.
-			return imageName, nil
+		// Exit early if the image is already around: as it is
+		// named after what it is built from, it is up to date.
+		// This avoids another long slug download, for instance.
+		if _, err := d.c.InspectImage(image.name); err == nil {
+			return image.name, nil
 		}
 	}
 
@@ -89,49 +358,57 @@ func (d *Docker) BuildSlugImage(si *DockerStackImage, release *Release) (
 	inputBuf, outputBuf := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
 	tr := tar.NewWriter(inputBuf)
 	defer tr.Close()
+	addFile := func(name string, mode int64, b []byte) error {
+		if err := tr.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    mode,
+			Size:    int64(len(b)),
+			ModTime: t, AccessTime: t,
+			ChangeTime: t,
+		}); err != nil {
+			return err
+		}
+		_, err := tr.Write(b)
+		return err
+	}
 
 	hs := Startup{Action: Build, Driver: &AbsPathDynoDriver{}}
 
-	hsupBytes, err := ioutil.ReadFile(linuxAmd64Path())
-	if err != nil {
+	if err := addFile("hsup", 0755, hsupBytes); err != nil {
 		return "", err
 	}
 
-	tr.WriteHeader(&tar.Header{
-		Name:    "hsup",
-		Size:    int64(len(hsupBytes)),
-		ModTime: t, AccessTime: t,
-		ChangeTime: t})
-	tr.Write([]byte(hsupBytes))
-
-	isLocalTgz := false
-	switch release.Where() {
-	case Local:
-		// A local file with a gzipped tarball.  Make it
-		// available in the build.
-		isLocalTgz = true
-		slug, err := ioutil.ReadFile(release.slugURL)
-		if err != nil {
-			log.Fatalln("could not read slug",
-				release.slugURL+":", err)
+	isLocalSlug := false
+	switch {
+	case release.slugURL == "":
+		// Nothing to unpack, e.g. when compiling a slug.
+	case release.slugPath != "":
+		isLocalSlug = true
+		if err := addFile("slug", 0644, slug); err != nil {
+			return "", err
 		}
-
-		tr.WriteHeader(&tar.Header{
-			Name:    "slug.tgz",
-			Size:    int64(len(slug)),
-			ModTime: t, AccessTime: t,
-			ChangeTime: t})
-		tr.Write(slug)
-		hs.App.Slug = "/tmp/slug.tgz"
-	case HTTP:
+		hs.App.Slug = "/tmp/slug"
+	case release.Where() == HTTP:
 		// Rely on abspath driver for the fetch.
 		hs.App.Slug = release.slugURL
+		hs.App.SlugChecksum = release.slugChecksum
 	default:
 		panic("unenumerated slug location")
 	}
+	hs.App.SlugFormat = release.slugFormat
+	hs.App.SlugStripComponents = &release.slugStrip
+
+	// Place the control file for the build step in the archive.
+	control, err := json.Marshal(&hs)
+	if err != nil {
+		return "", err
+	}
+	if err := addFile("hsup-control.json", 0644, control); err != nil {
+		return "", err
+	}
 
 	// Generate Dockerfile and place in archive.
-	genv := "HSUP_CONTROL_GOB=" + hs.ToBase64Gob()
+	genv := "HSUP_CONTROL_FILE=" + ControlFileInContainer
 	args := []string{"setuidgid", "dyno", "env", genv, "/hsup"}
 	argText, err := json.Marshal(args)
 	if err != nil {
@@ -139,44 +416,141 @@ func (d *Docker) BuildSlugImage(si *DockerStackImage, release *Release) (
 	}
 
 	var localSlugText string
-	if isLocalTgz {
-		localSlugText = "COPY slug.tgz /tmp/slug.tgz\n" +
-			"RUN chmod a+r /tmp/slug.tgz"
+	if isLocalSlug {
+		localSlugText = "COPY slug /tmp/slug\n" +
+			"RUN chmod a+r /tmp/slug"
 
 	}
 
-	dockerContents := fmt.Sprintf(`FROM %s
+	// The slug is unpacked in a first stage, which is not part of the
+	// image: neither the control file, with a possibly pre-signed slug
+	// URL, nor the slug archive end up in its layers, only /app.
+	dockerContents := fmt.Sprintf(`FROM %s AS slug
 COPY hsup /hsup
-RUN groupadd -r dyno && useradd -r -g dyno dyno && mkdir /app && chown dyno:dyno /app && chmod a+x /hsup
+RUN groupadd -r dyno && useradd -r -g dyno dyno && mkdir /app && chown dyno:dyno /app
 %s
+COPY hsup-control.json %s
 RUN %s
+
+FROM %s
+%sRUN groupadd -r dyno && useradd -r -g dyno dyno && mkdir /app && chown dyno:dyno /app
+COPY --from=slug /hsup /hsup
+COPY --from=slug --chown=dyno:dyno /app /app
 WORKDIR /app
-`, si.image.ID, localSlugText, argText)
+`, si.image.ID, localSlugText, ControlFileInContainer, argText,
+		si.image.ID, dockerfileLabels(image.labels))
 
 	diag.Log("building with Dockerfile", dockerContents)
-	tr.WriteHeader(&tar.Header{
-		Name:    "Dockerfile",
-		Size:    int64(len(dockerContents)),
-		ModTime: t, AccessTime: t,
-		ChangeTime: t})
-	tr.Write([]byte(dockerContents))
-
-	if os.IsNotExist(err) {
-		log.Println("make a Linux binary: `make`")
+	if err := addFile("Dockerfile", 0644,
+		[]byte(dockerContents)); err != nil {
+		return "", err
+	}
+	if err := tr.Close(); err != nil {
+		return "", err
 	}
-
-	tr.Close()
 
 	opts := docker.BuildImageOptions{
-		Name:           imageName,
+		Name:           image.name,
 		InputStream:    inputBuf,
 		OutputStream:   outputBuf,
 		SuppressOutput: false,
 	}
 
 	if err := d.c.BuildImage(opts); err != nil {
-		return "", err
+		return "", &DockerBuildError{
+			Err:    err,
+			Output: lastLines(outputBuf.String(), buildOutputLines),
+		}
+	}
+	diag.Log("built image", image.name, "with output", outputBuf.String())
+
+	return image.name, nil
+}
+
+// buildOutputLines is how much of the output of a failed image build
+// is reported.
+const buildOutputLines = 20
+
+// DockerBuildError is returned when the image of a release can't be
+// built, with the end of the output of the build.
+type DockerBuildError struct {
+	Err    error
+	Output string
+}
+
+func (e *DockerBuildError) Error() string {
+	if e.Output == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v, build output:\n%s", e.Err, e.Output)
+}
+
+// lastLines returns the last n lines of s.
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// PruneImages removes the images built by hsup that were superseded:
+// all but the latest one of each app, and those no container uses.
+// It returns the names of the images removed.
+func (d *Docker) PruneImages() ([]string, error) {
+	images, err := d.c.ListImages(docker.ListImagesOptions{
+		Filters: map[string][]string{"label": {dockerLabelApp}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	containers, err := d.c.ListContainers(docker.ListContainersOptions{
+		All: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	inUse := make(map[string]bool)
+	for _, c := range containers {
+		inUse[c.Image] = true
 	}
 
-	return imageName, nil
+	latest := make(map[string]docker.APIImages)
+	for _, img := range images {
+		for _, tag := range img.RepoTags {
+			repo, _ := docker.ParseRepositoryTag(tag)
+			if l, ok := latest[repo]; !ok || img.Created > l.Created {
+				latest[repo] = img
+			}
+		}
+	}
+
+	var removed []string
+	for _, img := range images {
+		if inUse[img.ID] {
+			continue
+		}
+		for _, tag := range img.RepoTags {
+			repo, _ := docker.ParseRepositoryTag(tag)
+			if latest[repo].ID == img.ID || inUse[tag] {
+				continue
+			}
+			if err := d.c.RemoveImage(tag); err != nil {
+				return removed, err
+			}
+			removed = append(removed, tag)
+		}
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
+
+// PruneDockerImages connects to Docker and prunes the images built by
+// hsup, see Docker.PruneImages.
+func PruneDockerImages() ([]string, error) {
+	d := &Docker{}
+	if err := d.Connect(); err != nil {
+		return nil, err
+	}
+	return d.PruneImages()
 }
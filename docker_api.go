@@ -0,0 +1,292 @@
+package hsup
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// dockerAPI calls the Docker remote API directly for what the vendored
+// go-dockerclient lacks: the labels of containers, their host
+// configuration and resources at creation, copying files into them,
+// the networks they are attached to, and their logs since a point in
+// time.  It talks to the same endpoint as the client, through its HTTP
+// client.
+type dockerAPI struct {
+	base   string
+	client *http.Client
+}
+
+func newDockerAPI(endpoint string, c *docker.Client) (*dockerAPI, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	api := &dockerAPI{client: c.HTTPClient}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		api.base = "http://docker"
+		api.client = &http.Client{Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		}}
+	case "tcp":
+		// As go-dockerclient does, TLS is on the port of Docker
+		// for TLS.
+		scheme := "http"
+		if _, port, _ := net.SplitHostPort(u.Host); port == "2376" {
+			scheme = "https"
+		}
+		api.base = scheme + "://" + u.Host
+	default:
+		api.base = strings.TrimRight(endpoint, "/")
+	}
+	return api, nil
+}
+
+// request sends a request to the Docker API, with a body of the given
+// content type if set, and returns the response unless it is an error.
+func (api *dockerAPI) request(method, path string, query url.Values,
+	contentType string, body io.Reader) (*http.Response, error) {
+	u := api.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := api.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, &docker.Error{
+			Status:  resp.StatusCode,
+			Message: string(msg),
+		}
+	}
+	return resp, nil
+}
+
+// call sends a request to the Docker API, encoding in as JSON if set,
+// and decoding its response as JSON into out if set.
+func (api *dockerAPI) call(method, path string, query url.Values,
+	in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	resp, err := api.request(method, path, query, "application/json",
+		body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// dockerContainer is a container as listed by the Docker API, with its
+// labels.
+type dockerContainer struct {
+	docker.APIContainers
+	Labels map[string]string `json:"Labels,omitempty"`
+}
+
+// dockerContainerJSON is a container as inspected through the Docker
+// API, with the networks it is attached to.
+type dockerContainerJSON struct {
+	docker.Container
+	NetworkSettings *dockerNetworkSettings `json:"NetworkSettings,omitempty"`
+}
+
+type dockerNetworkSettings struct {
+	docker.NetworkSettings
+	Networks map[string]dockerEndpointSettings `json:"Networks,omitempty"`
+}
+
+// dockerEndpointSettings is how a container is attached to a network.
+type dockerEndpointSettings struct {
+	IPAddress string `json:"IPAddress,omitempty"`
+}
+
+// dockerHostConfig is the host configuration of a container, with the
+// resources it is limited to: memory in bytes, a relative share of CPU,
+// and CPU time in microseconds per CPU period.
+type dockerHostConfig struct {
+	*docker.HostConfig
+	Memory    int64 `json:"Memory,omitempty"`
+	CPUShares int64 `json:"CpuShares,omitempty"`
+	CPUQuota  int64 `json:"CpuQuota,omitempty"`
+	CPUPeriod int64 `json:"CpuPeriod,omitempty"`
+}
+
+// createContainer creates a container with the given host
+// configuration and labels, and returns its ID.  The host
+// configuration is only taken at creation by recent Docker versions,
+// not when starting the container.
+func (api *dockerAPI) createContainer(name string, config *docker.Config,
+	hostConfig *dockerHostConfig, labels map[string]string) (string,
+	error) {
+	in := struct {
+		*docker.Config
+		HostConfig *dockerHostConfig `json:"HostConfig,omitempty"`
+		Labels     map[string]string `json:"Labels,omitempty"`
+	}{config, hostConfig, labels}
+	var out struct {
+		ID string `json:"Id"`
+	}
+	query := url.Values{}
+	if name != "" {
+		query.Set("name", name)
+	}
+	if err := api.call("POST", "/containers/create", query, in,
+		&out); err != nil {
+		return "", err
+	}
+	return out.ID, nil
+}
+
+// startContainer starts a container created with its host
+// configuration.
+func (api *dockerAPI) startContainer(id string) error {
+	return api.call("POST", "/containers/"+id+"/start", nil, nil, nil)
+}
+
+// copyFile writes a file into a container, e.g. before it is started,
+// as an archive extracted into the directory of the file.
+func (api *dockerAPI) copyFile(id, name string, contents []byte,
+	mode int64) error {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	hdr := &tar.Header{
+		Name:    path.Base(name),
+		Mode:    mode,
+		Size:    int64(len(contents)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(contents); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	query := url.Values{"path": {path.Dir(name)}}
+	resp, err := api.request("PUT", "/containers/"+id+"/archive", query,
+		"application/x-tar", &buf)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// listContainers lists the containers matching filters, stopped ones
+// included.
+func (api *dockerAPI) listContainers(filters map[string][]string) (
+	[]dockerContainer, error) {
+	query := url.Values{"all": {"1"}}
+	if len(filters) > 0 {
+		b, err := json.Marshal(filters)
+		if err != nil {
+			return nil, err
+		}
+		query.Set("filters", string(b))
+	}
+	var containers []dockerContainer
+	err := api.call("GET", "/containers/json", query, nil, &containers)
+	return containers, err
+}
+
+func (api *dockerAPI) inspectContainer(id string) (*dockerContainerJSON,
+	error) {
+	container := new(dockerContainerJSON)
+	err := api.call("GET", "/containers/"+id+"/json", nil, nil, container)
+	if err != nil {
+		return nil, err
+	}
+	return container, nil
+}
+
+// followLogs follows the stdout and stderr of a container onto stdout
+// and stderr, each line prefixed with its timestamp, from since, in
+// seconds since the epoch, if positive.
+func (api *dockerAPI) followLogs(id string, since int64,
+	stdout, stderr io.Writer) error {
+	query := url.Values{
+		"follow":     {"1"},
+		"stdout":     {"1"},
+		"stderr":     {"1"},
+		"timestamps": {"1"},
+		"tail":       {"all"},
+	}
+	if since > 0 {
+		query.Set("since", strconv.FormatInt(since, 10))
+	}
+	resp, err := api.request("GET", "/containers/"+id+"/logs", query, "",
+		nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return dockerDemux(stdout, stderr, resp.Body)
+}
+
+// dockerDemux copies the stdout and stderr multiplexed in a stream of
+// the Docker API onto stdout and stderr.  The stream is made of frames
+// of a header, the stream of the frame followed by three bytes of
+// padding and the big-endian length of the frame, and the frame.
+func dockerDemux(stdout, stderr io.Writer, r io.Reader) error {
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var w io.Writer
+		switch header[0] {
+		case 0, 1:
+			w = stdout
+		case 2:
+			w = stderr
+		default:
+			return fmt.Errorf("invalid stream %d in Docker logs",
+				header[0])
+		}
+		size := binary.BigEndian.Uint32(header[4:])
+		if _, err := io.CopyN(w, r, int64(size)); err != nil {
+			return err
+		}
+	}
+}
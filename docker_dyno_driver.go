@@ -1,43 +1,122 @@
 package hsup
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"code.google.com/p/go-uuid/uuid"
 	"github.com/fsouza/go-dockerclient"
 )
 
+// Labels of the containers of dynos, along with those of their images,
+// telling which hsup, app and release they belong to.
+const (
+	dockerLabelRelease     = "com.heroku.hsup.release"
+	dockerLabelProcessType = "com.heroku.hsup.process-type"
+	dockerLabelDyno        = "com.heroku.hsup.dyno"
+	dockerLabelSupervisor  = "com.heroku.hsup.supervisor"
+	dockerLabelRun         = "com.heroku.hsup.run"
+)
+
+// dockerRunID tells the containers started by this run of hsup from
+// those left behind by earlier ones.
+var dockerRunID = uuid.New()
+
 type DockerDynoDriver struct {
 	d *Docker
+
+	// reconciled holds the apps whose containers left behind by a
+	// previous run of this hsup were dealt with.
+	mu         sync.Mutex
+	reconciled map[string]bool
+}
+
+// DockerSupervisorID identifies this hsup among those sharing a Docker
+// host, for it to find the containers it started in an earlier run.
+// It is HSUP_SUPERVISOR_ID, or else the host name.
+func DockerSupervisorID() string {
+	if id := os.Getenv("HSUP_SUPERVISOR_ID"); id != "" {
+		return id
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "hsup"
+	}
+	return hostname
+}
+
+func (dd *DockerDynoDriver) ValidateApp(app *AppSerializable,
+	verr *ValidationError) {
+	validateSlug(app, verr)
+	if slugIsZstd(app) {
+		// Slugs are unpacked by hsup within the stack image, and
+		// Heroku stack images do not ship zstd.
+		verr.Add("SlugFormat", "zstd compressed slugs are not "+
+			"supported by the docker driver")
+	}
+
+	images, err := DockerStackImages()
+	if err != nil {
+		verr.Add("Stack", "%v", err)
+	} else {
+		stacks := make([]string, 0, len(images))
+		for stack := range images {
+			stacks = append(stacks, stack)
+		}
+		sort.Strings(stacks)
+		validateStack(app, stacks, verr)
+	}
+	if app.StackVersion != "" {
+		verr.Add("StackVersion", "stack versions cannot be pinned "+
+			"with the docker driver")
+	}
 }
 
 func (dd *DockerDynoDriver) Build(release *Release) error {
-	if release.stack != "cedar-14" {
-		return fmt.Errorf("only cedar-14 is supported, but the "+
-			"application uses the %q stack", release.stack)
+	images, err := DockerStackImages()
+	if err != nil {
+		return err
+	}
+	image, ok := images[release.stack]
+	if !ok {
+		return fmt.Errorf("no docker image for the %q stack, see "+
+			"DOCKER_STACK_IMAGES", release.stack)
+	}
+
+	// Fetch the slug on the host, through the slug cache, rather
+	// than within every image build.  Without a slug, e.g. to
+	// compile one, only hsup is added to the stack image.
+	if release.slugURL != "" {
+		if err := fetchSlug(release); err != nil {
+			return err
+		}
 	}
 
 	if err := dd.connectDocker(); err != nil {
 		return err
 	}
-
-	stack := "heroku/cedar:14"
-	si, err := dd.d.StackStat(stack)
+	si, err := dd.d.StackStat(release.stack, image)
 	if err != nil {
 		return err
 	}
 	if si == nil {
-		log.Fatalln("Stack not found:", stack)
+		if si, err = dd.d.PullStackImage(release.stack, image); err != nil {
+			return err
+		}
 	}
 
 	imageName, err := dd.d.BuildSlugImage(si, release)
 	if err != nil {
-		log.Fatalln("could not build image:", err)
+		return fmt.Errorf("could not build image: %v", err)
 	}
 	log.Println("Built image successfully")
 
@@ -45,7 +124,19 @@ func (dd *DockerDynoDriver) Build(release *Release) error {
 	return nil
 }
 
+// Start creates and starts the container of a dyno.  The environment
+// and arguments of the dyno are only handed to it then, in its control
+// file, rather than baked into the image of the release.  Errors are
+// returned for the executor to restart the dyno, with whatever was
+// created so far removed.
 func (dd *DockerDynoDriver) Start(ex *Executor) error {
+	if err := dd.connectDocker(); err != nil {
+		return err
+	}
+	if adopted, err := dd.adopt(ex); err != nil || adopted {
+		return err
+	}
+
 	hs := Startup{
 		App: AppSerializable{
 			Version: ex.Release.version,
@@ -59,7 +150,6 @@ func (dd *DockerDynoDriver) Start(ex *Executor) error {
 					FType:     ex.ProcessType,
 				},
 			},
-			LogplexURL: ex.logplexURLString(),
 		},
 		OneShot:     true,
 		StartNumber: ex.ProcessID,
@@ -67,52 +157,242 @@ func (dd *DockerDynoDriver) Start(ex *Executor) error {
 		Driver:      &AbsPathDynoDriver{},
 	}
 
+	// The control file is copied into the container before it
+	// starts rather than passed in the environment, which is both
+	// visible and limited in size, or bound from the host, which
+	// remote Docker daemons cannot reach.  It must be readable by
+	// the dyno user inside the container.
+	control, err := json.MarshalIndent(&hs, "", "    ")
+	if err != nil {
+		return err
+	}
+
 	// attach a timestamp as some extra entropy because container names must be
 	// unique
-	name := fmt.Sprintf("%v.%v", ex.Name(), time.Now().Unix())
+	name := fmt.Sprintf("%v.%v.%v",
+		path.Base(dockerRepository(ex.Release.appName)), ex.Name(),
+		time.Now().Unix())
+	port := dockerPort(ex.Release)
 	vols := make(map[string]struct{})
 	for _, inside := range ex.Binds {
 		vols[inside] = struct{}{}
 	}
 
-	container, err := dd.d.c.CreateContainer(docker.CreateContainerOptions{
-		Name: name,
-		Config: &docker.Config{
-			Cmd:          []string{"setuidgid", "dyno", "/hsup"},
-			Env:          []string{"HSUP_CONTROL_GOB=" + hs.ToBase64Gob()},
-			Image:        ex.Release.imageName,
-			Volumes:      vols,
-			ExposedPorts: map[docker.Port]struct{}{docker.Port("5000/tcp"): {}},
-		},
-	})
+	cmd := []string{"setuidgid", "dyno", "/hsup"}
+	if len(ex.OwnedBinds) > 0 {
+		// The dyno user only exists in the image: hand the paths
+		// over to it as root, before dropping privileges.
+		cmd = []string{"sh", "-c",
+			`chown -R dyno:dyno "$@" && exec setuidgid dyno /hsup`,
+			"sh"}
+		for _, outside := range ex.OwnedBinds {
+			cmd = append(cmd, ex.Binds[outside])
+		}
+	}
+
+	config := &docker.Config{
+		Cmd:          cmd,
+		Env:          []string{"HSUP_CONTROL_FILE=" + ControlFileInContainer},
+		Image:        ex.Release.imageName,
+		Volumes:      vols,
+		ExposedPorts: map[docker.Port]struct{}{port: {}},
+	}
+	id, err := dd.d.api.createContainer(name, config,
+		dd.hostConfig(ex, port, ex.bindPairs()), dd.labels(ex))
 	if err != nil {
-		log.Fatalln("could not create container:", err)
+		return fmt.Errorf("could not create container: %v", err)
 	}
+	container := &docker.Container{ID: id}
+
+	err = dd.d.api.copyFile(container.ID, ControlFileInContainer, control,
+		0644)
+	if err != nil {
+		dd.remove(container.ID)
+		return fmt.Errorf("could not copy control file: %v", err)
+	}
+
+	if err := dd.d.api.startContainer(container.ID); err != nil {
+		dd.remove(container.ID)
+		return fmt.Errorf("could not start container: %v", err)
+	}
+
+	if err := dd.started(ex, container, time.Time{}); err != nil {
+		dd.remove(container.ID)
+		return err
+	}
+	return nil
+}
 
+// dockerPort returns the port the dynos of a release listen on.
+func dockerPort(release *Release) docker.Port {
+	port := release.config["PORT"]
+	if port == "" {
+		port = DefaultPort
+	}
+	return docker.Port(port + "/tcp")
+}
+
+// dockerCPUPeriod is the period the CPU quota of dynos is enforced
+// over.
+const dockerCPUPeriod = 100 * time.Millisecond
+
+// hostConfig publishes the port of a dyno on the host port configured
+// for its process type, which stays the same when it restarts.
+// Otherwise, it is published on a random host port, unless the dyno is
+// attached to a network of its own where it can be reached directly.
+// The container is limited to the dyno size of its process type.
+func (dd *DockerDynoDriver) hostConfig(ex *Executor, port docker.Port,
+	binds []string) *dockerHostConfig {
+	hc := &dockerHostConfig{HostConfig: &docker.HostConfig{
+		Binds:       binds,
+		NetworkMode: dd.d.network,
+	}}
+	if size := dd.d.dynoSize(ex.ProcessType); size != nil {
+		hc.Memory = size.Memory
+		hc.CPUShares = size.CPUShares
+		hc.CPUPeriod = int64(dockerCPUPeriod / time.Microsecond)
+		hc.CPUQuota = int64(size.cpuQuotaPerSecond() *
+			dockerCPUPeriod / time.Second / time.Microsecond)
+	}
+	if hostPort := dd.d.hostPort(ex.ProcessType, ex.ProcessID); hostPort != 0 {
+		hc.PortBindings = map[docker.Port][]docker.PortBinding{
+			port: {{HostPort: strconv.Itoa(hostPort)}},
+		}
+	} else if dd.d.network == "" {
+		hc.PublishAllPorts = true
+	}
+	return hc
+}
+
+// started follows a container that was started for a dyno, and its
+// logs written after since.  The logs are relayed by this hsup rather
+// than the one in the container, which only sees its own dyno.
+func (dd *DockerDynoDriver) started(ex *Executor, container *docker.Container,
+	since time.Time) (err error) {
 	ex.container = container
 	ex.IPInfo = dd.IPInfo(ex)
+	ex.containerLogs, err = followDockerLogs(dd.d, ex, since,
+		os.Stdout, os.Stderr)
+	return err
+}
+
+func (dd *DockerDynoDriver) labels(ex *Executor) map[string]string {
+	return map[string]string{
+		dockerLabelApp:         ex.Release.appName,
+		dockerLabelRelease:     strconv.Itoa(ex.Release.version),
+		dockerLabelProcessType: ex.ProcessType,
+		dockerLabelDyno:        ex.Name(),
+		dockerLabelSupervisor:  DockerSupervisorID(),
+		dockerLabelRun:         dockerRunID,
+	}
+}
 
-	err = dd.d.c.StartContainer(ex.container.ID, &docker.HostConfig{
-		Binds:           ex.bindPairs(),
-		PublishAllPorts: true,
+// containers lists the containers of this hsup with the given labels.
+func (dd *DockerDynoDriver) containers(labels map[string]string) (
+	[]dockerContainer, error) {
+	filters := []string{dockerLabelSupervisor + "=" + DockerSupervisorID()}
+	for k, v := range labels {
+		filters = append(filters, k+"="+v)
+	}
+	return dd.d.api.listContainers(map[string][]string{"label": filters})
+}
+
+func dockerContainerRunning(c dockerContainer) bool {
+	return strings.HasPrefix(c.Status, "Up")
+}
+
+// Reconcile deals with the containers of an app left behind by an
+// earlier run of this hsup, the first time one of its releases is
+// rolled out: running dynos of that release, which Start adopts, and
+// containers of this run are kept, and every other container is
+// removed.
+func (dd *DockerDynoDriver) Reconcile(release *Release) error {
+	if err := dd.connectDocker(); err != nil {
+		return err
+	}
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	if dd.reconciled[release.appName] {
+		return nil
+	}
+
+	containers, err := dd.containers(map[string]string{
+		dockerLabelApp: release.appName,
 	})
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	version := strconv.Itoa(release.version)
+	for _, c := range containers {
+		if c.Labels[dockerLabelRun] == dockerRunID {
+			continue
+		}
+		if dockerContainerRunning(c) &&
+			c.Labels[dockerLabelRelease] == version {
+			continue
+		}
+		log.Printf("Removing container %s of dyno %s, left behind "+
+			"by release %s", c.ID, c.Labels[dockerLabelDyno],
+			c.Labels[dockerLabelRelease])
+		dd.remove(c.ID)
 	}
 
-	go dd.d.c.Logs(docker.LogsOptions{
-		Container:    ex.container.ID,
-		Stdout:       true,
-		Stderr:       true,
-		Follow:       true,
-		OutputStream: os.Stdout,
+	if dd.reconciled == nil {
+		dd.reconciled = make(map[string]bool)
+	}
+	dd.reconciled[release.appName] = true
+	return nil
+}
+
+// adopt takes over the container of a dyno left running by an earlier
+// run of this hsup, if there is one, rather than starting another.
+func (dd *DockerDynoDriver) adopt(ex *Executor) (bool, error) {
+	containers, err := dd.containers(map[string]string{
+		dockerLabelApp:     ex.Release.appName,
+		dockerLabelRelease: strconv.Itoa(ex.Release.version),
+		dockerLabelDyno:    ex.Name(),
 	})
+	if err != nil {
+		return false, err
+	}
 
-	return nil
+	for _, c := range containers {
+		if !dockerContainerRunning(c) {
+			continue
+		}
+		container, err := dd.d.c.InspectContainer(c.ID)
+		if err != nil {
+			return false, err
+		}
+		log.Printf("Adopting container %s of dyno %s", c.ID, ex.Name())
+		if err := dd.started(ex, container, time.Now()); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
 }
 
+// remove removes the container of a dyno, logging failures.
+func (dd *DockerDynoDriver) remove(id string) {
+	err := dd.d.c.RemoveContainer(docker.RemoveContainerOptions{
+		ID:    id,
+		Force: true,
+	})
+	if err != nil {
+		log.Printf("could not remove container %s: %v", id, err)
+	}
+}
+
+// Wait waits for the container of a dyno to exit, and removes it so
+// that dead containers don't accumulate.
 func (dd *DockerDynoDriver) Wait(ex *Executor) (s *ExitStatus) {
 	code, err := dd.d.c.WaitContainer(ex.container.ID)
+	if ex.containerLogs != nil {
+		// wait until all buffered logs are delivered
+		ex.containerLogs.close()
+	}
+	dd.remove(ex.container.ID)
 	return &ExitStatus{Code: code, Err: err}
 }
 
@@ -124,21 +404,36 @@ func (dd *DockerDynoDriver) Stop(ex *Executor) error {
 	return dd.d.c.StopContainer(ex.container.ID, 10)
 }
 
+// IPInfo returns the address of a dyno: that of its published port,
+// or else its address in the network it is attached to.
 func (dd *DockerDynoDriver) IPInfo(ex *Executor) IPInfo {
+	port := dockerPort(ex.Release)
 	return func() (string, int) {
-		container, err := dd.d.c.InspectContainer(ex.container.ID)
-		if err != nil {
+		container, err := dd.d.api.inspectContainer(ex.container.ID)
+		if err != nil || container.NetworkSettings == nil {
 			return "", -1
 		}
+		settings := container.NetworkSettings
 
-		exposed, ok := container.NetworkSettings.Ports[docker.Port("5000/tcp")]
-		if !ok || exposed[0].HostIP == "" {
-			return "", -1
+		exposed := settings.Ports[port]
+		if len(exposed) > 0 && exposed[0].HostIP != "" {
+			ip := strings.Split(exposed[0].HostIP, "/")
+			hostPort, _ := strconv.Atoi(exposed[0].HostPort)
+			return ip[0], hostPort
 		}
 
-		ip := strings.Split(exposed[0].HostIP, "/")
-		port, _ := strconv.Atoi(exposed[0].HostPort)
-		return ip[0], port
+		if dd.d.network == "" {
+			return "", -1
+		}
+		ip := settings.IPAddress
+		if network, ok := settings.Networks[dd.d.network]; ok {
+			ip = network.IPAddress
+		}
+		containerPort, err := strconv.Atoi(port.Port())
+		if ip == "" || err != nil {
+			return "", -1
+		}
+		return ip, containerPort
 	}
 }
 
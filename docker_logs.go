@@ -0,0 +1,212 @@
+package hsup
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"time"
+)
+
+// dockerLogsRetryDelay is how long to wait before following the logs
+// of a dyno again once their stream broke.
+const dockerLogsRetryDelay = time.Second
+
+// dockerLogs follows the stdout and stderr of the container of a dyno,
+// printing them prefixed with the name of the dyno and relaying them to
+// Logplex like the logs of other drivers.  Should the stream break
+// while the dyno runs, e.g. when the Docker daemon restarts, it is
+// followed again from where it stopped.
+type dockerLogs struct {
+	d    *Docker
+	id   string
+	name string
+
+	out, err *dockerLogWriter
+
+	// pipes are the write ends of the pipes the relay reads from.
+	pipes []io.WriteCloser
+	relay *relay
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// followDockerLogs starts following the logs of the container of a
+// dyno onto stdout and stderr, skipping those written before since, if
+// set.
+func followDockerLogs(d *Docker, ex *Executor, since time.Time,
+	stdout, stderr io.Writer) (*dockerLogs, error) {
+	l := &dockerLogs{
+		d:    d,
+		id:   ex.container.ID,
+		name: ex.Name(),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	prefix := ex.Name() + " | "
+	var out, errOut io.Writer = newPrefixWriter(stdout, prefix),
+		newPrefixWriter(stderr, prefix)
+
+	// Tee stdout and stderr to Logplex.
+	if ex.LogplexURL != nil {
+		rStdout, wStdout := teePipe(out)
+		rStderr, wStderr := teePipe(errOut)
+		relay, err := newRelay(ex.LogplexURL, ex.Name(), rStdout, rStderr)
+		if err != nil {
+			return nil, err
+		}
+		relay.run()
+		l.relay = relay
+		l.pipes = []io.WriteCloser{wStdout, wStderr}
+		out, errOut = wStdout, wStderr
+	}
+
+	l.out = &dockerLogWriter{dst: out, last: since, skipping: true}
+	l.err = &dockerLogWriter{dst: errOut, last: since, skipping: true}
+	go l.follow()
+	return l, nil
+}
+
+func (l *dockerLogs) follow() {
+	defer close(l.done)
+	for {
+		// Since has a resolution of seconds: the lines of the
+		// second the stream broke in are skipped by timestamp.
+		since := l.out.last
+		if since.IsZero() || !l.err.last.IsZero() &&
+			l.err.last.Before(since) {
+			since = l.err.last
+		}
+		var sinceUnix int64
+		if !since.IsZero() {
+			sinceUnix = since.Unix()
+		}
+
+		err := l.d.api.followLogs(l.id, sinceUnix, l.out, l.err)
+		if !l.running() {
+			return
+		}
+		log.Printf("log stream of %s broke, following it again: %v",
+			l.name, err)
+		select {
+		case <-l.stop:
+			return
+		case <-time.After(dockerLogsRetryDelay):
+		}
+		l.out.skipping = true
+		l.err.skipping = true
+	}
+}
+
+// running reports whether the logs of the dyno should still be
+// followed, assuming it runs when Docker can't tell.
+func (l *dockerLogs) running() bool {
+	select {
+	case <-l.stop:
+		return false
+	default:
+	}
+	container, err := l.d.c.InspectContainer(l.id)
+	if err != nil {
+		return true
+	}
+	return container.State.Running
+}
+
+// close waits for the logs of a dyno that exited to be read, and for
+// the relay to deliver them.
+func (l *dockerLogs) close() {
+	close(l.stop)
+	<-l.done
+	l.out.flush()
+	l.err.flush()
+	for _, p := range l.pipes {
+		p.Close()
+	}
+	if l.relay != nil {
+		l.relay.stop()
+	}
+}
+
+// dockerLogWriter strips the timestamps Docker prefixes log lines with,
+// skipping the lines up to the last one written when skipping, i.e.
+// when a stream is followed again.
+type dockerLogWriter struct {
+	dst      io.Writer
+	last     time.Time
+	skipping bool
+	partial  []byte
+}
+
+func (w *dockerLogWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := w.partial[:i+1]
+		w.partial = w.partial[i+1:]
+		if err := w.writeLine(line); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+func (w *dockerLogWriter) writeLine(line []byte) error {
+	if i := bytes.IndexByte(line, ' '); i > 0 {
+		ts, err := time.Parse(time.RFC3339Nano, string(line[:i]))
+		if err == nil {
+			if w.skipping && !ts.After(w.last) {
+				return nil
+			}
+			w.skipping = false
+			w.last = ts
+			line = line[i+1:]
+		}
+	}
+	_, err := w.dst.Write(line)
+	return err
+}
+
+// flush writes the last line of a stream that ended without a newline.
+func (w *dockerLogWriter) flush() {
+	if len(w.partial) > 0 {
+		w.writeLine(append(w.partial, '\n'))
+		w.partial = nil
+	}
+}
+
+// prefixWriter prefixes every line written to it.
+type prefixWriter struct {
+	w       io.Writer
+	prefix  []byte
+	midLine bool
+}
+
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: []byte(prefix)}
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	var buf bytes.Buffer
+	for rest := p; len(rest) > 0; {
+		if !pw.midLine {
+			buf.Write(pw.prefix)
+		}
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			buf.Write(rest)
+			pw.midLine = true
+			break
+		}
+		buf.Write(rest[:i+1])
+		rest = rest[i+1:]
+		pw.midLine = false
+	}
+	if _, err := pw.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
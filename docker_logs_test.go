@@ -0,0 +1,92 @@
+package hsup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// dockerLogFrame multiplexes a line of stdout the way Docker streams
+// the logs of containers without a TTY.
+func dockerLogFrame(line string) []byte {
+	frame := []byte{1, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(line)))
+	return append(frame, line...)
+}
+
+func TestDockerLogsFollowAgain(t *testing.T) {
+	var (
+		sinces  []string
+		running = true
+	)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/containers/c1/logs":
+				sinces = append(sinces, r.URL.Query().Get("since"))
+				w.Write(dockerLogFrame(
+					"2016-01-02T15:04:05.000000001Z first\n"))
+				if len(sinces) == 1 {
+					// The stream breaks while the dyno runs.
+					return
+				}
+				w.Write(dockerLogFrame(
+					"2016-01-02T15:04:05.000000002Z second\n"))
+				running = false
+			case "/containers/c1/json":
+				json.NewEncoder(w).Encode(docker.Container{
+					ID:    "c1",
+					State: docker.State{Running: running},
+				})
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer srv.Close()
+
+	ex := &Executor{
+		ProcessID:   1,
+		ProcessType: "web",
+		Release:     &Release{},
+		container:   &docker.Container{ID: "c1"},
+	}
+	var out bytes.Buffer
+	l, err := followDockerLogs(newTestDocker(t, srv.URL), ex, time.Time{},
+		&out, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-l.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the logs to be followed until the dyno exits")
+	}
+	l.close()
+
+	if len(sinces) != 2 || sinces[0] != "" || sinces[1] != "1451747045" {
+		t.Fatalf("expected the stream to be followed again from the "+
+			"last line, got since %q", sinces)
+	}
+	if expected := "web.1 | first\nweb.1 | second\n"; out.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, out.String())
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := newPrefixWriter(&out, "web.1 | ")
+	for _, s := range []string{"one\ntw", "o\n", "three\nfour\n"} {
+		w.Write([]byte(s))
+	}
+	expected := "web.1 | one\nweb.1 | two\nweb.1 | three\nweb.1 | four\n"
+	if out.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, out.String())
+	}
+}
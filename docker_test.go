@@ -0,0 +1,513 @@
+package hsup
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+func TestDockerStackImages(t *testing.T) {
+	defer os.Setenv("DOCKER_STACK_IMAGES", os.Getenv("DOCKER_STACK_IMAGES"))
+
+	os.Setenv("DOCKER_STACK_IMAGES",
+		"heroku-18=example/heroku:18, custom=example/custom")
+	images, err := DockerStackImages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for stack, expected := range map[string]string{
+		"cedar-14":  "heroku/cedar:14",
+		"heroku-18": "example/heroku:18",
+		"custom":    "example/custom",
+	} {
+		if images[stack] != expected {
+			t.Errorf("expected image %q for %s, got %q", expected,
+				stack, images[stack])
+		}
+	}
+
+	os.Setenv("DOCKER_STACK_IMAGES", "heroku-18")
+	if _, err := DockerStackImages(); err == nil {
+		t.Fatal("expected an invalid entry to be rejected")
+	}
+}
+
+func TestDockerPullsMissingStackImage(t *testing.T) {
+	var images []docker.APIImages
+	var pulled []string
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/images/json":
+				json.NewEncoder(w).Encode(images)
+			case "/images/create":
+				q := r.URL.Query()
+				image := q.Get("fromImage") + ":" + q.Get("tag")
+				pulled = append(pulled, image)
+				images = append(images, docker.APIImages{
+					ID:       "abc",
+					RepoTags: []string{image},
+				})
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer srv.Close()
+
+	c, err := docker.NewClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Docker{c: c}
+
+	si, err := d.StackStat("custom", "example/custom")
+	if err != nil || si != nil {
+		t.Fatalf("expected no stack image, got %v, %v", si, err)
+	}
+	if si, err = d.PullStackImage("custom", "example/custom"); err != nil {
+		t.Fatal(err)
+	}
+	if si.image.ID != "abc" || len(pulled) != 1 ||
+		pulled[0] != "example/custom:latest" {
+		t.Fatalf("unexpected pull %v of image %+v", pulled, si.image)
+	}
+}
+
+func TestDockerImageNamedAfterInputs(t *testing.T) {
+	si := &DockerStackImage{image: docker.APIImages{ID: "stack1"}}
+	release := &Release{
+		appName:      "My_App",
+		config:       map[string]string{"FOO": "bar"},
+		slugURL:      "https://example.com/slug.tgz",
+		slugChecksum: "sha256:abc",
+		slugFormat:   SlugFormatTgz,
+		slugStrip:    SlugStripComponents,
+	}
+	hsupBytes := []byte("hsup v1")
+
+	image := newDockerImage(si, release, hsupBytes, nil)
+	if !strings.HasPrefix(image.name, "hsup/my_app:") {
+		t.Fatalf("unexpected image name %q", image.name)
+	}
+	if image.labels[dockerLabelApp] != "My_App" {
+		t.Fatalf("unexpected labels %v", image.labels)
+	}
+	if again := newDockerImage(si, release, hsupBytes, nil); again.name != image.name {
+		t.Fatalf("expected the same name, got %q and %q", image.name,
+			again.name)
+	}
+
+	changed := []*dockerImage{
+		newDockerImage(si, release, []byte("hsup v2"), nil),
+		newDockerImage(&DockerStackImage{
+			image: docker.APIImages{ID: "stack2"},
+		}, release, hsupBytes, nil),
+	}
+	next := *release
+	next.config = map[string]string{"FOO": "baz"}
+	if again := newDockerImage(si, &next, hsupBytes, nil); again.name != image.name {
+		t.Fatalf("expected config vars not to change name %q, got %q",
+			image.name, again.name)
+	}
+	next = *release
+	next.slugChecksum = "sha256:def"
+	changed = append(changed, newDockerImage(si, &next, hsupBytes, nil))
+
+	for _, c := range changed {
+		if c.name == image.name {
+			t.Fatalf("expected a change of input to change name %q",
+				image.name)
+		}
+	}
+}
+
+func TestDockerPruneImages(t *testing.T) {
+	images := []docker.APIImages{
+		{ID: "old", RepoTags: []string{"hsup/myapp:1"}, Created: 1},
+		{ID: "running", RepoTags: []string{"hsup/myapp:2"}, Created: 2},
+		{ID: "latest", RepoTags: []string{"hsup/myapp:3"}, Created: 3},
+		{ID: "other", RepoTags: []string{"hsup/other:1"}, Created: 1},
+	}
+	var filters string
+	var removed []string
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/images/json":
+				filters = r.URL.Query().Get("filters")
+				json.NewEncoder(w).Encode(images)
+			case r.URL.Path == "/containers/json":
+				json.NewEncoder(w).Encode([]docker.APIContainers{
+					{ID: "c1", Image: "hsup/myapp:2"},
+				})
+			case r.Method == "DELETE":
+				removed = append(removed,
+					strings.TrimPrefix(r.URL.Path, "/images/"))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer srv.Close()
+
+	c, err := docker.NewClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pruned, err := (&Docker{c: c}).PruneImages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(filters, dockerLabelApp) {
+		t.Fatalf("expected images to be filtered by label, got %q",
+			filters)
+	}
+	if !reflect.DeepEqual(pruned, []string{"hsup/myapp:1"}) ||
+		!reflect.DeepEqual(removed, pruned) {
+		t.Fatalf("unexpected pruned images %v, removed %v", pruned,
+			removed)
+	}
+}
+
+// newTestDocker connects to a fake Docker daemon.
+func newTestDocker(t *testing.T, url string) *Docker {
+	c, err := docker.NewClient(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := newDockerAPI(url, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Docker{c: c, api: api}
+}
+
+func TestDockerStartReturnsErrors(t *testing.T) {
+	var removed []string
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/containers/json":
+				w.Write([]byte("[]"))
+			case r.URL.Path == "/containers/create":
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(`{"Id": "c1"}`))
+			case r.URL.Path == "/containers/c1/archive":
+			case r.URL.Path == "/containers/c1/start":
+				http.Error(w, "daemon hiccup",
+					http.StatusInternalServerError)
+			case r.Method == "DELETE":
+				removed = append(removed, r.URL.Path)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer srv.Close()
+
+	dd := &DockerDynoDriver{d: newTestDocker(t, srv.URL)}
+	ex := &Executor{
+		Args:        []string{"./bin/web"},
+		ProcessID:   1,
+		ProcessType: "web",
+		Release: &Release{
+			appName:   "myapp",
+			config:    map[string]string{"PORT": "5000"},
+			imageName: "hsup/myapp:abc",
+		},
+	}
+
+	if err := dd.Start(ex); err == nil {
+		t.Fatal("expected the start failure to be returned")
+	}
+	if !reflect.DeepEqual(removed, []string{"/containers/c1"}) {
+		t.Fatalf("expected the container to be removed, got %v",
+			removed)
+	}
+}
+
+func TestDockerBuildErrorOutput(t *testing.T) {
+	var output bytes.Buffer
+	for i := 1; i <= 30; i++ {
+		fmt.Fprintf(&output, "Step %d\n", i)
+	}
+	err := &DockerBuildError{
+		Err:    errors.New("build failed"),
+		Output: lastLines(output.String(), buildOutputLines),
+	}
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "build failed, build output:\nStep 11\n") ||
+		!strings.HasSuffix(msg, "\nStep 30") {
+		t.Fatalf("unexpected error %q", msg)
+	}
+}
+
+func TestDockerReconcileContainers(t *testing.T) {
+	defer os.Setenv("HSUP_SUPERVISOR_ID", os.Getenv("HSUP_SUPERVISOR_ID"))
+	os.Setenv("HSUP_SUPERVISOR_ID", "test")
+
+	labels := func(version, dyno string) map[string]string {
+		return map[string]string{
+			dockerLabelApp:        "myapp",
+			dockerLabelRelease:    version,
+			dockerLabelDyno:       dyno,
+			dockerLabelSupervisor: "test",
+		}
+	}
+	container := func(id, status string, labels map[string]string) dockerContainer {
+		return dockerContainer{
+			APIContainers: docker.APIContainers{ID: id, Status: status},
+			Labels:        labels,
+		}
+	}
+	starting := labels("2", "web.3")
+	starting[dockerLabelRun] = dockerRunID
+	containers := []dockerContainer{
+		container("current", "Up 2 hours", labels("2", "web.1")),
+		container("exited", "Exited (0)", labels("2", "web.2")),
+		container("old", "Up 3 hours", labels("1", "web.1")),
+		container("starting", "Created", starting),
+	}
+
+	var filters []string
+	var removed []string
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/containers/json":
+				filters = append(filters, r.URL.Query().Get("filters"))
+				json.NewEncoder(w).Encode(containers)
+			case r.URL.Path == "/containers/current/json":
+				json.NewEncoder(w).Encode(docker.Container{ID: "current"})
+			case r.Method == "DELETE":
+				removed = append(removed,
+					strings.TrimPrefix(r.URL.Path, "/containers/"))
+			case strings.HasSuffix(r.URL.Path, "/logs"):
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer srv.Close()
+
+	dd := &DockerDynoDriver{d: newTestDocker(t, srv.URL)}
+	release := &Release{appName: "myapp", version: 2}
+	for i := 0; i < 2; i++ {
+		if err := dd.Reconcile(release); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(filters) != 1 || !strings.Contains(filters[0],
+		dockerLabelSupervisor+"=test") {
+		t.Fatalf("expected one listing of this hsup's containers, "+
+			"got %v", filters)
+	}
+	if !reflect.DeepEqual(removed, []string{"exited", "old"}) {
+		t.Fatalf("unexpected removed containers %v", removed)
+	}
+
+	// The running dyno of the release is adopted rather than started
+	// again.
+	containers = containers[:1]
+	ex := &Executor{ProcessID: 1, ProcessType: "web", Release: release}
+	if err := dd.Start(ex); err != nil {
+		t.Fatal(err)
+	}
+	if ex.container == nil || ex.container.ID != "current" {
+		t.Fatalf("expected container current to be adopted, got %+v",
+			ex.container)
+	}
+}
+
+func TestDockerConfigureDynos(t *testing.T) {
+	for _, name := range []string{"DOCKER_NETWORK", "DOCKER_HOST_PORTS",
+		"DOCKER_DYNO_SIZE", "DOCKER_DYNO_SIZES"} {
+		defer os.Setenv(name, os.Getenv(name))
+	}
+
+	os.Setenv("DOCKER_NETWORK", "dynos")
+	os.Setenv("DOCKER_HOST_PORTS", "web=8000")
+	os.Setenv("DOCKER_DYNO_SIZE", "standard-1x")
+	os.Setenv("DOCKER_DYNO_SIZES", "worker=performance-m")
+	d := &Docker{}
+	if err := d.configureDynos(); err != nil {
+		t.Fatal(err)
+	}
+	if d.network != "dynos" {
+		t.Fatalf("unexpected network %q", d.network)
+	}
+	if port := d.hostPort("web", 3); port != 8002 {
+		t.Fatalf("expected web.3 on host port 8002, got %d", port)
+	}
+	if port := d.hostPort("worker", 1); port != 0 {
+		t.Fatalf("expected worker.1 on a random port, got %d", port)
+	}
+	if size := d.dynoSize("web"); *size != DynoSizes["standard-1x"] {
+		t.Fatalf("unexpected web dyno size %+v", size)
+	}
+	if size := d.dynoSize("worker"); *size != DynoSizes["performance-m"] {
+		t.Fatalf("unexpected worker dyno size %+v", size)
+	}
+
+	for name, value := range map[string]string{
+		"DOCKER_HOST_PORTS": "web=http",
+		"DOCKER_DYNO_SIZES": "web=huge",
+	} {
+		os.Setenv(name, value)
+		if err := d.configureDynos(); err == nil {
+			t.Fatalf("expected %s=%s to be rejected", name, value)
+		}
+		os.Setenv(name, "")
+	}
+}
+
+func TestDockerStartPublishesPort(t *testing.T) {
+	var (
+		config struct {
+			docker.Config
+			HostConfig struct {
+				docker.HostConfig
+				Memory    int64
+				CPUShares int64 `json:"CpuShares"`
+				CPUQuota  int64 `json:"CpuQuota"`
+				CPUPeriod int64 `json:"CpuPeriod"`
+			}
+			Labels map[string]string
+		}
+		control   Startup
+		startBody []byte
+	)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/containers/json":
+				w.Write([]byte("[]"))
+			case "/containers/create":
+				json.NewDecoder(r.Body).Decode(&config)
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(`{"Id": "c1"}`))
+			case "/containers/c1/archive":
+				if r.Method != "PUT" || r.URL.Query().Get("path") !=
+					filepath.Dir(ControlFileInContainer) {
+					http.NotFound(w, r)
+					return
+				}
+				tr := tar.NewReader(r.Body)
+				hdr, err := tr.Next()
+				if err != nil || hdr.Name !=
+					filepath.Base(ControlFileInContainer) ||
+					hdr.Mode != 0644 {
+					http.Error(w, "bad archive", http.StatusBadRequest)
+					return
+				}
+				json.NewDecoder(tr).Decode(&control)
+			case "/containers/c1/start":
+				startBody, _ = ioutil.ReadAll(r.Body)
+				w.WriteHeader(http.StatusNoContent)
+			case "/containers/c1/json":
+				json.NewEncoder(w).Encode(docker.Container{
+					ID: "c1",
+					NetworkSettings: &docker.NetworkSettings{
+						Ports: map[docker.Port][]docker.PortBinding{
+							"8080/tcp": {{HostIP: "0.0.0.0",
+								HostPort: "9001"}},
+						},
+					},
+				})
+			}
+		}))
+	defer srv.Close()
+
+	size := DynoSizes["standard-2x"]
+	d := newTestDocker(t, srv.URL)
+	d.hostPorts = map[string]int{"web": 9000}
+	d.defaultSize = &size
+	dd := &DockerDynoDriver{d: d}
+	ex := &Executor{
+		Args:        []string{"./bin/web"},
+		ProcessID:   2,
+		ProcessType: "web",
+		Release: &Release{
+			appName:   "myapp",
+			config:    map[string]string{"PORT": "8080"},
+			imageName: "hsup/myapp:abc",
+		},
+	}
+	if err := dd.Start(ex); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := config.ExposedPorts["8080/tcp"]; !ok ||
+		len(config.ExposedPorts) != 1 {
+		t.Fatalf("expected PORT to be exposed, got %v",
+			config.ExposedPorts)
+	}
+	if hc := config.HostConfig; hc.Memory != size.Memory ||
+		hc.CPUShares != size.CPUShares || hc.CPUPeriod != 100000 ||
+		hc.CPUQuota != 200000 {
+		t.Fatalf("expected the dyno size to be applied, got %+v", hc)
+	}
+	if config.Labels[dockerLabelDyno] != "web.2" ||
+		config.Labels[dockerLabelApp] != "myapp" {
+		t.Fatalf("expected the container to be labelled, got %v",
+			config.Labels)
+	}
+	hostConfig := config.HostConfig
+	bindings := hostConfig.PortBindings["8080/tcp"]
+	if hostConfig.PublishAllPorts || len(bindings) != 1 ||
+		bindings[0].HostPort != "9001" {
+		t.Fatalf("expected PORT to be published on 9001, got %+v",
+			hostConfig)
+	}
+	if len(hostConfig.Binds) != 0 {
+		t.Fatalf("expected nothing to be bound, got %v",
+			hostConfig.Binds)
+	}
+	if control.App.Name != "myapp" || control.StartNumber != 2 ||
+		!reflect.DeepEqual(control.App.Processes[0].FArgs,
+			[]string{"./bin/web"}) {
+		t.Fatalf("expected the control file to be copied, got %+v",
+			control)
+	}
+	if len(startBody) != 0 {
+		t.Fatalf("expected the container to be started without a "+
+			"body, got %q", startBody)
+	}
+	if ip, port := ex.IPInfo(); ip != "0.0.0.0" || port != 9001 {
+		t.Fatalf("unexpected address %s:%d", ip, port)
+	}
+}
+
+func TestDockerIPInfoInNetwork(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/containers/c1/json" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(`{"Id": "c1", "NetworkSettings": {` +
+				`"Networks": {"dynos": {"IPAddress": "10.0.0.2"}}}}`))
+		}))
+	defer srv.Close()
+
+	d := newTestDocker(t, srv.URL)
+	d.network = "dynos"
+	dd := &DockerDynoDriver{d: d}
+	ex := &Executor{
+		Release:   &Release{config: map[string]string{"PORT": "8080"}},
+		container: &docker.Container{ID: "c1"},
+	}
+	if ip, port := dd.IPInfo(ex)(); ip != "10.0.0.2" || port != 8080 {
+		t.Fatalf("expected the address of the dyno in its network, "+
+			"got %s:%d", ip, port)
+	}
+}
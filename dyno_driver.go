@@ -17,6 +17,70 @@ type DynoDriver interface {
 	Wait(*Executor) *ExitStatus
 }
 
+// Reconciler is implemented by dyno drivers that clean up after an
+// earlier run of hsup, e.g. removing the dynos it left behind.  It is
+// called once a release of an application was rolled out, so that a
+// release failing to build or in its release phase leaves what runs
+// alone.
+type Reconciler interface {
+	Reconcile(release *Release) error
+}
+
+// DefaultWorkDir is where drivers keep state on the host, such as
+// stack images and container file systems.
+const DefaultWorkDir = "/var/lib/hsup"
+
+// DriverName returns the name a dyno driver is known by on the command
+// line and in control files.
+func DriverName(dd DynoDriver) (string, error) {
+	switch dd.(type) {
+	case *SimpleDynoDriver:
+		return "simple", nil
+	case *DockerDynoDriver:
+		return "docker", nil
+	case *AbsPathDynoDriver:
+		return "abspath", nil
+	case *LibContainerDynoDriver:
+		return "libcontainer", nil
+	case *OCIDynoDriver:
+		return "oci", nil
+	case *RootlessDynoDriver:
+		return "rootless", nil
+	case *SystemdDynoDriver:
+		return "systemd", nil
+	default:
+		return "", fmt.Errorf("dyno driver %T has no name", dd)
+	}
+}
+
+// NewDriverByName creates a dyno driver from its name, as returned by
+// DriverName.
+func NewDriverByName(name string) (DynoDriver, error) {
+	switch name {
+	case "simple":
+		return &SimpleDynoDriver{}, nil
+	case "docker":
+		return &DockerDynoDriver{}, nil
+	case "abspath":
+		return &AbsPathDynoDriver{}, nil
+	case "libcontainer":
+		return NewLibContainerDynoDriver(DefaultWorkDir)
+	case "oci":
+		return NewOCIDynoDriver(DefaultWorkDir)
+	case "rootless":
+		workDir, err := RootlessWorkDir()
+		if err != nil {
+			return nil, err
+		}
+		return NewRootlessDynoDriver(workDir)
+	case "systemd":
+		return NewSystemdDynoDriver(DefaultWorkDir)
+	default:
+		return nil, fmt.Errorf("could not locate driver. "+
+			"specified by the user: %v", name)
+	}
+}
+
 type ExitStatus struct {
 	Code int
 	Err  error
@@ -29,8 +93,29 @@ type Release struct {
 	stack   string
 	version int
 
+	// slugChecksum is "sha256:<hex digest>" of the slug, or empty
+	// when unknown.
+	slugChecksum string
+
+	// slugPath is the local copy of the slug once fetched, see
+	// fetchSlug, e.g. in the slug cache.
+	slugPath string
+
+	// slugFormat and slugStrip say how to unpack the slug, see
+	// AppSerializable.
+	slugFormat string
+	slugStrip  int
+
+	// stackVersion pins the stack image version, see
+	// AppSerializable.
+	stackVersion string
+
 	// docker dyno driver properties
 	imageName string
+
+	// libcontainer dyno driver properties
+	stackImage string
+	slugLayer  string
 }
 
 func (r *Release) Name() string {
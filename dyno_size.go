@@ -0,0 +1,61 @@
+package hsup
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// DynoSize is how much memory, in bytes, a dyno gets, along with its
+// relative share of CPU, as weighed against other dynos, and its CPU
+// quota, in percent of a CPU.
+type DynoSize struct {
+	Memory    int64
+	CPUShares int64
+	CPUQuota  int64
+}
+
+// DynoSizes are the dyno sizes DOCKER_DYNO_SIZE and DOCKER_DYNO_SIZES,
+// as well as SYSTEMD_DYNO_SIZE and SYSTEMD_DYNO_SIZES, can refer to.
+var DynoSizes = map[string]DynoSize{
+	"standard-1x":   {Memory: 512 << 20, CPUShares: 1024, CPUQuota: 100},
+	"standard-2x":   {Memory: 1 << 30, CPUShares: 2048, CPUQuota: 200},
+	"performance-m": {Memory: 2560 << 20, CPUShares: 4096, CPUQuota: 400},
+	"performance-l": {Memory: 14 << 30, CPUShares: 8192, CPUQuota: 800},
+}
+
+// cpuQuotaPerSecond returns how much CPU time a dyno of this size may
+// use per second of wall clock time.
+func (size *DynoSize) cpuQuotaPerSecond() time.Duration {
+	return time.Duration(size.CPUQuota) * time.Second / 100
+}
+
+// readDynoSizes reads the default dyno size from sizeVar, if set, and
+// the dyno sizes of process types from sizesVar, both referring to
+// DynoSizes.
+func readDynoSizes(sizeVar, sizesVar string) (
+	map[string]DynoSize, *DynoSize, error) {
+	var defaultSize *DynoSize
+	if name := os.Getenv(sizeVar); name != "" {
+		size, ok := DynoSizes[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown %s %q", sizeVar,
+				name)
+		}
+		defaultSize = &size
+	}
+	pairs, err := envPairs(sizesVar, "type=size")
+	if err != nil {
+		return nil, nil, err
+	}
+	sizes := make(map[string]DynoSize)
+	for processType, name := range pairs {
+		size, ok := DynoSizes[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown %s size %q of %s",
+				sizesVar, name, processType)
+		}
+		sizes[processType] = size
+	}
+	return sizes, defaultSize, nil
+}
@@ -48,18 +48,29 @@ type Executor struct {
 	LogplexURL  *url.URL
 	Binds       map[string]string
 
+	// OwnedBinds are host paths of Binds handed over to the user the
+	// dyno runs as before it starts, for it to write to.
+	OwnedBinds []string
+
 	// simple and abspath dyno driver properties
 	cmd       *exec.Cmd
 	waiting   chan struct{}
 	logsRelay *relay
 
 	// docker dyno driver properties
-	container *docker.Container
+	container     *docker.Container
+	containerLogs *dockerLogs
 
-	// libcontainer dyno driver properties
+	// libcontainer, oci and rootless dyno driver properties
 	initExitStatus chan *ExitStatus
 	initProcess    *libcontainer.Process
 
+	// oci and rootless dyno driver properties
+	ociContainer string
+
+	// systemd dyno driver properties
+	systemdUnit string
+
 	// FSM Fields
 	OneShot  bool
 	State    DynoState
@@ -166,6 +177,27 @@ again:
 	}
 }
 
+// runOneShot starts a one-shot executor and waits for it to retire.
+// It returns the exit status of the process, or nil if it could not be
+// started.
+func runOneShot(ex *Executor) *ExitStatus {
+	go ex.Trigger(StayStarted)
+	go func() {
+		for ex.Tick() != ErrExecutorComplete {
+		}
+	}()
+
+	// A one-off executor that fails to start retires without
+	// ever reporting a status.
+	select {
+	case s := <-ex.Status:
+		<-ex.Complete
+		return s
+	case <-ex.Complete:
+		return nil
+	}
+}
+
 func (ex *Executor) Name() string {
 	return ex.ProcessType + "." + strconv.Itoa(ex.ProcessID)
 }
@@ -0,0 +1,134 @@
+package hsup
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newFakeExecutor(dd *FakeDynoDriver, oneShot bool) *Executor {
+	ex := &Executor{
+		Args:        []string{"./web"},
+		DynoDriver:  dd,
+		Release:     &Release{appName: "sushi", version: 1},
+		ProcessID:   1,
+		ProcessType: "web",
+		Complete:    make(chan struct{}),
+		State:       Stopped,
+		OneShot:     oneShot,
+		NewInput:    make(chan DynoInput),
+	}
+	if oneShot {
+		ex.Status = make(chan *ExitStatus)
+	}
+	return ex
+}
+
+// tickUntilComplete runs the tick loop of an executor, like hsup does.
+func tickUntilComplete(ex *Executor) {
+	go ex.Trigger(StayStarted)
+	go func() {
+		for ex.Tick() != ErrExecutorComplete {
+		}
+	}()
+}
+
+func waitForEvents(t *testing.T, dd *FakeDynoDriver, n int) []FakeDynoEvent {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		events := dd.Events()
+		if len(events) >= n {
+			return events
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d events, got %v", n, events)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestExecutorRestartsExitedDyno(t *testing.T) {
+	dd := &FakeDynoDriver{ExitCodes: map[string][]int{"web.1": {1, 2}}}
+	ex := newFakeExecutor(dd, false)
+	tickUntilComplete(ex)
+
+	waitForEvents(t, dd, 5)
+	if running := dd.Running(); !reflect.DeepEqual(running,
+		[]string{"sushi-1 web.1"}) {
+		t.Fatalf("expected web.1 to run again, got %v", running)
+	}
+
+	ex.Trigger(Retire)
+	<-ex.Complete
+	expected := []FakeDynoEvent{
+		{"sushi-1", "web.1", FakeStart, 0},
+		{"sushi-1", "web.1", FakeExit, 1},
+		{"sushi-1", "web.1", FakeStart, 0},
+		{"sushi-1", "web.1", FakeExit, 2},
+		{"sushi-1", "web.1", FakeStart, 0},
+		{"sushi-1", "web.1", FakeStop, 0},
+		{"sushi-1", "web.1", FakeExit, 0},
+	}
+	if events := dd.Events(); !reflect.DeepEqual(events, expected) {
+		t.Fatalf("expected %v, got %v", expected, events)
+	}
+}
+
+func TestExecutorRetriesFailedStarts(t *testing.T) {
+	fail := errors.New("no luck")
+	dd := &FakeDynoDriver{
+		StartErrs: map[string][]error{"web.1": {fail, fail}},
+	}
+	ex := newFakeExecutor(dd, false)
+	tickUntilComplete(ex)
+
+	events := waitForEvents(t, dd, 3)
+	for i, action := range []string{
+		FakeStartFailed, FakeStartFailed, FakeStart,
+	} {
+		if events[i].Action != action {
+			t.Fatalf("expected %s, got %v", action, events)
+		}
+	}
+	ex.Trigger(Retire)
+	<-ex.Complete
+}
+
+func TestExecutorOneShot(t *testing.T) {
+	dd := &FakeDynoDriver{ExitCodes: map[string][]int{"web.1": {3}}}
+	s := runOneShot(newFakeExecutor(dd, true))
+	if s == nil || s.Code != 3 {
+		t.Fatalf("expected exit code 3, got %+v", s)
+	}
+	if running := dd.Running(); len(running) != 0 {
+		t.Fatalf("expected no dyno to run again, got %v", running)
+	}
+
+	dd = &FakeDynoDriver{
+		StartErrs: map[string][]error{"web.1": {errors.New("no luck")}},
+	}
+	if s := runOneShot(newFakeExecutor(dd, true)); s != nil {
+		t.Fatalf("expected no status, got %+v", s)
+	}
+}
+
+func TestExecutorStopsSlowDyno(t *testing.T) {
+	dd := &FakeDynoDriver{StopDelay: 20 * time.Millisecond, StopCode: 143}
+	ex := newFakeExecutor(dd, false)
+	tickUntilComplete(ex)
+	waitForEvents(t, dd, 1)
+
+	start := time.Now()
+	ex.Trigger(Retire)
+	<-ex.Complete
+	if elapsed := time.Since(start); elapsed < dd.StopDelay {
+		t.Fatalf("expected to wait for the dyno to exit, took %v",
+			elapsed)
+	}
+	events := dd.Events()
+	if last := events[len(events)-1]; last.Action != FakeExit ||
+		last.Code != 143 {
+		t.Fatalf("expected the dyno to exit with 143, got %v", events)
+	}
+}
@@ -0,0 +1,222 @@
+package hsup
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// What happened to a dyno of a FakeDynoDriver, see FakeDynoEvent.
+const (
+	FakeBuild       = "build"
+	FakeStart       = "start"
+	FakeStartFailed = "start failed"
+	FakeStop        = "stop"
+	FakeExit        = "exit"
+	FakeReconcile   = "reconcile"
+)
+
+// ErrFakeDynoNotRunning is returned by FakeDynoDriver.Exit for dynos
+// that are not running.
+var ErrFakeDynoNotRunning = errors.New("fake dyno not running")
+
+// FakeDynoDriver runs dynos in memory rather than as processes, as
+// scripted by the tests using it, so that supervision can be tested in
+// milliseconds, without binaries, root or a Docker daemon.  Dynos are
+// scripted by name, e.g. "web.1", whatever release they run.  The zero
+// value builds every release and starts dynos that run until stopped.
+type FakeDynoDriver struct {
+	// BuildErrs are returned by Build, by release name, e.g. "sushi-2".
+	BuildErrs map[string]error
+
+	// BuildDelays are how long Build takes, by release name.
+	BuildDelays map[string]time.Duration
+
+	// StartErrs are returned by the successive starts of a dyno, nil
+	// letting it start.  Once they run out, the dyno starts.
+	StartErrs map[string][]error
+
+	// ExitCodes are those of the successive runs of a dyno, which
+	// exits by itself after RunTime.  Once they run out, the dyno
+	// runs until stopped.
+	ExitCodes map[string][]int
+
+	// StartDelay is how long starting a dyno takes, RunTime how long
+	// dynos with an exit code run, and StopDelay how long dynos take
+	// to exit once stopped, with StopCode.
+	StartDelay time.Duration
+	RunTime    time.Duration
+	StopDelay  time.Duration
+	StopCode   int
+
+	mu      sync.Mutex
+	events  []FakeDynoEvent
+	running map[*Executor]*fakeDyno
+	starts  map[string]int
+	runs    map[string]int
+}
+
+// FakeDynoEvent is something that happened to a dyno of a
+// FakeDynoDriver, or to its release for FakeBuild and FakeReconcile.
+type FakeDynoEvent struct {
+	Release string
+	Dyno    string
+	Action  string
+	Code    int
+}
+
+func (e FakeDynoEvent) String() string {
+	s := e.Release + " " + e.Dyno + " " + e.Action
+	if e.Action == FakeExit {
+		s += " " + strconv.Itoa(e.Code)
+	}
+	return s
+}
+
+// fakeDyno is a running dyno of a FakeDynoDriver, which exits once.
+type fakeDyno struct {
+	exited chan *ExitStatus
+	once   sync.Once
+}
+
+func (d *fakeDyno) exit(code int) {
+	d.once.Do(func() {
+		d.exited <- &ExitStatus{Code: code}
+	})
+}
+
+func (dd *FakeDynoDriver) init() {
+	if dd.running == nil {
+		dd.running = make(map[*Executor]*fakeDyno)
+		dd.starts = make(map[string]int)
+		dd.runs = make(map[string]int)
+	}
+}
+
+func (dd *FakeDynoDriver) record(release, dyno, action string, code int) {
+	dd.events = append(dd.events, FakeDynoEvent{
+		Release: release,
+		Dyno:    dyno,
+		Action:  action,
+		Code:    code,
+	})
+}
+
+func (dd *FakeDynoDriver) Build(release *Release) error {
+	time.Sleep(dd.BuildDelays[release.Name()])
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	dd.record(release.Name(), "", FakeBuild, 0)
+	return dd.BuildErrs[release.Name()]
+}
+
+func (dd *FakeDynoDriver) Reconcile(release *Release) error {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	dd.record(release.Name(), "", FakeReconcile, 0)
+	return nil
+}
+
+func (dd *FakeDynoDriver) Start(ex *Executor) error {
+	time.Sleep(dd.StartDelay)
+
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	dd.init()
+	name := ex.Name()
+
+	n := dd.starts[name]
+	dd.starts[name]++
+	if errs := dd.StartErrs[name]; n < len(errs) && errs[n] != nil {
+		dd.record(ex.Release.Name(), name, FakeStartFailed, 0)
+		return errs[n]
+	}
+
+	d := &fakeDyno{exited: make(chan *ExitStatus, 1)}
+	dd.running[ex] = d
+	dd.record(ex.Release.Name(), name, FakeStart, 0)
+
+	run := dd.runs[name]
+	dd.runs[name]++
+	if codes := dd.ExitCodes[name]; run < len(codes) {
+		code := codes[run]
+		time.AfterFunc(dd.RunTime, func() { d.exit(code) })
+	}
+
+	port, _ := strconv.Atoi(ex.Release.config["PORT"])
+	ex.IPInfo = func() (string, int) {
+		return "127.0.0.1", port
+	}
+	return nil
+}
+
+func (dd *FakeDynoDriver) Wait(ex *Executor) *ExitStatus {
+	dd.mu.Lock()
+	d := dd.running[ex]
+	dd.mu.Unlock()
+	if d == nil {
+		return &ExitStatus{Err: ErrFakeDynoNotRunning}
+	}
+	s := <-d.exited
+
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	delete(dd.running, ex)
+	dd.record(ex.Release.Name(), ex.Name(), FakeExit, s.Code)
+	return s
+}
+
+// Stop makes a running dyno exit with StopCode after StopDelay.  Dynos
+// that exited already are left alone.
+func (dd *FakeDynoDriver) Stop(ex *Executor) error {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	dd.record(ex.Release.Name(), ex.Name(), FakeStop, 0)
+
+	if d := dd.running[ex]; d != nil {
+		time.AfterFunc(dd.StopDelay, func() { d.exit(dd.StopCode) })
+	}
+	return nil
+}
+
+// Exit makes the running dynos with the given name, e.g. "web.1", exit
+// with code, as if their process exited.
+func (dd *FakeDynoDriver) Exit(dyno string, code int) error {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	var found bool
+	for ex, d := range dd.running {
+		if ex.Name() == dyno {
+			d.exit(code)
+			found = true
+		}
+	}
+	if !found {
+		return ErrFakeDynoNotRunning
+	}
+	return nil
+}
+
+// Events returns what happened to dynos so far, in order.
+func (dd *FakeDynoDriver) Events() []FakeDynoEvent {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	return append([]FakeDynoEvent(nil), dd.events...)
+}
+
+// Running returns the dynos running, as "release dyno", e.g.
+// "sushi-2 web.1", sorted.
+func (dd *FakeDynoDriver) Running() []string {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	var running []string
+	for ex := range dd.running {
+		running = append(running,
+			fmt.Sprintf("%s %s", ex.Release.Name(), ex.Name()))
+	}
+	sort.Strings(running)
+	return running
+}
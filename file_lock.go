@@ -0,0 +1,80 @@
+package hsup
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// FileLock is an exclusive lock coordinating hsup processes on a host,
+// e.g. so that only one of them downloads a stack image.  It is a
+// flock(2) on a file that also records the pid of its holder for
+// those waiting.  The kernel releases the lock when its holder exits,
+// so a dead process never leaves a stale lock behind.
+type FileLock struct {
+	f *os.File
+}
+
+// LockFile takes the lock at path, waiting for as long as another
+// process holds it and logging who that is every now and then.
+// What the lock protects is described by what.
+func LockFile(path, what string) (*FileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	lastLog := time.Time{}
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, err
+		}
+
+		if time.Since(lastLog) >= 10*time.Second {
+			log.Printf("waiting for %s, locked by pid %s for %v",
+				what, lockHolder(path),
+				time.Since(start)/time.Second*time.Second)
+			lastLog = time.Now()
+		}
+		time.Sleep(time.Second)
+	}
+
+	// The file is never removed, as another process may be about
+	// to lock it: only its contents change hands.
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileLock{f: f}, nil
+}
+
+func lockHolder(path string) string {
+	pid, err := ioutil.ReadFile(path)
+	if err != nil || len(pid) == 0 {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(pid))
+}
+
+// Unlock releases the lock.
+func (l *FileLock) Unlock() error {
+	if err := l.f.Truncate(0); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
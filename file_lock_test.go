@@ -0,0 +1,70 @@
+package hsup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFileLockExcludes(t *testing.T) {
+	dir := newTmpDb(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.lock")
+
+	first, err := LockFile(path, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid, _ := ioutil.ReadFile(path); string(pid) != strconv.Itoa(os.Getpid()) {
+		t.Fatalf("expected the lock to record its holder, got %q", pid)
+	}
+
+	locked := make(chan *FileLock)
+	go func() {
+		second, err := LockFile(path, "test")
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- second
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("expected the lock to be held")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := first.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case second := <-locked:
+		if err := second.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the lock to be released")
+	}
+}
+
+func TestFileLockReleasedOnClose(t *testing.T) {
+	dir := newTmpDb(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.lock")
+
+	// As if its holder had died.
+	first, err := LockFile(path, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.f.Close()
+
+	second, err := LockFile(path, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Unlock()
+}
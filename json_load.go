@@ -1,8 +1,9 @@
 package hsup
 
 import (
+	"bytes"
 	"encoding/json"
-	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -12,6 +13,7 @@ import (
 type conf struct {
 	dstNew        func() interface{}
 	path          string
+	validate      func(interface{}) error
 	accessProtect sync.RWMutex
 
 	snapshot interface{}
@@ -118,9 +120,13 @@ func (c *conf) Notify() (newInfo bool, err error) {
 		return newInfo, err
 	}
 
-	// Validate that the JSON is in the expected format.
+	// Validate that the JSON is in the expected format, and then
+	// that what it describes makes sense.
 	newSnap := c.dstNew()
-	nonfatale := json.Unmarshal(contents, newSnap)
+	nonfatale := decodeStrict(contents, newSnap)
+	if nonfatale == nil && c.validate != nil {
+		nonfatale = c.validate(newSnap)
+	}
 	if nonfatale != nil {
 		// Nope, can't understand the passed JSON, reject it.
 		if err := c.reject(p, nonfatale); err != nil {
@@ -244,6 +250,26 @@ func (c *conf) persistLoaded(contents []byte) (err error) {
 	return nil
 }
 
+// decodeStrict is like json.Unmarshal, except that fields not present
+// in dst and trailing data after the document are errors: a typoed
+// field name would otherwise be silently ignored.
+func decodeStrict(contents []byte, dst interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(contents))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return decodeError(err)
+	}
+
+	var extra json.RawMessage
+	if err := dec.Decode(&extra); err != io.EOF {
+		verr := &ValidationError{}
+		verr.Add("", "unexpected data after the JSON document")
+		return verr
+	}
+
+	return nil
+}
+
 func (c *conf) reject(submitPath string, nonfatale error) (err error) {
 	// Perform move to the rejection file
 	err = os.Rename(submitPath, c.rejPath())
@@ -254,10 +280,17 @@ func (c *conf) reject(submitPath string, nonfatale error) (err error) {
 	// Render and write the cause of the rejection.  Don't bother
 	// syncing it to disk: an incomplete or empty file on a crash
 	// seems acceptable for now.
-	err = ioutil.WriteFile(
-		c.errPath(),
-		[]byte(fmt.Sprintf("%#v\n", nonfatale)),
-		0400)
+	verr, ok := nonfatale.(*ValidationError)
+	if !ok {
+		verr = &ValidationError{}
+		verr.Add("", "%v", nonfatale)
+	}
+	rendered, err := json.MarshalIndent(verr, "", "    ")
+	if err != nil {
+		return err
+	}
+	os.Remove(c.errPath())
+	err = ioutil.WriteFile(c.errPath(), append(rendered, '\n'), 0400)
 	if err != nil {
 		return err
 	}
@@ -8,6 +8,22 @@ var ErrDriverNotSupported = errors.New(
 	"the libcontainer driver is not supported on this platform",
 )
 
+func GCStackImages(string) ([]string, error) {
+	return nil, ErrDriverNotSupported
+}
+
+func GCReleaseLayers(string) ([]string, error) {
+	return nil, ErrDriverNotSupported
+}
+
+func RefreshStacksManifest(string) ([]string, error) {
+	return nil, ErrDriverNotSupported
+}
+
+func RegisterStackImage(string, string, string, string) error {
+	return ErrDriverNotSupported
+}
+
 type LibContainerDynoDriver struct{}
 
 func NewLibContainerDynoDriver(string) (*LibContainerDynoDriver, error) {
@@ -29,6 +45,76 @@ func (dd *LibContainerDynoDriver) Wait(*Executor) *ExitStatus {
 	return nil
 }
 
+type OCIDynoDriver struct{}
+
+func NewOCIDynoDriver(string) (*OCIDynoDriver, error) {
+	return nil, ErrDriverNotSupported
+}
+
+func (dd *OCIDynoDriver) Build(*Release) error {
+	return ErrDriverNotSupported
+}
+
+func (dd *OCIDynoDriver) Start(*Executor) error {
+	return ErrDriverNotSupported
+}
+
+func (dd *OCIDynoDriver) Stop(*Executor) error {
+	return ErrDriverNotSupported
+}
+
+func (dd *OCIDynoDriver) Wait(*Executor) *ExitStatus {
+	return nil
+}
+
+type RootlessDynoDriver struct{}
+
+func RootlessWorkDir() (string, error) {
+	return "", ErrDriverNotSupported
+}
+
+func NewRootlessDynoDriver(string) (*RootlessDynoDriver, error) {
+	return nil, ErrDriverNotSupported
+}
+
+func (dd *RootlessDynoDriver) Build(*Release) error {
+	return ErrDriverNotSupported
+}
+
+func (dd *RootlessDynoDriver) Start(*Executor) error {
+	return ErrDriverNotSupported
+}
+
+func (dd *RootlessDynoDriver) Stop(*Executor) error {
+	return ErrDriverNotSupported
+}
+
+func (dd *RootlessDynoDriver) Wait(*Executor) *ExitStatus {
+	return nil
+}
+
+type SystemdDynoDriver struct{}
+
+func NewSystemdDynoDriver(string) (*SystemdDynoDriver, error) {
+	return nil, ErrDriverNotSupported
+}
+
+func (dd *SystemdDynoDriver) Build(*Release) error {
+	return ErrDriverNotSupported
+}
+
+func (dd *SystemdDynoDriver) Start(*Executor) error {
+	return ErrDriverNotSupported
+}
+
+func (dd *SystemdDynoDriver) Stop(*Executor) error {
+	return ErrDriverNotSupported
+}
+
+func (dd *SystemdDynoDriver) Wait(*Executor) *ExitStatus {
+	return nil
+}
+
 type LibContainerInitDriver struct{}
 
 func (dd *LibContainerInitDriver) Build(*Release) error {
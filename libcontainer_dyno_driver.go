@@ -12,6 +12,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -37,6 +38,9 @@ var (
 	// default to max 8K dynos
 	dynoMinUID int = 3000
 	dynoMaxUID int = 11000
+
+	dynoRootFS      = DynoRootFSBind
+	dynoAppReadOnly bool
 )
 
 type LibContainerDynoDriver struct {
@@ -49,6 +53,9 @@ type LibContainerDynoDriver struct {
 	primaryNetwork libnetwork.Network
 	extraNetwork   libnetwork.Network
 	extraRoutes    []*configs.Route
+
+	// buildMu serializes builds of releases again, see builtPaths.
+	buildMu sync.Mutex
 }
 
 type InvalidExtraIFErr struct {
@@ -72,6 +79,8 @@ func (e *InvalidExtraIFErr) Error() string {
 // - LIBCONTAINER_DYNO_EXTRA_ROUTES
 // - LIBCONTAINER_DYNO_UID_MIN
 // - LIBCONTAINER_DYNO_UID_MAX
+// - LIBCONTAINER_DYNO_ROOTFS
+// - LIBCONTAINER_DYNO_APP_READONLY
 func init() {
 	// hack to act as PID=1 inside containers
 	if len(os.Args) > 1 && os.Args[1] == "libcontainer-init" {
@@ -164,6 +173,24 @@ func init() {
 		}
 		dynoMaxUID = max
 	}
+
+	if rootFS := strings.TrimSpace(
+		os.Getenv("LIBCONTAINER_DYNO_ROOTFS"),
+	); len(rootFS) > 0 {
+		if rootFS != DynoRootFSBind && rootFS != DynoRootFSOverlay {
+			panic("invalid LIBCONTAINER_DYNO_ROOTFS " + rootFS)
+		}
+		dynoRootFS = rootFS
+	}
+	if appReadOnly := strings.TrimSpace(
+		os.Getenv("LIBCONTAINER_DYNO_APP_READONLY"),
+	); len(appReadOnly) > 0 {
+		readOnly, err := strconv.ParseBool(appReadOnly)
+		if err != nil {
+			panic(err)
+		}
+		dynoAppReadOnly = readOnly
+	}
 }
 
 func NewLibContainerDynoDriver(workDir string) (*LibContainerDynoDriver, error) {
@@ -238,18 +265,70 @@ func dynoNetworks(
 	return primary, extra, nil
 }
 
+func (dd *LibContainerDynoDriver) ValidateApp(app *AppSerializable,
+	verr *ValidationError) {
+	validateSlug(app, verr)
+	validateZstd(app, verr)
+	validateStackImage(dd.stacksDir, app, verr)
+}
+
+// validateStackImage checks that the stack of an application, and its
+// pinned stack version, are among the stack images in stacksDir.
+func validateStackImage(stacksDir string, app *AppSerializable,
+	verr *ValidationError) {
+	stacks, err := HerokuStacksFromManifest(stacksDir)
+	if err != nil {
+		// Not knowing which stacks exist is no reason to turn
+		// the application away: Build will report it again.
+		log.Println("could not read stacks manifest:", err)
+		return
+	}
+	names := make([]string, len(stacks))
+	for i, stack := range stacks {
+		names[i] = strings.TrimSpace(stack.Name)
+	}
+	validateStack(app, names, verr)
+
+	if app.StackVersion != "" {
+		_, err := SelectStackImage(stacks, app.Stack, app.StackVersion)
+		if err != nil {
+			verr.Add("StackVersion", "%v", err)
+		}
+	}
+}
+
 func (dd *LibContainerDynoDriver) Build(release *Release) error {
+	// Fetch the slug on the host, through the slug cache, so that
+	// dynos only need to copy it.
+	if release.slugURL != "" {
+		if err := fetchSlug(release); err != nil {
+			return err
+		}
+	}
+
 	stacks, err := HerokuStacksFromManifest(dd.stacksDir)
 	if err != nil {
 		return err
 	}
-	for _, stack := range stacks {
-		if strings.TrimSpace(stack.Name) != release.stack {
-			continue
-		}
-		if err := stack.mount(); err != nil {
+	img, err := SelectStackImage(stacks, release.stack,
+		release.stackVersion)
+	if err != nil {
+		return err
+	}
+	if err := img.mount(); err != nil {
+		return err
+	}
+	release.stackImage = img.Dir()
+
+	// Unpack the slug once for all dynos of the release, rather
+	// than once per dyno.
+	if release.slugURL != "" {
+		layer, err := unpackReleaseLayer(dd.workDir, release,
+			releaseLayerGID())
+		if err != nil {
 			return err
 		}
+		release.slugLayer = layer
 	}
 	return nil
 }
@@ -266,23 +345,123 @@ func (dd *LibContainerDynoDriver) networkFor(uid int) (*SmallSubnet, error) {
 	return subnet, nil
 }
 
+// dynoSandbox is what the container of a dyno runs in, prepared on
+// the host: its network, root file system and the hsup to run as its
+// init (PID=1) process, along with the configuration of its container.
+type dynoSandbox struct {
+	uuid          string
+	uid           int
+	dataPath      string
+	rootFSPath    string
+	writablePaths []string
+	appOverlay    bool
+	config        *configs.Config
+
+	endpoint      libnetwork.Endpoint
+	extraEndpoint libnetwork.Endpoint
+}
+
+// hsupInitPath is where the hsup run as the init process of a dyno
+// is, in its container.
+const hsupInitPath = "/tmp/hsup"
+
 func (dd *LibContainerDynoDriver) Start(ex *Executor) error {
 	ex.initExitStatus = make(chan *ExitStatus)
 
+	sb, err := dd.newSandbox(ex)
+	if err != nil {
+		return err
+	}
+
+	// Init (PID=1) hsup process with the abspath driver
+	hsupInit := &libcontainer.Process{
+		Args:   []string{hsupInitPath},
+		Env:    []string{"HSUP_CONTROL_FILE=" + ControlFileInContainer},
+		Cwd:    "/app",
+		User:   fmt.Sprintf("%d:%d", sb.uid, sb.uid),
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	ex.initProcess = hsupInit
+
+	var container libcontainer.Container
+	// GC
+	defer func() {
+		go func() {
+			// TODO: stop swallowing errors
+			code, err := hsupInit.Wait()
+			if err != nil {
+				log.Printf("process.Wait fails: %q", err)
+			}
+
+			// TODO: gc after sending back the exit status
+			// doing so right now terminates the program too early,
+			// before everything is removed
+			if container != nil {
+				if err := container.Destroy(); err != nil {
+					log.Printf(
+						"container.Destroy error: %#+v",
+						err,
+					)
+				}
+			}
+			dd.destroySandbox(sb)
+
+			var ec int
+			if code != nil {
+				ec = code.Sys().(syscall.WaitStatus).ExitStatus()
+			}
+
+			// TODO: handle exit status when signaled
+			ex.initExitStatus <- &ExitStatus{
+				Code: ec,
+				Err:  err,
+			}
+			close(ex.initExitStatus)
+		}()
+	}()
+
+	// Container Exec
+	factory, err := libcontainer.New(
+		filepath.Join(dd.containersDir, "libcontainer"),
+		libcontainer.InitArgs(os.Args[0], "libcontainer-init"),
+	)
+	if err != nil {
+		return err
+	}
+
+	container, err = factory.Create(sb.uuid, sb.config)
+	if err != nil {
+		return err
+	}
+	return container.Start(hsupInit)
+}
+
+// newSandbox prepares the sandbox of a dyno, to be destroyed once its
+// container exits.
+func (dd *LibContainerDynoDriver) newSandbox(ex *Executor) (
+	*dynoSandbox, error) {
 	containerUUID := uuid.New()
 	uid, err := dd.allocator.ReserveUID()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	sb := &dynoSandbox{uuid: containerUUID, uid: uid}
+	for _, path := range ex.OwnedBinds {
+		if err := chownTree(path, uid, uid); err != nil {
+			return nil, err
+		}
 	}
 
 	// Network
 	network, err := dd.networkFor(uid)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	port, err := strconv.Atoi(ex.Release.config["PORT"])
 	if err != nil {
-		return err
+		return nil, err
 	}
 	ex.IPInfo = func() (string, int) {
 		return network.Host().IP.String(), port
@@ -291,104 +470,145 @@ func (dd *LibContainerDynoDriver) Start(ex *Executor) error {
 	addressOpt := map[string]interface{}{
 		"subnet": network,
 	}
-	endpoint, err := dd.primaryNetwork.CreateEndpoint(containerUUID,
+	if sb.endpoint, err = dd.primaryNetwork.CreateEndpoint(containerUUID,
 		libnetwork.EndpointOptionGeneric(addressOpt),
-	)
-	if err != nil {
-		return err
+	); err != nil {
+		return nil, err
 	}
-	if err := endpoint.Join(containerUUID,
+	if err := sb.endpoint.Join(containerUUID,
 		libnetwork.JoinOptionHostname(containerUUID),
 	); err != nil {
-		return err
+		return nil, err
 	}
-	var extraEndpoint libnetwork.Endpoint
 	if dd.extraNetwork != nil {
 		extraAddressOpt := map[string]interface{}{
 			"address": extraIFIP,
 		}
-		if extraEndpoint, err = dd.extraNetwork.CreateEndpoint(containerUUID,
+		if sb.extraEndpoint, err = dd.extraNetwork.CreateEndpoint(containerUUID,
 			libnetwork.EndpointOptionGeneric(extraAddressOpt),
 		); err != nil {
-			return err
+			return nil, err
 		}
-		if err := extraEndpoint.Join(containerUUID); err != nil {
-			return err
+		if err := sb.extraEndpoint.Join(containerUUID); err != nil {
+			return nil, err
 		}
 	}
 
 	// Root FS
-	stackImagePath, err := CurrentStackImagePath(
-		dd.stacksDir, ex.Release.stack,
-	)
+	stackImagePath, slugLayer, err := builtPaths(dd, &dd.buildMu,
+		ex.Release)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if stackImagePath == "" {
+		// Not built by this hsup, e.g. with SkipBuild.
+		if stackImagePath, err = CurrentStackImagePath(
+			dd.stacksDir, ex.Release.stack,
+		); err != nil {
+			return nil, err
+		}
 	}
 	dataPath := filepath.Join(dd.containersDir, containerUUID)
+	sb.dataPath = dataPath
 	if err := os.MkdirAll(dataPath, 0755); err != nil {
-		return err
+		return nil, err
+	}
+	if err := useStackImage(stackImagePath, dataPath); err != nil {
+		return nil, err
 	}
-	writablePaths := []string{
+	if slugLayer != "" {
+		if err := useReleaseLayer(slugLayer, dataPath); err != nil {
+			return nil, err
+		}
+	}
+	sb.writablePaths = []string{
 		filepath.Join(dataPath, "app"),
 		filepath.Join(dataPath, "dev"),
 		filepath.Join(dataPath, "tmp"),
 		filepath.Join(dataPath, "var", "tmp"),
 	}
-	for _, path := range writablePaths {
+	for _, path := range sb.writablePaths {
 		if err := os.MkdirAll(path, 0755); err != nil {
-			return err
+			return nil, err
 		}
 		if err := os.Chown(path, uid, uid); err != nil {
-			return err
+			return nil, err
 		}
 	}
-	rootFSPath := filepath.Join(dataPath, "root")
-	if err := os.MkdirAll(rootFSPath, 0755); err != nil {
-		return err
+	sb.rootFSPath = filepath.Join(dataPath, "root")
+	if err := os.MkdirAll(sb.rootFSPath, 0755); err != nil {
+		return nil, err
 	}
 
-	// stack image is the rootFS
-	if err := syscall.Mount(
-		stackImagePath, rootFSPath, "bind",
-		syscall.MS_RDONLY|syscall.MS_BIND, "",
-	); err != nil {
-		return err
+	if dynoRootFS == DynoRootFSOverlay {
+		lower := []string{stackImagePath}
+		if slugLayer != "" {
+			lower = append([]string{slugLayer}, lower...)
+		}
+		if err := mountOverlayRootFS(
+			lower, dataPath, sb.rootFSPath, uid,
+		); err != nil {
+			return nil, err
+		}
+	} else {
+		// stack image is the rootFS
+		if err := syscall.Mount(
+			stackImagePath, sb.rootFSPath, "bind",
+			syscall.MS_RDONLY|syscall.MS_BIND, "",
+		); err != nil {
+			return nil, err
+		}
+	}
+	sb.appOverlay = dynoRootFS == DynoRootFSBind && !dynoAppReadOnly &&
+		slugLayer != ""
+	if sb.appOverlay {
+		if err := mountAppOverlay(slugLayer, dataPath, uid); err != nil {
+			return nil, err
+		}
 	}
 
 	if err := createPasswdWithDynoUser(
 		stackImagePath, dataPath, uid,
 	); err != nil {
-		return err
+		return nil, err
 	}
 
-	if ex.Release.Where() == Local {
+	slug := ex.Release.slugURL
+	if slugLayer != "" {
+		// Already in /app, from the release layer.
+		slug = ""
+	}
+	if slug != "" && ex.Release.slugPath != "" {
 		// move into the container
 		if err := copyFile(
-			ex.Release.slugURL,
-			filepath.Join(dataPath, "tmp", "slug.tgz"),
+			ex.Release.slugPath,
+			filepath.Join(dataPath, "tmp", "slug"),
 			0644,
 		); err != nil {
-			return err
+			return nil, err
 		}
-		ex.Release.slugURL = "/tmp/slug.tgz"
+		slug = "/tmp/slug"
 	}
 
 	outsideContainer, err := filepath.Abs(linuxAmd64Path())
 	if err != nil {
-		return err
+		return nil, err
 	}
-	insideContainer := filepath.Join(dataPath, "tmp", "hsup")
+	insideContainer := filepath.Join(dataPath, hsupInitPath)
 	if err := copyFile(outsideContainer, insideContainer, 0755); err != nil {
-		return err
+		return nil, err
 	}
 
-	// Init (PID=1) hsup process with the abspath driver
 	hsupConfig := Startup{
 		App: AppSerializable{
 			Version: ex.Release.version,
 			Env:     ex.Release.config,
-			Slug:    ex.Release.slugURL,
+			Slug:    slug,
 			Stack:   ex.Release.stack,
+
+			SlugFormat:          ex.Release.slugFormat,
+			SlugStripComponents: &ex.Release.slugStrip,
+
 			Processes: []FormationSerializable{
 				{
 					FArgs:     ex.Args,
@@ -405,115 +625,97 @@ func (dd *LibContainerDynoDriver) Start(ex *Executor) error {
 		Driver:      &AbsPathDynoDriver{},
 		FormName:    ex.ProcessType,
 	}
-	hsupInit := &libcontainer.Process{
-		Args:   []string{"/tmp/hsup"},
-		Env:    []string{"HSUP_CONTROL_GOB=" + hsupConfig.ToBase64Gob()},
-		Cwd:    "/app",
-		User:   fmt.Sprintf("%d:%d", uid, uid),
-		Stdin:  os.Stdin,
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
-	}
-	ex.initProcess = hsupInit
-
-	var container libcontainer.Container
-	// GC
-	defer func() {
-		go func() {
-			// TODO: stop swallowing errors
-			code, err := hsupInit.Wait()
-			if err != nil {
-				log.Printf("process.Wait fails: %q", err)
-			}
-
-			// TODO: gc after sending back the exit status
-			// doing so right now terminates the program too early,
-			// before everything is removed
-			if container != nil {
-				if err := container.Destroy(); err != nil {
-					log.Printf(
-						"container.Destroy error: %#+v",
-						err,
-					)
-				}
-			}
-			if err := syscall.Unmount(rootFSPath, 0); err != nil {
-				log.Printf("unmount error: %#+v", err)
-			}
-			for _, path := range writablePaths {
-				if err := os.RemoveAll(path); err != nil {
-					log.Printf("remove all error: %#+v", err)
-				}
-			}
-			if err := os.RemoveAll(dataPath); err != nil {
-				log.Printf("datapath remove all error: %#+v", err)
-			}
-			if err := dd.controller.LeaveAll(containerUUID); err != nil {
-				log.Printf("controller.LeaveAll error: %#+v", err)
-			}
-			if err := endpoint.Delete(); err != nil {
-				log.Printf("endpoint.Leave error: %#+v", err)
-			}
-			if extraEndpoint != nil {
-				if err := extraEndpoint.Delete(); err != nil {
-					log.Printf("extraEndpoint.Leave error: %#+v", err)
-				}
-			}
-			netGCDone := make(chan struct{}, 1)
-			go func() {
-				dd.controller.GC()
-				netGCDone <- struct{}{}
-			}()
-			// wait at most 10s
-			select {
-			case <-netGCDone:
-			case <-time.After(10 * time.Second):
-			}
-
-			// it's probably safe to ignore errors here. Worst case
-			// scenario, this uid won't be be reused.
-			dd.allocator.FreeUID(uid)
-
-			var ec int
-			if code != nil {
-				ec = code.Sys().(syscall.WaitStatus).ExitStatus()
-			}
-
-			// TODO: handle exit status when signaled
-			ex.initExitStatus <- &ExitStatus{
-				Code: ec,
-				Err:  err,
-			}
-			close(ex.initExitStatus)
-		}()
-	}()
-
-	// Container Exec
-	factory, err := libcontainer.New(
-		filepath.Join(dd.containersDir, "libcontainer"),
-		libcontainer.InitArgs(os.Args[0], "libcontainer-init"),
+	controlFile := filepath.Join(
+		dataPath, "tmp", filepath.Base(ControlFileInContainer),
 	)
-	if err != nil {
-		return err
+	if err := hsupConfig.WriteControlFile(controlFile); err != nil {
+		return nil, err
+	}
+	if err := os.Chown(controlFile, uid, uid); err != nil {
+		return nil, err
 	}
 
 	extraRoutes, err := dd.replaceDefaultInExtraRoutes(containerUUID, dd.extraRoutes)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	container, err = factory.Create(
-		containerUUID, containerConfig(
-			containerUUID,
-			dataPath,
-			endpoint.Info().SandboxKey(),
-			extraRoutes,
-		),
+	config := containerConfig(
+		containerUUID,
+		dataPath,
+		sb.endpoint.Info().SandboxKey(),
+		extraRoutes,
 	)
-	if err != nil {
-		return err
+	switch {
+	case dynoRootFS == DynoRootFSOverlay:
+		overlayConfig(config)
+	case slugLayer != "" && !sb.appOverlay:
+		readOnlyAppConfig(config, slugLayer)
+	}
+	if slugLayer != "" {
+		config.AdditionalGroups = []string{
+			strconv.Itoa(releaseLayerGID()),
+		}
 	}
-	return container.Start(hsupInit)
+	// Mounted after /tmp, so that bind mounts can be placed in it
+	// despite the root file system being read only.
+	for outside, inside := range ex.Binds {
+		config.Mounts = append(config.Mounts, &configs.Mount{
+			Device:      "bind",
+			Flags:       syscall.MS_NOSUID | syscall.MS_BIND,
+			Destination: inside,
+			Source:      outside,
+		})
+	}
+	sb.config = config
+	return sb, nil
+}
+
+// destroySandbox unmounts and removes the sandbox of a dyno whose
+// container exited, and frees its network and uid.
+func (dd *LibContainerDynoDriver) destroySandbox(sb *dynoSandbox) {
+	if err := syscall.Unmount(sb.rootFSPath, 0); err != nil {
+		log.Printf("unmount error: %#+v", err)
+	}
+	if sb.appOverlay {
+		app := filepath.Join(sb.dataPath, "app")
+		if err := syscall.Unmount(app, 0); err != nil {
+			log.Printf("unmount error: %#+v", err)
+		}
+	}
+	for _, path := range sb.writablePaths {
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("remove all error: %#+v", err)
+		}
+	}
+	if err := os.RemoveAll(sb.dataPath); err != nil {
+		log.Printf("datapath remove all error: %#+v", err)
+	}
+	if err := dd.controller.LeaveAll(sb.uuid); err != nil {
+		log.Printf("controller.LeaveAll error: %#+v", err)
+	}
+	if err := sb.endpoint.Delete(); err != nil {
+		log.Printf("endpoint.Leave error: %#+v", err)
+	}
+	if sb.extraEndpoint != nil {
+		if err := sb.extraEndpoint.Delete(); err != nil {
+			log.Printf("extraEndpoint.Leave error: %#+v", err)
+		}
+	}
+	netGCDone := make(chan struct{}, 1)
+	go func() {
+		dd.controller.GC()
+		netGCDone <- struct{}{}
+	}()
+	// wait at most 10s
+	select {
+	case <-netGCDone:
+	case <-time.After(10 * time.Second):
+	}
+
+	// it's probably safe to ignore errors here. Worst case
+	// scenario, this uid won't be be reused.
+	dd.allocator.FreeUID(sb.uid)
 }
 
 func (dd *LibContainerDynoDriver) Wait(ex *Executor) (s *ExitStatus) {
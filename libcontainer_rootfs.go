@@ -0,0 +1,435 @@
+// +build linux
+
+package hsup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/opencontainers/runc/libcontainer/configs"
+)
+
+// Root file systems of libcontainer dynos, see LIBCONTAINER_DYNO_ROOTFS.
+//
+// With DynoRootFSBind, the stack image is bind mounted read-only and
+// only /tmp, /var/tmp and /app are writable.  The slug, unpacked once
+// per release, is the lower directory of an overlay on /app with a
+// writable upper directory per dyno, or bind mounted read-only onto
+// it when LIBCONTAINER_DYNO_APP_READONLY says so.  With
+// DynoRootFSOverlay, the whole root file system is an overlay of the
+// stack image, the slug and a writable upper directory per dyno,
+// discarded when it exits.
+const (
+	DynoRootFSBind    = "bind"
+	DynoRootFSOverlay = "overlay"
+)
+
+// releaseLayersDir is where slugs are unpacked, in the libcontainer
+// work directory, to be shared between dynos of the same release.
+const releaseLayersDir = "releases"
+
+// releaseLayerUseFile is written into the data directory of every
+// libcontainer dyno with a slug, naming the release layer it runs.
+const releaseLayerUseFile = "release-layer"
+
+// releaseLayerGCAge is how long unused release layers are kept, so
+// that those of releases built but with no dyno started yet are not
+// removed.
+const releaseLayerGCAge = time.Hour
+
+// slugUnpackUID is the user, nobody, that hsup running as root unpacks
+// release layers as, so that slugs can't write anywhere else on the
+// host, see unpackSlugAsNobody.
+const slugUnpackUID = 65534
+
+// unpackSlugCommand is the argument hsup re-executes itself with to
+// unpack a slug, in the directory of file descriptor 3.
+const unpackSlugCommand = "unpack-slug"
+
+func init() {
+	if len(os.Args) > 1 && os.Args[1] == unpackSlugCommand {
+		if err := unpackSlugChild(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+}
+
+// unpackSlugChild unpacks the slug on stdin, of the format and with
+// the number of components to strip in args, into the directory of
+// file descriptor 3.
+func unpackSlugChild(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %s FORMAT STRIP", unpackSlugCommand)
+	}
+	strip, err := strconv.Atoi(args[1])
+	if err != nil {
+		return err
+	}
+	if err := syscall.Fchdir(3); err != nil {
+		return err
+	}
+	return extractSlug(os.Stdin, args[0], ".", strip)
+}
+
+// unpackSlugAsNobody extracts a slug into dir.  Running as root, hsup
+// does so in a child process running as slugUnpackUID, handed dir as
+// an open file: the parent of dir must only be reachable by root, so
+// that no other process of that user can tamper with the slug.
+func unpackSlugAsNobody(slug io.Reader, format, dir string,
+	strip int) error {
+	if os.Getuid() != 0 {
+		return extractSlug(slug, format, dir, strip)
+	}
+
+	if err := os.Chown(dir, slugUnpackUID, slugUnpackUID); err != nil {
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("/proc/self/exe", unpackSlugCommand, format,
+		strconv.Itoa(strip))
+	cmd.Stdin = slug
+	cmd.Stderr = &stderr
+	cmd.ExtraFiles = []*os.File{d}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{
+			Uid: slugUnpackUID,
+			Gid: slugUnpackUID,
+		},
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("could not unpack slug: %v: %s", err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// releaseLayerGID is the group that libcontainer dynos share release
+// layers through, see ownReleaseLayer: the uid just below theirs, so
+// that it is none of their own groups.
+func releaseLayerGID() int {
+	return dynoMinUID - 1
+}
+
+// releaseLayerKey names the layer of a release after its slug, so that
+// releases with the same slug, e.g. only changing config vars, share
+// it.  Slugs without a checksum are told apart by path and mtime.
+// Layers shared through different groups are told apart too.
+func releaseLayerKey(release *Release, gid int) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%d\n", release.slugChecksum,
+		release.slugFormat, release.slugStrip)
+	if gid >= 0 {
+		fmt.Fprintf(h, "gid %d\n", gid)
+	}
+	if release.slugChecksum == "" {
+		fi, err := os.Stat(release.slugPath)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\n%d\n%d\n", release.slugPath, fi.Size(),
+			fi.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32], nil
+}
+
+// unpackReleaseLayer unpacks the slug of a release into a layer
+// holding its /app, unless that was done for an earlier release
+// already, and returns its directory.  The slug must have been
+// fetched.  The files of the layer belong to hsup and, unless gid is
+// negative, to that group, with the permissions of their owner, see
+// ownReleaseLayer.
+func unpackReleaseLayer(workDir string, release *Release, gid int) (
+	layer string, err error) {
+	key, err := releaseLayerKey(release, gid)
+	if err != nil {
+		return "", err
+	}
+	layers := filepath.Join(workDir, releaseLayersDir)
+	if err := os.MkdirAll(layers, 0755); err != nil {
+		return "", err
+	}
+	layer = filepath.Join(layers, key)
+
+	lock, err := LockFile(layer+".lock", "release "+release.Name())
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if uerr := lock.Unlock(); err == nil {
+			err = uerr
+		}
+	}()
+
+	if _, err := os.Stat(layer); err == nil {
+		return layer, nil
+	}
+
+	log.Printf("Unpacking slug of release %s once for its dynos",
+		release.Name())
+	f, err := os.Open(release.slugPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	tmp := layer + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(tmp, 0700); err != nil {
+		return "", err
+	}
+	app := filepath.Join(tmp, "app")
+	if err := os.Mkdir(app, 0755); err != nil {
+		return "", err
+	}
+	if err := unpackSlugAsNobody(f, release.slugFormat, app,
+		release.slugStrip); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	if err := ownReleaseLayer(app, gid); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	return layer, os.Rename(tmp, layer)
+}
+
+// ownReleaseLayer hands the files of an unpacked slug over to hsup
+// and, unless gid is negative, to a group, giving it the permissions
+// of their owner, so that dynos in that group can write to them
+// through an overlay: files copied up keep their owner and mode.
+// Set-user-ID and set-group-ID bits are dropped.
+func ownReleaseLayer(app string, gid int) error {
+	group := gid
+	if group < 0 {
+		group = os.Getgid()
+	}
+	return filepath.Walk(app, func(path string, fi os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		if err := os.Lchown(path, os.Getuid(), group); err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		mode := fi.Mode() & (os.ModePerm | os.ModeSticky)
+		if gid >= 0 {
+			mode |= (mode & 0700) >> 3
+		}
+		return os.Chmod(path, mode)
+	})
+}
+
+// useReleaseLayer records that the dyno with the given data directory
+// runs the release layer, with its lock held so that the layer can't
+// be garbage collected meanwhile.
+func useReleaseLayer(layer, dataPath string) (err error) {
+	lock, err := LockFile(layer+".lock", "release layer "+
+		filepath.Base(layer))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if uerr := lock.Unlock(); err == nil {
+			err = uerr
+		}
+	}()
+
+	if _, err := os.Stat(layer); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dataPath, releaseLayerUseFile),
+		[]byte(layer), 0644)
+}
+
+// GCReleaseLayers deletes the release layers in a libcontainer work
+// directory that no dyno runs and that were not unpacked recently.
+// It returns the names of the layers removed.
+func GCReleaseLayers(workDir string) ([]string, error) {
+	var (
+		layersDir     = filepath.Join(workDir, releaseLayersDir)
+		containersDir = filepath.Join(workDir, "containers")
+	)
+
+	entries, err := ioutil.ReadDir(layersDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, fi := range entries {
+		if !fi.IsDir() || time.Since(fi.ModTime()) < releaseLayerGCAge {
+			continue
+		}
+		layer := filepath.Join(layersDir, fi.Name())
+		ok, err := removeReleaseLayer(layer, containersDir)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed = append(removed, fi.Name())
+		}
+	}
+	return removed, nil
+}
+
+// removeReleaseLayer deletes the release layer unless a dyno runs it,
+// and reports whether it did.
+func removeReleaseLayer(layer, containersDir string) (removed bool,
+	err error) {
+	lock, err := LockFile(layer+".lock", "release layer "+
+		filepath.Base(layer))
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if uerr := lock.Unlock(); err == nil {
+			err = uerr
+		}
+	}()
+
+	uses, err := filepath.Glob(filepath.Join(containersDir, "*",
+		releaseLayerUseFile))
+	if err != nil {
+		return false, err
+	}
+	for _, use := range uses {
+		if inUse, _ := ioutil.ReadFile(use); string(inUse) == layer {
+			return false, nil
+		}
+	}
+
+	log.Printf("Removing release layer %q", layer)
+	return true, os.RemoveAll(layer)
+}
+
+// readOnlyAppConfig mounts the /app of the release layer read-only in
+// place of the writable /app of a dyno.
+func readOnlyAppConfig(config *configs.Config, layer string) {
+	for _, m := range config.Mounts {
+		if m.Destination == "/app" {
+			m.Source = filepath.Join(layer, "app")
+			m.Flags |= syscall.MS_RDONLY
+		}
+	}
+}
+
+// overlayConfig adapts the container configuration of a dyno to an
+// overlay root file system: it is writable, /app included.
+func overlayConfig(config *configs.Config) {
+	config.Readonlyfs = false
+	mounts := config.Mounts[:0]
+	for _, m := range config.Mounts {
+		if m.Destination != "/app" {
+			mounts = append(mounts, m)
+		}
+	}
+	config.Mounts = mounts
+}
+
+// overlayMountData returns the options of an overlay mount, the first
+// of the lower directories being the topmost.
+func overlayMountData(lower []string, upper, work string) string {
+	return fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
+		strings.Join(lower, ":"), upper, work)
+}
+
+func mountOverlay(lower []string, target, upper, work string) error {
+	for _, dir := range []string{upper, work} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return syscall.Mount(
+		"overlay", target, "overlay", 0,
+		overlayMountData(lower, upper, work),
+	)
+}
+
+// builtPaths returns the stack image and release layer that Build
+// made for a release, building it again first if either was garbage
+// collected since, e.g. for dynos restarted long after it was built.
+// mu serializes this between the dynos of a driver.
+func builtPaths(dd DynoDriver, mu *sync.Mutex, release *Release) (
+	stackImage, slugLayer string, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, path := range []string{release.stackImage, release.slugLayer} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			log.Printf("%s was garbage collected, building "+
+				"release %s again", path, release.Name())
+			if err := dd.Build(release); err != nil {
+				return "", "", err
+			}
+			break
+		}
+	}
+	return release.stackImage, release.slugLayer, nil
+}
+
+// mountAppOverlay mounts a writable overlay of the /app of the release
+// layer onto the /app of a dyno, in dataPath.
+func mountAppOverlay(layer, dataPath string, uid int) error {
+	app := filepath.Join(dataPath, "app")
+	if err := mountOverlay(
+		[]string{filepath.Join(layer, "app")}, app,
+		filepath.Join(dataPath, "app-upper"),
+		filepath.Join(dataPath, "app-work"),
+	); err != nil {
+		return err
+	}
+	return os.Chown(app, uid, uid)
+}
+
+// mountOverlayRootFS mounts the root file system of a dyno onto
+// rootFSPath, with its upper directory in dataPath.  The dyno user
+// owns /app, as with DynoRootFSBind.
+func mountOverlayRootFS(lower []string, dataPath, rootFSPath string,
+	uid int) error {
+	if err := mountOverlay(
+		lower, rootFSPath,
+		filepath.Join(dataPath, "upper"),
+		filepath.Join(dataPath, "work"),
+	); err != nil {
+		return err
+	}
+
+	app := filepath.Join(rootFSPath, "app")
+	if err := os.MkdirAll(app, 0755); err != nil {
+		return err
+	}
+	return os.Chown(app, uid, uid)
+}
@@ -0,0 +1,236 @@
+// +build linux
+
+package hsup
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestUnpackReleaseLayerOnce(t *testing.T) {
+	work := newTmpDb(t)
+	defer os.RemoveAll(work)
+
+	slug := makeTarGz(t, testSlugEntries)
+	release := &Release{
+		appName:      "myapp",
+		slugURL:      filepath.Join(work, "slug.tgz"),
+		slugPath:     filepath.Join(work, "slug.tgz"),
+		slugChecksum: sha256Checksum(slug),
+		slugFormat:   SlugFormatTgz,
+		slugStrip:    SlugStripComponents,
+	}
+	if err := ioutil.WriteFile(release.slugPath, slug, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	layer, err := unpackReleaseLayer(work, release, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestSlug(t, filepath.Join(layer, "app"))
+
+	// Another release of the same slug, e.g. with new config vars.
+	marker := filepath.Join(layer, "app", "marker")
+	ioutil.WriteFile(marker, nil, 0644)
+	next := *release
+	next.version = 2
+	again, err := unpackReleaseLayer(work, &next, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != layer {
+		t.Fatalf("expected layer %q to be shared, got %q", layer, again)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Fatal("expected the slug not to be unpacked again")
+	}
+}
+
+func TestUnpackReleaseLayerFails(t *testing.T) {
+	work := newTmpDb(t)
+	defer os.RemoveAll(work)
+
+	slug := makeTarGz(t, []tarEntry{
+		{hdr: tar.Header{Name: "./app/escape",
+			Typeflag: tar.TypeSymlink, Linkname: work}},
+		{hdr: tar.Header{Name: "./app/escape/evil",
+			Typeflag: tar.TypeReg, Mode: 0644}},
+	})
+	release := &Release{
+		appName:      "myapp",
+		slugURL:      filepath.Join(work, "slug.tgz"),
+		slugPath:     filepath.Join(work, "slug.tgz"),
+		slugChecksum: sha256Checksum(slug),
+		slugFormat:   SlugFormatTgz,
+		slugStrip:    SlugStripComponents,
+	}
+	if err := ioutil.WriteFile(release.slugPath, slug, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := unpackReleaseLayer(work, release, -1); err == nil {
+		t.Fatal("expected a slug escaping its layer to be rejected")
+	}
+	if _, err := os.Stat(filepath.Join(work, "evil")); err == nil {
+		t.Fatal("expected nothing to be written outside of the layer")
+	}
+	matches, _ := filepath.Glob(filepath.Join(work, releaseLayersDir,
+		"*.tmp"))
+	if len(matches) != 0 {
+		t.Fatalf("expected the partial layer to be removed, got %q",
+			matches)
+	}
+}
+
+func TestUnpackSharedReleaseLayer(t *testing.T) {
+	work := newTmpDb(t)
+	defer os.RemoveAll(work)
+
+	slug := makeTarGz(t, testSlugEntries)
+	release := &Release{
+		appName:      "myapp",
+		slugURL:      filepath.Join(work, "slug.tgz"),
+		slugPath:     filepath.Join(work, "slug.tgz"),
+		slugChecksum: sha256Checksum(slug),
+		slugFormat:   SlugFormatTgz,
+		slugStrip:    SlugStripComponents,
+	}
+	if err := ioutil.WriteFile(release.slugPath, slug, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	private, err := unpackReleaseLayer(work, release, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := unpackReleaseLayer(work, release, 2999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layer == private {
+		t.Fatal("expected layers shared through a group to be apart")
+	}
+
+	fi, err := os.Stat(filepath.Join(layer, "app", "bin", "web"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid := fi.Sys().(*syscall.Stat_t).Uid; int(uid) != os.Getuid() {
+		t.Fatalf("expected the slug to belong to hsup, got uid %d",
+			uid)
+	}
+	if gid := fi.Sys().(*syscall.Stat_t).Gid; gid != 2999 {
+		t.Fatalf("expected group 2999, got %d", gid)
+	}
+	if mode := fi.Mode().Perm(); mode != 0770 {
+		t.Fatalf("expected the group to write to the slug, got %v",
+			mode)
+	}
+}
+
+func TestBuiltPathsBuildsCollectedReleases(t *testing.T) {
+	work := newTmpDb(t)
+	defer os.RemoveAll(work)
+
+	var (
+		dd FakeDynoDriver
+		mu sync.Mutex
+	)
+	release := &Release{appName: "myapp", stackImage: work}
+	if _, _, err := builtPaths(&dd, &mu, release); err != nil {
+		t.Fatal(err)
+	}
+	if events := dd.Events(); len(events) != 0 {
+		t.Fatalf("unexpected build of a built release: %v", events)
+	}
+
+	release.slugLayer = filepath.Join(work, "collected")
+	if _, _, err := builtPaths(&dd, &mu, release); err != nil {
+		t.Fatal(err)
+	}
+	events := dd.Events()
+	if len(events) != 1 || events[0].Action != FakeBuild {
+		t.Fatalf("expected the release to be built again, got %v",
+			events)
+	}
+}
+
+func TestOverlayConfig(t *testing.T) {
+	config := containerConfig("some-uuid", "/data", "", nil)
+	overlayConfig(config)
+
+	if config.Readonlyfs {
+		t.Fatal("expected a writable root file system")
+	}
+	for _, m := range config.Mounts {
+		if m.Destination == "/app" {
+			t.Fatal("expected /app to come from the overlay")
+		}
+	}
+
+	data := overlayMountData([]string{"/layer", "/stack"}, "/data/upper",
+		"/data/work")
+	expected := "lowerdir=/layer:/stack,upperdir=/data/upper," +
+		"workdir=/data/work"
+	if data != expected {
+		t.Fatalf("expected %q, got %q", expected, data)
+	}
+}
+
+func TestReadOnlyAppConfig(t *testing.T) {
+	config := containerConfig("some-uuid", "/data", "", nil)
+	readOnlyAppConfig(config, "/layer")
+
+	for _, m := range config.Mounts {
+		if m.Destination != "/app" {
+			continue
+		}
+		if m.Source != "/layer/app" || m.Flags&syscall.MS_RDONLY == 0 {
+			t.Fatalf("expected a read-only /app from the layer, "+
+				"got %+v", m)
+		}
+		return
+	}
+	t.Fatal("expected an /app mount")
+}
+
+func TestGCReleaseLayers(t *testing.T) {
+	work := newTmpDb(t)
+	defer os.RemoveAll(work)
+	layers := filepath.Join(work, releaseLayersDir)
+	dyno := filepath.Join(work, "containers", "some-uuid")
+	os.MkdirAll(dyno, 0755)
+
+	old := time.Now().Add(-2 * releaseLayerGCAge)
+	for _, name := range []string{"unused", "used", "recent"} {
+		os.MkdirAll(filepath.Join(layers, name, "app"), 0755)
+		if name != "recent" {
+			os.Chtimes(filepath.Join(layers, name), old, old)
+		}
+	}
+	err := useReleaseLayer(filepath.Join(layers, "used"), dyno)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := GCReleaseLayers(work)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(removed, []string{"unused"}) {
+		t.Fatalf("unexpected removed release layers %v", removed)
+	}
+	for _, name := range []string{"used", "recent"} {
+		if _, err := os.Stat(filepath.Join(layers, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
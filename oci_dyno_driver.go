@@ -0,0 +1,213 @@
+// +build linux
+
+package hsup
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/opencontainers/runc/libcontainer/configs"
+	"github.com/opencontainers/runc/libcontainer/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// DefaultOCIRuntime is the OCI runtime dynos run with, unless
+// OCI_RUNTIME names another one, such as crun.
+const DefaultOCIRuntime = "runc"
+
+// OCIDynoDriver runs dynos in the same sandboxes as the libcontainer
+// driver, with the same mounts, namespaces and capabilities, but
+// through the command line of an OCI runtime rather than the
+// libcontainer library hsup is built with.  Every dyno gets an OCI
+// bundle in its data directory.
+type OCIDynoDriver struct {
+	*LibContainerDynoDriver
+
+	runtime *ociRuntime
+}
+
+func NewOCIDynoDriver(workDir string) (*OCIDynoDriver, error) {
+	runtime, err := newOCIRuntime(workDir)
+	if err != nil {
+		return nil, err
+	}
+	lc, err := NewLibContainerDynoDriver(workDir)
+	if err != nil {
+		return nil, err
+	}
+	return &OCIDynoDriver{LibContainerDynoDriver: lc, runtime: runtime}, nil
+}
+
+// ociRuntime is the OCI runtime binary at Path, keeping the state of
+// the containers of dynos in StateDir.
+type ociRuntime struct {
+	Path     string
+	StateDir string
+}
+
+// newOCIRuntime looks up OCI_RUNTIME, or DefaultOCIRuntime, keeping its
+// state in the work directory of a driver.
+func newOCIRuntime(workDir string) (*ociRuntime, error) {
+	name := os.Getenv("OCI_RUNTIME")
+	if name == "" {
+		name = DefaultOCIRuntime
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not find OCI runtime %q: %v",
+			name, err)
+	}
+	return &ociRuntime{Path: path, StateDir: filepath.Join(workDir, "oci")}, nil
+}
+
+// command runs a command of the OCI runtime.
+func (r *ociRuntime) command(args ...string) *exec.Cmd {
+	return exec.Command(r.Path,
+		append([]string{"--root", r.StateDir}, args...)...)
+}
+
+// kill sends a signal, e.g. "TERM", to the init process of a container.
+func (r *ociRuntime) kill(id, signal string) error {
+	out, err := r.command("kill", id, signal).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("could not signal container %s: %v: %s",
+			id, err, out)
+	}
+	return nil
+}
+
+// delete removes a container, killing its processes if it still runs,
+// logging failures.
+func (r *ociRuntime) delete(id string) {
+	out, err := r.command("delete", "--force", id).CombinedOutput()
+	if err != nil {
+		log.Printf("could not delete container %s: %v: %s", id, err,
+			out)
+	}
+}
+
+// ociExitStatus returns the exit status of the OCI runtime running a
+// container in the foreground, which is that of its init process.
+func ociExitStatus(err error) *ExitStatus {
+	s := &ExitStatus{}
+	if err != nil {
+		if eErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := eErr.Sys().(syscall.WaitStatus); ok {
+				s.Code = status.ExitStatus()
+			}
+		} else {
+			s.Err = err
+		}
+	}
+	return s
+}
+
+func (dd *OCIDynoDriver) Start(ex *Executor) (err error) {
+	ex.initExitStatus = make(chan *ExitStatus)
+
+	sb, err := dd.newSandbox(ex)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			dd.destroySandbox(sb)
+		}
+	}()
+
+	// OCI runtimes leave the network namespace as they find it.
+	if err := setupOCINetwork(sb.config); err != nil {
+		return err
+	}
+
+	// Init (PID=1) hsup process with the abspath driver
+	bundle := filepath.Join(sb.dataPath, "bundle")
+	spec := newOCISpec(sb.config, ociProcess{
+		User: ociUser{UID: uint32(sb.uid), GID: uint32(sb.uid)},
+		Args: []string{hsupInitPath},
+		Env:  []string{"HSUP_CONTROL_FILE=" + ControlFileInContainer},
+		Cwd:  "/app",
+	})
+	if err := writeOCIBundle(bundle, spec); err != nil {
+		return err
+	}
+
+	// The runtime stays in the foreground until the container exits,
+	// removing it then.
+	cmd := dd.runtime.command("run", "--bundle", bundle, sb.uuid)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	ex.ociContainer = sb.uuid
+
+	go func() {
+		s := ociExitStatus(cmd.Wait())
+		dd.destroySandbox(sb)
+
+		ex.initExitStatus <- s
+		close(ex.initExitStatus)
+	}()
+	return nil
+}
+
+func (dd *OCIDynoDriver) Stop(ex *Executor) error {
+	// tell the abspath-driver to stop
+	return dd.runtime.kill(ex.ociContainer, "TERM")
+}
+
+// setupOCINetwork does in the network namespace of a dyno what
+// libcontainer does from within its container: bring its loopback
+// interface up and add its routes.
+func setupOCINetwork(config *configs.Config) error {
+	var path string
+	for _, ns := range config.Namespaces {
+		if ns.Type == configs.NEWNET {
+			path = ns.Path
+		}
+	}
+	if path == "" {
+		return nil
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		return err
+	}
+	defer origin.Close()
+	dyno, err := netns.GetFromPath(path)
+	if err != nil {
+		return err
+	}
+	defer dyno.Close()
+
+	if err := netns.Set(dyno); err != nil {
+		return err
+	}
+	defer netns.Set(origin)
+
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		return err
+	}
+	if err := netlink.NetworkLinkUp(lo); err != nil {
+		return err
+	}
+	for _, r := range config.Routes {
+		if err := netlink.AddRoute(r.Destination, r.Source, r.Gateway,
+			r.InterfaceName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
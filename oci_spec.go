@@ -0,0 +1,221 @@
+// +build linux
+
+package hsup
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/opencontainers/runc/libcontainer/configs"
+)
+
+// ociVersion is the version of the OCI runtime specification bundles
+// are written for.
+const ociVersion = "1.0.2"
+
+// ociSpec is the configuration of an OCI bundle, config.json, limited
+// to what dynos use.
+type ociSpec struct {
+	Version  string     `json:"ociVersion"`
+	Process  ociProcess `json:"process"`
+	Root     ociRoot    `json:"root"`
+	Hostname string     `json:"hostname,omitempty"`
+	Mounts   []ociMount `json:"mounts"`
+	Linux    ociLinux   `json:"linux"`
+}
+
+type ociProcess struct {
+	Terminal     bool            `json:"terminal"`
+	User         ociUser         `json:"user"`
+	Args         []string        `json:"args"`
+	Env          []string        `json:"env,omitempty"`
+	Cwd          string          `json:"cwd"`
+	Capabilities ociCapabilities `json:"capabilities"`
+}
+
+type ociUser struct {
+	UID            uint32   `json:"uid"`
+	GID            uint32   `json:"gid"`
+	AdditionalGids []uint32 `json:"additionalGids,omitempty"`
+}
+
+type ociCapabilities struct {
+	Bounding    []string `json:"bounding"`
+	Effective   []string `json:"effective"`
+	Inheritable []string `json:"inheritable"`
+	Permitted   []string `json:"permitted"`
+}
+
+type ociRoot struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly,omitempty"`
+}
+
+type ociMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Source      string   `json:"source"`
+	Options     []string `json:"options,omitempty"`
+}
+
+type ociLinux struct {
+	Namespaces    []ociNamespace `json:"namespaces"`
+	UIDMappings   []ociIDMapping `json:"uidMappings,omitempty"`
+	GIDMappings   []ociIDMapping `json:"gidMappings,omitempty"`
+	Resources     *ociResources  `json:"resources,omitempty"`
+	MaskedPaths   []string       `json:"maskedPaths,omitempty"`
+	ReadonlyPaths []string       `json:"readonlyPaths,omitempty"`
+}
+
+// ociIDMapping maps the IDs of a user namespace, from ContainerID, to
+// those of the host, from HostID.
+type ociIDMapping struct {
+	ContainerID uint32 `json:"containerID"`
+	HostID      uint32 `json:"hostID"`
+	Size        uint32 `json:"size"`
+}
+
+type ociNamespace struct {
+	Type string `json:"type"`
+	Path string `json:"path,omitempty"`
+}
+
+type ociResources struct {
+	Devices []ociDeviceCgroup `json:"devices"`
+}
+
+type ociDeviceCgroup struct {
+	Allow  bool   `json:"allow"`
+	Type   string `json:"type,omitempty"`
+	Major  *int64 `json:"major,omitempty"`
+	Minor  *int64 `json:"minor,omitempty"`
+	Access string `json:"access"`
+}
+
+var ociNamespaceTypes = map[configs.NamespaceType]string{
+	configs.NEWPID:  "pid",
+	configs.NEWNS:   "mount",
+	configs.NEWUTS:  "uts",
+	configs.NEWIPC:  "ipc",
+	configs.NEWNET:  "network",
+	configs.NEWUSER: "user",
+}
+
+var ociMountFlags = []struct {
+	flag   int
+	option string
+}{
+	{syscall.MS_RDONLY, "ro"},
+	{syscall.MS_NOSUID, "nosuid"},
+	{syscall.MS_NODEV, "nodev"},
+	{syscall.MS_NOEXEC, "noexec"},
+	{syscall.MS_STRICTATIME, "strictatime"},
+	{syscall.MS_BIND, "bind"},
+}
+
+// newOCISpec translates the container configuration of a dyno, as
+// built by containerConfig, into an OCI runtime specification running
+// process, in the additional groups of the configuration, by gid.  The
+// devices the configuration creates are those OCI runtimes create by
+// default.
+func newOCISpec(config *configs.Config, process ociProcess) *ociSpec {
+	for _, group := range config.AdditionalGroups {
+		if gid, err := strconv.ParseUint(group, 10, 32); err == nil {
+			process.User.AdditionalGids = append(
+				process.User.AdditionalGids, uint32(gid))
+		}
+	}
+
+	caps := make([]string, len(config.Capabilities))
+	for i, c := range config.Capabilities {
+		caps[i] = "CAP_" + c
+	}
+	process.Capabilities = ociCapabilities{
+		Bounding:    caps,
+		Effective:   caps,
+		Inheritable: caps,
+		Permitted:   caps,
+	}
+
+	spec := &ociSpec{
+		Version:  ociVersion,
+		Process:  process,
+		Root:     ociRoot{Path: config.Rootfs, Readonly: config.Readonlyfs},
+		Hostname: config.Hostname,
+		Linux: ociLinux{
+			MaskedPaths:   config.MaskPaths,
+			ReadonlyPaths: config.ReadonlyPaths,
+		},
+	}
+
+	for _, m := range config.Mounts {
+		spec.Mounts = append(spec.Mounts, ociMountFor(m))
+	}
+	for _, ns := range config.Namespaces {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces,
+			ociNamespace{Type: ociNamespaceTypes[ns.Type], Path: ns.Path})
+	}
+
+	// Deny every device but those allowed.
+	devices := []ociDeviceCgroup{{Allow: false, Access: "rwm"}}
+	if config.Cgroups != nil {
+		for _, d := range config.Cgroups.AllowedDevices {
+			devices = append(devices, ociDeviceCgroupFor(d))
+		}
+	}
+	spec.Linux.Resources = &ociResources{Devices: devices}
+	return spec
+}
+
+func ociMountFor(m *configs.Mount) ociMount {
+	om := ociMount{
+		Destination: m.Destination,
+		Type:        m.Device,
+		Source:      m.Source,
+	}
+	for _, f := range ociMountFlags {
+		if m.Flags&f.flag != 0 {
+			om.Options = append(om.Options, f.option)
+		}
+	}
+	if m.Data != "" {
+		om.Options = append(om.Options, strings.Split(m.Data, ",")...)
+	}
+	return om
+}
+
+func ociDeviceCgroupFor(d *configs.Device) ociDeviceCgroup {
+	dc := ociDeviceCgroup{
+		Allow:  true,
+		Type:   string(d.Type),
+		Access: d.Permissions,
+	}
+	if d.Major != configs.Wildcard {
+		major := d.Major
+		dc.Major = &major
+	}
+	if d.Minor != configs.Wildcard {
+		minor := d.Minor
+		dc.Minor = &minor
+	}
+	return dc
+}
+
+// writeOCIBundle writes the configuration of an OCI bundle into its
+// directory.  Its root file system is referred to by absolute path.
+func writeOCIBundle(bundle string, spec *ociSpec) error {
+	if err := os.MkdirAll(bundle, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(bundle, "config.json"),
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(spec)
+}
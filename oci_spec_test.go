@@ -0,0 +1,127 @@
+// +build linux
+
+package hsup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOCISpecFromContainerConfig(t *testing.T) {
+	config := containerConfig("some-uuid", "/data", "/var/run/netns/x", nil)
+	config.AdditionalGroups = []string{"2999"}
+	spec := newOCISpec(config, ociProcess{
+		User: ociUser{UID: 3000, GID: 3000},
+		Args: []string{hsupInitPath},
+		Cwd:  "/app",
+	})
+
+	if spec.Root.Path != "/data/root" || !spec.Root.Readonly ||
+		spec.Hostname != "some-uuid" {
+		t.Fatalf("unexpected root %+v of %q", spec.Root, spec.Hostname)
+	}
+	if gids := spec.Process.User.AdditionalGids; !reflect.DeepEqual(
+		gids, []uint32{2999}) {
+		t.Fatalf("expected additional gid 2999, got %v", gids)
+	}
+	if len(spec.Mounts) != len(config.Mounts) {
+		t.Fatalf("expected %d mounts, got %d", len(config.Mounts),
+			len(spec.Mounts))
+	}
+	for _, m := range spec.Mounts {
+		if m.Destination != "/etc/passwd" {
+			continue
+		}
+		expected := ociMount{
+			Destination: "/etc/passwd",
+			Type:        "bind",
+			Source:      "/data/passwd",
+			Options:     []string{"ro", "nosuid", "bind"},
+		}
+		if !reflect.DeepEqual(m, expected) {
+			t.Fatalf("expected %+v, got %+v", expected, m)
+		}
+	}
+
+	var netNS string
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Type == "network" {
+			netNS = ns.Path
+		}
+	}
+	if netNS != "/var/run/netns/x" || len(spec.Linux.Namespaces) != 5 {
+		t.Fatalf("unexpected namespaces %+v", spec.Linux.Namespaces)
+	}
+
+	caps := spec.Process.Capabilities
+	if len(caps.Bounding) != len(config.Capabilities) ||
+		caps.Bounding[0] != "CAP_CHOWN" ||
+		!reflect.DeepEqual(caps.Bounding, caps.Effective) {
+		t.Fatalf("unexpected capabilities %+v", caps)
+	}
+
+	devices := spec.Linux.Resources.Devices
+	if len(devices) < 2 || devices[0].Allow || !devices[1].Allow {
+		t.Fatalf("expected devices to be denied but those allowed, "+
+			"got %+v", devices)
+	}
+}
+
+func TestWriteOCIBundle(t *testing.T) {
+	dir := newTmpDb(t)
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "bundle")
+
+	config := containerConfig("some-uuid", "/data", "", nil)
+	if err := writeOCIBundle(bundle, newOCISpec(config, ociProcess{
+		Args: []string{hsupInitPath},
+		Cwd:  "/app",
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec map[string]interface{}
+	if err := json.Unmarshal(contents, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec["ociVersion"] != ociVersion {
+		t.Fatalf("unexpected bundle configuration %s", contents)
+	}
+}
+
+func TestOCIDynoDriverCommand(t *testing.T) {
+	dir := newTmpDb(t)
+	defer os.RemoveAll(dir)
+
+	// A runtime that records its arguments.
+	runtime := filepath.Join(dir, "runtime")
+	args := filepath.Join(dir, "args")
+	err := ioutil.WriteFile(runtime,
+		[]byte("#!/bin/sh\necho \"$@\" > "+args+"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dd := &OCIDynoDriver{
+		runtime: &ociRuntime{Path: runtime, StateDir: "/state"},
+	}
+	if err := dd.Stop(&Executor{ociContainer: "some-uuid"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "--root /state kill some-uuid TERM"; strings.TrimSpace(string(got)) != expected {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 
@@ -26,6 +27,20 @@ type Processes struct {
 	OneShot    bool
 	Executors  []*Executor
 	LogplexURL *url.URL
+
+	// Removed is set when the application is no longer to be
+	// supervised, e.g. because its control directory was removed:
+	// its processes are to be stopped, and nothing started.
+	Removed bool
+}
+
+// AppName returns the name of the application the processes belong
+// to, or "" if it is not known.
+func (p *Processes) AppName() string {
+	if p.Rel == nil {
+		return ""
+	}
+	return p.Rel.appName
 }
 
 type Formation interface {
@@ -73,6 +88,18 @@ func copyFile(src, dst string, mode os.FileMode) (err error) {
 	return nil
 }
 
+// chownTree changes the owner of everything below dir, without
+// following symbolic links.
+func chownTree(dir string, uid, gid int) error {
+	return filepath.Walk(dir, func(path string, fi os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
+
 type combinedError []error
 
 // combine needs to return error, not a combinedError, otherwise nil errors
@@ -0,0 +1,163 @@
+package hsup
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var procfileLineRe = regexp.MustCompile(`^([A-Za-z0-9_-]+):\s*(.+)$`)
+
+// ProcfilePoller watches an application directory for a Procfile and
+// an optional .env file, the way foreman does, and emits new
+// processes whenever either of them changes.  The directory itself is
+// used as the slug, so that drivers running from local code, like the
+// simple driver, run processes from within it.
+type ProcfilePoller struct {
+	Dir string
+	Hs  *Startup
+
+	version  int
+	procfile []byte
+	env      []byte
+}
+
+func (pp *ProcfilePoller) Notify() <-chan *Processes {
+	out := make(chan *Processes)
+	go pp.pollSynchronous(out)
+	return out
+}
+
+func (pp *ProcfilePoller) pollSynchronous(out chan<- *Processes) {
+	for {
+		procs, err := pp.pollOnce()
+		if err != nil {
+			log.Println("Could not load Procfile:", err)
+		} else if procs != nil {
+			out <- procs
+		}
+
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func (pp *ProcfilePoller) pollOnce() (*Processes, error) {
+	procfile, err := ioutil.ReadFile(filepath.Join(pp.Dir, "Procfile"))
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := ioutil.ReadFile(filepath.Join(pp.Dir, ".env"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if pp.version > 0 && bytes.Equal(procfile, pp.procfile) &&
+		bytes.Equal(env, pp.env) {
+		return nil, nil
+	}
+
+	// Remember the contents even if they turn out to be invalid,
+	// so the same problem is only reported once.
+	pp.procfile, pp.env = procfile, env
+	pp.version++
+
+	dir, err := filepath.Abs(pp.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	hs := Startup{
+		App: AppSerializable{
+			Version: pp.version,
+			Name:    filepath.Base(dir),
+			Slug:    dir,
+		},
+		Driver:  pp.Hs.Driver,
+		OneShot: pp.Hs.OneShot,
+	}
+	if hs.App.Processes, err = parseProcfile(procfile); err != nil {
+		return nil, err
+	}
+	if hs.App.Env, err = parseDotEnv(env); err != nil {
+		return nil, err
+	}
+	if err := hs.App.Validate(pp.Hs.Action, pp.Hs.Driver); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Procfile or .env changed, loading version %d",
+		pp.version)
+	return hs.Procs(), nil
+}
+
+// parseProcfile reads "type: command" lines, skipping blank lines and
+// comments.  Every process type is given a quantity of one.
+func parseProcfile(contents []byte) ([]FormationSerializable, error) {
+	var forms []FormationSerializable
+
+	s := bufio.NewScanner(bytes.NewReader(contents))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		m := procfileLineRe.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("Procfile line %d: expected "+
+				"\"type: command\", got %q", n, line)
+		}
+
+		forms = append(forms, FormationSerializable{
+			FArgs:     []string{m[2]},
+			FQuantity: 1,
+			FType:     m[1],
+		})
+	}
+
+	return forms, s.Err()
+}
+
+// parseDotEnv reads "NAME=value" lines as written for foreman,
+// optionally prefixed with "export" and with the value optionally
+// quoted.  Double quoted values may contain "\n" escapes.
+func parseDotEnv(contents []byte) (map[string]string, error) {
+	env := make(map[string]string)
+
+	s := bufio.NewScanner(bytes.NewReader(contents))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf(".env line %d: expected "+
+				"\"NAME=value\", got %q", n, line)
+		}
+
+		name, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if len(value) >= 2 {
+			switch {
+			case value[0] == '\'' && value[len(value)-1] == '\'':
+				value = value[1 : len(value)-1]
+			case value[0] == '"' && value[len(value)-1] == '"':
+				value = strings.Replace(value[1:len(value)-1],
+					`\n`, "\n", -1)
+			}
+		}
+		env[name] = value
+	}
+
+	return env, s.Err()
+}
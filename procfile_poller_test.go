@@ -0,0 +1,95 @@
+package hsup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseProcfile(t *testing.T) {
+	forms, err := parseProcfile([]byte(`
+# comment
+web: bundle exec puma -p $PORT
+worker:bundle exec sidekiq
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []FormationSerializable{
+		{FArgs: []string{"bundle exec puma -p $PORT"}, FQuantity: 1, FType: "web"},
+		{FArgs: []string{"bundle exec sidekiq"}, FQuantity: 1, FType: "worker"},
+	}
+	if !reflect.DeepEqual(forms, expect) {
+		t.Fatalf("\nExpect %+v\nResult %+v", expect, forms)
+	}
+
+	if _, err := parseProcfile([]byte("web bundle exec puma\n")); err == nil {
+		t.Fatal("expected a line without a type to be an error")
+	}
+}
+
+func TestParseDotEnv(t *testing.T) {
+	env, err := parseDotEnv([]byte(`
+# comment
+PORT=5100
+export LANG=en_US.UTF-8
+QUOTED='single $quoted'
+MULTI="two\nlines"
+EMPTY=
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]string{
+		"PORT":   "5100",
+		"LANG":   "en_US.UTF-8",
+		"QUOTED": "single $quoted",
+		"MULTI":  "two\nlines",
+		"EMPTY":  "",
+	}
+	if !reflect.DeepEqual(env, expect) {
+		t.Fatalf("\nExpect %+v\nResult %+v", expect, env)
+	}
+}
+
+func TestProcfilePollerReloadsOnChange(t *testing.T) {
+	name := newTmpDb(t)
+	defer os.RemoveAll(name)
+
+	pp := &ProcfilePoller{
+		Dir: name,
+		Hs:  &Startup{Action: Start, Driver: &SimpleDynoDriver{}},
+	}
+
+	if _, err := pp.pollOnce(); err == nil {
+		t.Fatal("expected a missing Procfile to be an error")
+	}
+
+	ioutil.WriteFile(filepath.Join(name, "Procfile"),
+		[]byte("web: ./server\n"), 0644)
+	procs, err := pp.pollOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if procs == nil || len(procs.Forms) != 1 || procs.Rel.slugURL != name {
+		t.Fatalf("expected the web process, got %+v", procs)
+	}
+
+	if procs, err = pp.pollOnce(); procs != nil || err != nil {
+		t.Fatalf("expected no change, got %+v, %v", procs, err)
+	}
+
+	ioutil.WriteFile(filepath.Join(name, ".env"), []byte("FOO=bar\n"), 0644)
+	procs, err = pp.pollOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if procs == nil || procs.Rel.config["FOO"] != "bar" ||
+		procs.Rel.version != 2 {
+		t.Fatalf("expected a new version with FOO set, got %+v", procs)
+	}
+}
@@ -0,0 +1,78 @@
+package hsup
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+)
+
+// ReleaseProcessType is the process type of the release phase command,
+// which is run once per release after it is built and before any of
+// its other processes are started.
+const ReleaseProcessType = "release"
+
+// ReleasePhaseError is returned when the release phase command of a
+// release could not be run or exited unsuccessfully.  The release is
+// not to be rolled out.
+type ReleasePhaseError struct {
+	Release string
+	Status  *ExitStatus
+}
+
+func (e *ReleasePhaseError) Error() string {
+	switch {
+	case e.Status == nil:
+		return fmt.Sprintf("release phase of %s could not be started",
+			e.Release)
+	case e.Status.Err != nil:
+		return fmt.Sprintf("release phase of %s failed: %v",
+			e.Release, e.Status.Err)
+	default:
+		return fmt.Sprintf("release phase of %s exited with code %d",
+			e.Release, e.Status.Code)
+	}
+}
+
+// ReleaseFormation returns the release phase formation of the
+// processes, or nil if there is none.
+func (p *Processes) ReleaseFormation() Formation {
+	for _, form := range p.Forms {
+		if form.Type() == ReleaseProcessType {
+			return form
+		}
+	}
+	return nil
+}
+
+// RunReleasePhase runs the release phase command, if any, as a one-off
+// process and waits for it to exit.  A *ReleasePhaseError is returned
+// unless it exits with code zero.
+func (p *Processes) RunReleasePhase(processID int, logplexURL *url.URL,
+	binds map[string]string) error {
+	form := p.ReleaseFormation()
+	if form == nil {
+		return nil
+	}
+
+	ex := &Executor{
+		Args:        form.Args(),
+		DynoDriver:  p.Dd,
+		ProcessID:   processID,
+		ProcessType: ReleaseProcessType,
+		Release:     p.Rel,
+		Complete:    make(chan struct{}),
+		State:       Stopped,
+		OneShot:     true,
+		Status:      make(chan *ExitStatus),
+		NewInput:    make(chan DynoInput),
+		LogplexURL:  logplexURL,
+		Binds:       binds,
+	}
+
+	log.Printf("running release phase of %s", p.Rel.Name())
+	s := runOneShot(ex)
+	if s == nil || s.Err != nil || s.Code != 0 {
+		return &ReleasePhaseError{Release: p.Rel.Name(), Status: s}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package hsup
+
+import (
+	"testing"
+)
+
+func releasePhaseProcs(command string) *Processes {
+	hs := Startup{
+		App: AppSerializable{
+			Version: 1,
+			Name:    "sushi",
+			Processes: []FormationSerializable{
+				{FArgs: []string{"./web"}, FQuantity: 1, FType: "web"},
+				{FArgs: []string{command}, FQuantity: 1, FType: "release"},
+			},
+		},
+		Driver: &SimpleDynoDriver{},
+	}
+	return hs.Procs()
+}
+
+func TestReleasePhaseSucceeds(t *testing.T) {
+	p := releasePhaseProcs("exit 0")
+	if err := p.RunReleasePhase(1, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReleasePhaseFails(t *testing.T) {
+	p := releasePhaseProcs("exit 3")
+	err := p.RunReleasePhase(1, nil, nil)
+	rpe, ok := err.(*ReleasePhaseError)
+	if !ok {
+		t.Fatalf("expected a release phase error, got %v", err)
+	}
+	if rpe.Status == nil || rpe.Status.Code != 3 {
+		t.Fatalf("expected exit code 3, got %+v", rpe.Status)
+	}
+}
+
+func TestReleasePhaseAbsent(t *testing.T) {
+	p := releasePhaseProcs("exit 0")
+	p.Forms = p.Forms[:1]
+	if p.ReleaseFormation() != nil {
+		t.Fatal("expected no release formation")
+	}
+	if err := p.RunReleasePhase(1, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,544 @@
+// +build linux
+
+package hsup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"code.google.com/p/go-uuid/uuid"
+
+	"github.com/opencontainers/runc/libcontainer/configs"
+)
+
+// rootlessDynoUID is the uid, and gid, of the dyno user in the
+// containers of rootless dynos.
+const rootlessDynoUID = 1000
+
+// DefaultRootlessPortBase is the host port forwarded to the PORT of the
+// dyno in the first slot, unless ROOTLESS_PORT_BASE says otherwise.
+const DefaultRootlessPortBase = 15000
+
+// RootlessDynoDriver runs dynos in containers like the libcontainer
+// driver does, without root: in user namespaces, through an OCI runtime
+// in rootless mode.  Stack images are unpacked rather than mounted, and
+// dynos are connected to the host by a userspace network rather than
+// veth pairs.
+//
+// Each dyno unpacks its slug into its own writable /app, unless
+// AppReadOnly makes dynos share the slug, unpacked once per release and
+// mounted read-only: the user running hsup can't hand files over to
+// the dyno user without copying them.
+//
+// Every dyno takes a slot, which gives it a subordinate uid and gid of
+// the user running hsup, from /etc/subuid and /etc/subgid, to run as,
+// and the host port PortBase+slot on the loopback interface, forwarded
+// to its PORT.
+type RootlessDynoDriver struct {
+	workDir       string
+	stacksDir     string
+	containersDir string
+	slots         *Allocator
+
+	uid, gid         int
+	subUIDs, subGIDs *subordinateIDs
+
+	runtime     *ociRuntime
+	Network     string
+	PortBase    int
+	AppReadOnly bool
+
+	// buildMu serializes builds of releases again, see builtPaths.
+	buildMu sync.Mutex
+}
+
+// RootlessWorkDir returns where rootless dynos keep state:
+// ROOTLESS_WORK_DIR, or else hsup in the XDG data directory of the
+// user running hsup.
+func RootlessWorkDir() (string, error) {
+	if dir := os.Getenv("ROOTLESS_WORK_DIR"); dir != "" {
+		return dir, nil
+	}
+	if data := os.Getenv("XDG_DATA_HOME"); data != "" {
+		return filepath.Join(data, "hsup"), nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(u.HomeDir, ".local", "share", "hsup"), nil
+}
+
+// NewRootlessDynoDriver reads its configuration from ENV vars:
+// - OCI_RUNTIME
+// - ROOTLESS_NETWORK
+// - ROOTLESS_PORT_BASE
+// - ROOTLESS_DYNO_APP_READONLY
+func NewRootlessDynoDriver(workDir string) (*RootlessDynoDriver, error) {
+	runtime, err := newOCIRuntime(workDir)
+	if err != nil {
+		return nil, err
+	}
+	dd := &RootlessDynoDriver{
+		workDir:       workDir,
+		stacksDir:     filepath.Join(workDir, "stacks"),
+		containersDir: filepath.Join(workDir, "containers"),
+		uid:           os.Getuid(),
+		gid:           os.Getgid(),
+		runtime:       runtime,
+		Network:       RootlessNetworkSlirp4netns,
+		PortBase:      DefaultRootlessPortBase,
+	}
+
+	switch network := os.Getenv("ROOTLESS_NETWORK"); network {
+	case "":
+	case RootlessNetworkSlirp4netns, RootlessNetworkPasta,
+		RootlessNetworkNone:
+		dd.Network = network
+	default:
+		return nil, fmt.Errorf("invalid ROOTLESS_NETWORK %q", network)
+	}
+	if base := os.Getenv("ROOTLESS_PORT_BASE"); base != "" {
+		n, err := strconv.Atoi(base)
+		if err != nil || n <= 0 || n > 65535 {
+			return nil, fmt.Errorf("invalid ROOTLESS_PORT_BASE %q",
+				base)
+		}
+		dd.PortBase = n
+	}
+	if readOnly := os.Getenv("ROOTLESS_DYNO_APP_READONLY"); readOnly != "" {
+		if dd.AppReadOnly, err = strconv.ParseBool(readOnly); err != nil {
+			return nil, fmt.Errorf(
+				"invalid ROOTLESS_DYNO_APP_READONLY %q", readOnly)
+		}
+	}
+
+	// The init processes of containers are left behind by the
+	// runtime, to be reparented to hsup and waited for.
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL,
+		prSetChildSubreaper, 1, 0); errno != 0 {
+		return nil, fmt.Errorf("could not become a subreaper: %v", errno)
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+	if dd.subUIDs, err = readSubordinateIDs("/etc/subuid", u); err != nil {
+		return nil, err
+	}
+	if dd.subGIDs, err = readSubordinateIDs("/etc/subgid", u); err != nil {
+		return nil, err
+	}
+
+	for _, dir := range []string{dd.stacksDir, dd.containersDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if dd.slots, err = NewAllocator(
+		workDir, DefaultPrivateSubnet, 0, dd.maxSlot(),
+	); err != nil {
+		return nil, err
+	}
+	return dd, nil
+}
+
+// maxSlot is the last slot with both a subordinate uid and gid, and a
+// host port.
+func (dd *RootlessDynoDriver) maxSlot() int {
+	slots := 65536 - dd.PortBase
+	if dd.subUIDs.Count < slots {
+		slots = dd.subUIDs.Count
+	}
+	if dd.subGIDs.Count < slots {
+		slots = dd.subGIDs.Count
+	}
+	return slots - 1
+}
+
+func (dd *RootlessDynoDriver) ValidateApp(app *AppSerializable,
+	verr *ValidationError) {
+	validateSlug(app, verr)
+	validateZstd(app, verr)
+	validateStackImage(dd.stacksDir, app, verr)
+}
+
+func (dd *RootlessDynoDriver) Build(release *Release) error {
+	if release.slugURL != "" {
+		if err := fetchSlug(release); err != nil {
+			return err
+		}
+	}
+
+	stacks, err := HerokuStacksFromManifest(dd.stacksDir)
+	if err != nil {
+		return err
+	}
+	img, err := SelectStackImage(stacks, release.stack,
+		release.stackVersion)
+	if err != nil {
+		return err
+	}
+	if err := img.unpack(); err != nil {
+		return err
+	}
+	release.stackImage = img.Dir()
+
+	if release.slugURL != "" && dd.AppReadOnly {
+		layer, err := unpackReleaseLayer(dd.workDir, release, -1)
+		if err != nil {
+			return err
+		}
+		release.slugLayer = layer
+	}
+	return nil
+}
+
+func (dd *RootlessDynoDriver) Start(ex *Executor) (err error) {
+	ex.initExitStatus = make(chan *ExitStatus)
+
+	port, err := strconv.Atoi(ex.Release.config["PORT"])
+	if err != nil {
+		return err
+	}
+	slot, err := dd.slots.ReserveUID()
+	if err != nil {
+		return err
+	}
+	containerUUID := uuid.New()
+	dataPath := filepath.Join(dd.containersDir, containerUUID)
+	defer func() {
+		if err != nil {
+			dd.destroy(slot, dataPath)
+		}
+	}()
+
+	// Only the user running hsup, root in the container, needs to
+	// get at the files of the dyno on the host.
+	if err := os.MkdirAll(dataPath, 0700); err != nil {
+		return err
+	}
+	config, err := dd.newConfig(ex, containerUUID, dataPath)
+	if err != nil {
+		return err
+	}
+
+	// Paths of the host cannot be handed over to a subordinate id
+	// without root: dynos writing to them run as root in the
+	// container instead, which is the user running hsup, who owns
+	// them.
+	dynoUser := ociUser{UID: rootlessDynoUID, GID: rootlessDynoUID}
+	if len(ex.OwnedBinds) > 0 {
+		dynoUser = ociUser{}
+	}
+	bundle := filepath.Join(dataPath, "bundle")
+	spec := newOCISpec(config, ociProcess{
+		User: dynoUser,
+		Args: []string{hsupInitPath},
+		Env:  []string{"HSUP_CONTROL_FILE=" + ControlFileInContainer},
+		Cwd:  "/app",
+	})
+	rootlessSpec(spec, dd.uid, dd.gid, dd.subUIDs, dd.subGIDs, slot)
+	if err := writeOCIBundle(bundle, spec); err != nil {
+		return err
+	}
+
+	// The container is created, along with its network namespace,
+	// before the dyno runs in it, so that its network is up by when
+	// it starts.  The runtime hands the stdio of the create command
+	// over to the container, and leaves its init process behind for
+	// hsup, a subreaper, to wait for.
+	pidFile := filepath.Join(dataPath, "pid")
+	create := dd.runtime.command("create", "--bundle", bundle,
+		"--pid-file", pidFile, containerUUID)
+	create.Stdin = os.Stdin
+	create.Stdout = os.Stdout
+	create.Stderr = os.Stderr
+	if err := create.Run(); err != nil {
+		dd.runtime.delete(containerUUID)
+		return fmt.Errorf("could not create container %s: %v",
+			containerUUID, err)
+	}
+	pid, err := readPidFile(pidFile)
+	if err != nil {
+		dd.runtime.delete(containerUUID)
+		return err
+	}
+	hostPort := dd.PortBase + slot
+	network, err := startRootlessNetwork(dd.Network, pid, dataPath,
+		hostPort, port)
+	if err != nil {
+		dd.runtime.delete(containerUUID)
+		return err
+	}
+	if out, err := dd.runtime.command(
+		"start", containerUUID,
+	).CombinedOutput(); err != nil {
+		network.stop()
+		dd.runtime.delete(containerUUID)
+		return fmt.Errorf("could not start container %s: %v: %s",
+			containerUUID, err, out)
+	}
+
+	ex.ociContainer = containerUUID
+	ex.IPInfo = func() (string, int) {
+		if dd.Network == RootlessNetworkNone {
+			return "", -1
+		}
+		return "127.0.0.1", hostPort
+	}
+
+	go func() {
+		s := waitAdopted(pid)
+		network.stop()
+		dd.runtime.delete(containerUUID)
+		dd.destroy(slot, dataPath)
+
+		ex.initExitStatus <- s
+		close(ex.initExitStatus)
+	}()
+	return nil
+}
+
+// newConfig prepares the data directory of a dyno and returns the
+// configuration of its container.  Unlike with the libcontainer
+// driver, the directories the dyno writes to are not on the host: the
+// user running hsup could not remove the files of subordinate uids.
+func (dd *RootlessDynoDriver) newConfig(ex *Executor, containerUUID,
+	dataPath string) (*configs.Config, error) {
+	stackImagePath, slugLayer, err := builtPaths(dd, &dd.buildMu,
+		ex.Release)
+	if err != nil {
+		return nil, err
+	}
+	if stackImagePath == "" {
+		// Not built by this hsup, e.g. with SkipBuild.
+		if stackImagePath, err = CurrentStackImagePath(
+			dd.stacksDir, ex.Release.stack,
+		); err != nil {
+			return nil, err
+		}
+	}
+	if err := useStackImage(stackImagePath, dataPath); err != nil {
+		return nil, err
+	}
+	if slugLayer != "" {
+		if err := useReleaseLayer(slugLayer, dataPath); err != nil {
+			return nil, err
+		}
+	}
+	if err := createPasswdWithDynoUser(
+		stackImagePath, dataPath, rootlessDynoUID,
+	); err != nil {
+		return nil, err
+	}
+
+	// Files of the host the dyno reads, by path in its container.
+	binds := make(map[string]string)
+
+	slug := ex.Release.slugURL
+	if slugLayer != "" {
+		// Already in /app, from the release layer.
+		slug = ""
+	}
+	if slug != "" && ex.Release.slugPath != "" {
+		binds["/tmp/slug"] = ex.Release.slugPath
+		slug = "/tmp/slug"
+	}
+
+	outsideContainer, err := filepath.Abs(linuxAmd64Path())
+	if err != nil {
+		return nil, err
+	}
+	hsup := filepath.Join(dataPath, "hsup")
+	if err := copyFile(outsideContainer, hsup, 0755); err != nil {
+		return nil, err
+	}
+	binds[hsupInitPath] = hsup
+
+	hsupConfig := Startup{
+		App: AppSerializable{
+			Version: ex.Release.version,
+			Env:     ex.Release.config,
+			Slug:    slug,
+			Stack:   ex.Release.stack,
+
+			SlugFormat:          ex.Release.slugFormat,
+			SlugStripComponents: &ex.Release.slugStrip,
+
+			Processes: []FormationSerializable{
+				{
+					FArgs:     ex.Args,
+					FQuantity: 1,
+					FType:     ex.ProcessType,
+				},
+			},
+			LogplexURL: ex.logplexURLString(),
+		},
+		OneShot:     true,
+		SkipBuild:   false,
+		StartNumber: ex.ProcessID,
+		Action:      Start,
+		Driver:      &AbsPathDynoDriver{},
+		FormName:    ex.ProcessType,
+	}
+	controlFile := filepath.Join(dataPath,
+		filepath.Base(ControlFileInContainer))
+	if err := hsupConfig.WriteControlFile(controlFile); err != nil {
+		return nil, err
+	}
+	// Owned by root in the container, and read by the dyno user.
+	if err := os.Chmod(controlFile, 0644); err != nil {
+		return nil, err
+	}
+	binds[ControlFileInContainer] = controlFile
+
+	config := containerConfig(containerUUID, dataPath, "", nil)
+	config.Rootfs = stackImagePath
+	if slugLayer != "" {
+		readOnlyAppConfig(config, slugLayer)
+	}
+	rootlessConfig(config)
+
+	if dd.Network == RootlessNetworkSlirp4netns {
+		// The host resolver may listen on the host loopback
+		// interface, which slirp4netns keeps dynos from reaching.
+		resolvConf := filepath.Join(dataPath, "resolv.conf")
+		if err := ioutil.WriteFile(resolvConf,
+			[]byte("nameserver 10.0.2.3\n"), 0644); err != nil {
+			return nil, err
+		}
+		for _, m := range config.Mounts {
+			if m.Destination == "/etc/resolv.conf" {
+				m.Source = resolvConf
+			}
+		}
+	}
+
+	// Mounted after /tmp, so that bind mounts can be placed in it
+	// despite the root file system being read only.
+	for inside, outside := range binds {
+		config.Mounts = append(config.Mounts, &configs.Mount{
+			Device:      "bind",
+			Flags:       syscall.MS_NOSUID | syscall.MS_BIND | syscall.MS_RDONLY,
+			Destination: inside,
+			Source:      outside,
+		})
+	}
+	for outside, inside := range ex.Binds {
+		config.Mounts = append(config.Mounts, &configs.Mount{
+			Device:      "bind",
+			Flags:       syscall.MS_NOSUID | syscall.MS_BIND,
+			Destination: inside,
+			Source:      outside,
+		})
+	}
+	return config, nil
+}
+
+// rootlessConfig adapts the container configuration of a dyno to a
+// user namespace: the directories it writes to are tmpfs rather than
+// bind mounts of the host, it gets /dev from the OCI runtime, devpts
+// takes no gid, which is unmapped, and the OCI runtime creates its
+// network namespace.
+func rootlessConfig(config *configs.Config) {
+	mounts := config.Mounts[:0]
+	for _, m := range config.Mounts {
+		switch {
+		case m.Device == "bind" && m.Destination == "/dev":
+			continue
+		case m.Device == "bind" && m.Flags&syscall.MS_RDONLY == 0 &&
+			(m.Destination == "/app" || m.Destination == "/tmp" ||
+				m.Destination == "/var/tmp"):
+			m = &configs.Mount{
+				Source:      "tmpfs",
+				Destination: m.Destination,
+				Device:      "tmpfs",
+				Flags:       syscall.MS_NOSUID | syscall.MS_NODEV,
+				Data:        "mode=1777",
+			}
+		case m.Device == "devpts":
+			m.Data = strings.Replace(m.Data, ",gid=5", "", 1)
+		}
+		mounts = append(mounts, m)
+	}
+	config.Mounts = mounts
+
+	for i, ns := range config.Namespaces {
+		if ns.Type == configs.NEWNET {
+			config.Namespaces[i].Path = ""
+		}
+	}
+	config.Namespaces = append(config.Namespaces,
+		configs.Namespace{Type: configs.NEWUSER})
+	config.Cgroups = nil
+}
+
+// rootlessSpec maps the user namespace of a dyno for its slot.  The
+// device cgroup is left alone: unprivileged users can't configure it,
+// and the user namespace keeps dynos from creating devices anyway.
+func rootlessSpec(spec *ociSpec, uid, gid int,
+	subUIDs, subGIDs *subordinateIDs, slot int) {
+	spec.Linux.UIDMappings = rootlessIDMappings(uid, subUIDs, slot)
+	spec.Linux.GIDMappings = rootlessIDMappings(gid, subGIDs, slot)
+	spec.Linux.Resources = nil
+}
+
+// prSetChildSubreaper is the prctl option making processes orphaned
+// below a process its children, rather than those of init.
+const prSetChildSubreaper = 36
+
+// waitAdopted waits for a process reparented to hsup as a subreaper to
+// exit, and returns its exit status.
+func waitAdopted(pid int) *ExitStatus {
+	var ws syscall.WaitStatus
+	for {
+		_, err := syscall.Wait4(pid, &ws, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return &ExitStatus{Err: err}
+		}
+		break
+	}
+	if ws.Signaled() {
+		return &ExitStatus{Code: 128 + int(ws.Signal())}
+	}
+	return &ExitStatus{Code: ws.ExitStatus()}
+}
+
+func readPidFile(path string) (int, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(contents)))
+}
+
+// destroy removes the data directory of a dyno whose container exited,
+// and frees its slot.
+func (dd *RootlessDynoDriver) destroy(slot int, dataPath string) {
+	if err := os.RemoveAll(dataPath); err != nil {
+		log.Printf("datapath remove all error: %#+v", err)
+	}
+	dd.slots.FreeUID(slot)
+}
+
+func (dd *RootlessDynoDriver) Wait(ex *Executor) (s *ExitStatus) {
+	return <-ex.initExitStatus
+}
+
+func (dd *RootlessDynoDriver) Stop(ex *Executor) error {
+	// tell the abspath-driver to stop
+	return dd.runtime.kill(ex.ociContainer, "TERM")
+}
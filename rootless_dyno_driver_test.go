@@ -0,0 +1,132 @@
+//go:build linux
+// +build linux
+
+package hsup
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runc/libcontainer/configs"
+)
+
+func TestReadSubordinateIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "subuid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "subuid")
+	if err := ioutil.WriteFile(path, []byte(
+		"# comment\nother:100000:65536\n1001:165536:100\n"+
+			"dev:231072:65536\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		u        user.User
+		expected *subordinateIDs
+	}{
+		{user.User{Username: "dev", Uid: "1000"}, &subordinateIDs{231072, 65536}},
+		{user.User{Username: "byuid", Uid: "1001"}, &subordinateIDs{165536, 100}},
+		{user.User{Username: "none", Uid: "1002"}, nil},
+	} {
+		ids, err := readSubordinateIDs(path, &c.u)
+		if c.expected == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v",
+					c.u.Username, ids)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *ids != *c.expected {
+			t.Errorf("%s: expected %+v, got %+v", c.u.Username,
+				c.expected, ids)
+		}
+	}
+}
+
+func TestRootlessSpec(t *testing.T) {
+	config := containerConfig("some-uuid", "/data", "", nil)
+	config.Rootfs = "/stacks/cedar-14"
+	rootlessConfig(config)
+
+	for _, m := range config.Mounts {
+		switch m.Destination {
+		case "/app", "/tmp", "/var/tmp":
+			if m.Device != "tmpfs" {
+				t.Errorf("expected tmpfs on %s, got %+v",
+					m.Destination, m)
+			}
+		case "/dev":
+			if m.Device == "bind" {
+				t.Errorf("unexpected bind mount on /dev: %+v", m)
+			}
+		case "/dev/pts":
+			if strings.Contains(m.Data, "gid=") {
+				t.Errorf("unexpected gid in devpts options %q",
+					m.Data)
+			}
+		}
+	}
+	var userNS bool
+	for _, ns := range config.Namespaces {
+		if ns.Type == configs.NEWNET && ns.Path != "" {
+			t.Errorf("unexpected network namespace %q", ns.Path)
+		}
+		userNS = userNS || ns.Type == configs.NEWUSER
+	}
+	if !userNS {
+		t.Error("expected a user namespace")
+	}
+
+	spec := newOCISpec(config, ociProcess{
+		User: ociUser{UID: rootlessDynoUID, GID: rootlessDynoUID},
+		Args: []string{hsupInitPath},
+		Cwd:  "/app",
+	})
+	ids := &subordinateIDs{Start: 100000, Count: 65536}
+	rootlessSpec(spec, 1000, 100, ids, ids, 7)
+
+	if spec.Linux.Resources != nil {
+		t.Errorf("unexpected resources %+v", spec.Linux.Resources)
+	}
+	expected := []ociIDMapping{
+		{ContainerID: 0, HostID: 1000, Size: 1},
+		{ContainerID: rootlessDynoUID, HostID: 100007, Size: 1},
+	}
+	if !reflect.DeepEqual(spec.Linux.UIDMappings, expected) {
+		t.Errorf("expected uid mappings %+v, got %+v", expected,
+			spec.Linux.UIDMappings)
+	}
+	expected[0].HostID = 100
+	if !reflect.DeepEqual(spec.Linux.GIDMappings, expected) {
+		t.Errorf("expected gid mappings %+v, got %+v", expected,
+			spec.Linux.GIDMappings)
+	}
+}
+
+func TestWaitAdopted(t *testing.T) {
+	for script, code := range map[string]int{
+		"exit 3":        3,
+		"kill -TERM $$": 128 + 15,
+	} {
+		cmd := exec.Command("sh", "-c", script)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if s := waitAdopted(cmd.Process.Pid); s.Err != nil || s.Code != code {
+			t.Fatalf("expected %q to exit with %d, got %+v", script,
+				code, s)
+		}
+	}
+}
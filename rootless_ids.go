@@ -0,0 +1,72 @@
+// +build linux
+
+package hsup
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// subordinateIDs is a range of subordinate user or group IDs delegated
+// to a user in /etc/subuid or /etc/subgid, for the user namespaces it
+// creates.
+type subordinateIDs struct {
+	Start int
+	Count int
+}
+
+// readSubordinateIDs returns the first range of subordinate IDs of a
+// user, listed as "name:start:count" or "uid:start:count" lines.
+func readSubordinateIDs(path string, u *user.User) (*subordinateIDs, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 ||
+			(fields[0] != u.Username && fields[0] != u.Uid) {
+			continue
+		}
+		start, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q", path, line)
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("invalid %s entry %q", path, line)
+		}
+		return &subordinateIDs{Start: start, Count: count}, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no subordinate IDs for user %s in %s, "+
+		"see usermod --add-subuids", u.Username, path)
+}
+
+// rootlessIDMappings maps root in the user namespace of a dyno to the
+// user running hsup, who owns the files of its sandbox, and the dyno
+// user to the subordinate ID of its slot, so that dynos can't reach
+// each other's processes and files.
+func rootlessIDMappings(hostID int, ids *subordinateIDs, slot int) []ociIDMapping {
+	return []ociIDMapping{
+		{ContainerID: 0, HostID: uint32(hostID), Size: 1},
+		{
+			ContainerID: rootlessDynoUID,
+			HostID:      uint32(ids.Start + slot),
+			Size:        1,
+		},
+	}
+}
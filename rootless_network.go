@@ -0,0 +1,158 @@
+// +build linux
+
+package hsup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Userspace networks of rootless dynos, see ROOTLESS_NETWORK.  Dynos
+// can't be given veth pairs without root: their network namespace is
+// connected to the host by slirp4netns or pasta instead, which also
+// forward a port of the host loopback interface to their PORT.  With
+// RootlessNetworkNone, dynos only have a loopback interface.
+const (
+	RootlessNetworkSlirp4netns = "slirp4netns"
+	RootlessNetworkPasta       = "pasta"
+	RootlessNetworkNone        = "none"
+)
+
+// rootlessStartTimeout is how long the container and network of a
+// rootless dyno may take to come up.
+const rootlessStartTimeout = 10 * time.Second
+
+// ErrRootlessStartTimeout is returned when a file a rootless dyno waits
+// for while starting does not show up in time.
+var ErrRootlessStartTimeout = errors.New("timed out starting rootless dyno")
+
+// rootlessNetwork is the userspace network of a rootless dyno.
+type rootlessNetwork struct {
+	cmd *exec.Cmd
+}
+
+// startRootlessNetwork connects the network namespace of the process
+// pid to the host, forwarding hostPort on the host loopback interface
+// to port.  Its state is kept in dataPath.
+func startRootlessNetwork(kind string, pid int, dataPath string,
+	hostPort, port int) (*rootlessNetwork, error) {
+	var cmd *exec.Cmd
+	switch kind {
+	case RootlessNetworkNone:
+		return &rootlessNetwork{}, nil
+	case RootlessNetworkPasta:
+		cmd = exec.Command("pasta", "--foreground", "--config-net",
+			"--tcp-ports", fmt.Sprintf("127.0.0.1/%d:%d", hostPort, port),
+			strconv.Itoa(pid))
+	case RootlessNetworkSlirp4netns:
+		cmd = exec.Command("slirp4netns", "--configure", "--mtu=65520",
+			"--disable-host-loopback",
+			"--api-socket", slirp4netnsSocket(dataPath),
+			strconv.Itoa(pid), "tap0")
+	default:
+		return nil, fmt.Errorf("unknown rootless network %q", kind)
+	}
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	rn := &rootlessNetwork{cmd: cmd}
+
+	if kind == RootlessNetworkSlirp4netns {
+		if err := slirp4netnsForward(
+			slirp4netnsSocket(dataPath), exited, hostPort, port,
+		); err != nil {
+			rn.stop()
+			return nil, err
+		}
+	}
+	return rn, nil
+}
+
+func (rn *rootlessNetwork) stop() {
+	if rn.cmd != nil {
+		rn.cmd.Process.Kill()
+	}
+}
+
+func slirp4netnsSocket(dataPath string) string {
+	return filepath.Join(dataPath, "slirp4netns.sock")
+}
+
+// slirp4netnsForward asks slirp4netns, through its API socket, to
+// forward hostPort to port.
+func slirp4netnsForward(socket string, exited <-chan struct{},
+	hostPort, port int) error {
+	if err := waitForFile(socket, exited); err != nil {
+		return err
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	req := map[string]interface{}{
+		"execute": "add_hostfwd",
+		"arguments": map[string]interface{}{
+			"proto":      "tcp",
+			"host_addr":  "127.0.0.1",
+			"host_port":  hostPort,
+			"guest_port": port,
+		},
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+	conn.(*net.UnixConn).CloseWrite()
+
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Error *struct {
+			Desc string `json:"desc"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(reply, &resp); err != nil {
+		return fmt.Errorf("invalid slirp4netns reply %q: %v", reply, err)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("could not forward port %d to %d: %s",
+			hostPort, port, resp.Error.Desc)
+	}
+	return nil
+}
+
+// waitForFile waits for a file written by a process starting up,
+// unless the process exits first.
+func waitForFile(path string, exited <-chan struct{}) error {
+	timeout := time.After(rootlessStartTimeout)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+		select {
+		case <-exited:
+			return fmt.Errorf("exited before writing %s", path)
+		case <-timeout:
+			return ErrRootlessStartTimeout
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -1,12 +1,13 @@
 package hsup
 
 import (
-	"bytes"
-	"encoding/base64"
-	"encoding/gob"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/url"
-	"strings"
+	"os"
+	"path/filepath"
 )
 
 type Action int
@@ -17,6 +18,73 @@ const (
 	Run
 )
 
+var actionNames = []string{"build", "start", "run"}
+
+func (a Action) String() string {
+	if a < 0 || int(a) >= len(actionNames) {
+		return fmt.Sprintf("Action(%d)", a)
+	}
+	return actionNames[a]
+}
+
+func parseAction(name string) (Action, error) {
+	for i, n := range actionNames {
+		if n == name {
+			return Action(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown action %q", name)
+}
+
+// StartupFormatVersion is the latest version of the JSON control file
+// format written by this hsup for sub-invocations.  It is incremented
+// on changes that older versions of hsup cannot safely ignore; new
+// optional fields do not require a new version, as readers ignore
+// fields they do not know about.  Control files are written in the
+// earliest version able to carry them, see formatVersion.
+//
+// Version 2 added SlugFormat and SlugStripComponents, which change
+// how the slug is to be unpacked.
+const StartupFormatVersion = 2
+
+// ControlFileInContainer is where dyno drivers place the control file
+// for the hsup sub-invocation running inside a container.
+const ControlFileInContainer = "/tmp/hsup-control.json"
+
+// FormatVersionError is returned when reading a control file written
+// in a format version this hsup does not understand.
+type FormatVersionError struct {
+	Version int
+}
+
+func (e *FormatVersionError) Error() string {
+	if e.Version == 0 {
+		return "control file has no FormatVersion: it was not " +
+			"written by a compatible version of hsup"
+	}
+	return fmt.Sprintf("control file format version %d is not "+
+		"supported by this hsup, which reads up to version %d: "+
+		"upgrade the hsup binary receiving it",
+		e.Version, StartupFormatVersion)
+}
+
+// startupJSON is the wire representation of Startup.  It differs from
+// Startup in naming the dyno driver and action rather than carrying
+// Go values for them.
+type startupJSON struct {
+	FormatVersion int
+	App           AppSerializable
+	Action        string
+	Driver        string
+	OneShot       bool              `json:",omitempty"`
+	StartNumber   int               `json:",omitempty"`
+	SkipBuild     bool              `json:",omitempty"`
+	FormName      string            `json:",omitempty"`
+	ControlSocket string            `json:",omitempty"`
+	Args          []string          `json:",omitempty"`
+	Binds         map[string]string `json:",omitempty"`
+}
+
 // Startup is a serializable struct sufficient to perform
 // sub-invocations of hsup.
 type Startup struct {
@@ -37,8 +105,8 @@ type Startup struct {
 	Action Action
 
 	// Driver specifies the DynoDriver used to execute a program
-	// under hsup.  If used for sub-invocations, it must be
-	// registered via "gob.Register".
+	// under hsup.  If used for sub-invocations, it must be known
+	// to DriverName and NewDriverByName.
 	Driver DynoDriver
 
 	// SkipBuild is set to true tos kip skip the build step of
@@ -70,13 +138,33 @@ type AppSerializable struct {
 	Stack     string
 	Processes []FormationSerializable
 
+	// SlugChecksum is the SHA256 digest of the slug in the form
+	// "sha256:<hex digest>".  When present, the slug is verified
+	// against it and downloads are cached by it.
+	SlugChecksum string `json:",omitempty"`
+
+	// SlugFormat is how the slug is archived: "tgz", the default,
+	// "tar.zst", "tar", or "oci-layer" for a layer of a local OCI
+	// image layout directory, identified by SlugChecksum.
+	// SlugStripComponents is the number of leading path components
+	// dropped from archive entries, two ("./app/") by default and
+	// none for OCI layers.
+	SlugFormat          string `json:",omitempty"`
+	SlugStripComponents *int   `json:",omitempty"`
+
+	// StackVersion pins the version of the stack image to run on,
+	// as listed in the stacks manifest, rather than using the
+	// primary or else latest one.  Only the libcontainer driver
+	// supports it.
+	StackVersion string `json:",omitempty"`
+
 	// LogplexURL specifies where to forward the supervised
 	// process Stdout and Stderr when non-empty.
 	LogplexURL string `json:",omitempty"`
 }
 
 // Convenience function for parsing the stringy LogplexURL.  This is
-// helpful because gob encoding of url.URL values is not supported.
+// helpful because url.URL values do not round-trip through JSON.
 // It's presumed that the URL-conformance of LogplexURL has already
 // been verified.
 func (as *AppSerializable) MustParseLogplexURL() *url.URL {
@@ -109,25 +197,104 @@ func (fs *FormationSerializable) Type() string {
 	return fs.FType
 }
 
-func (hs *Startup) ToBase64Gob() string {
-	buf := bytes.Buffer{}
-	b64enc := base64.NewEncoder(base64.StdEncoding, &buf)
-	enc := gob.NewEncoder(b64enc)
-	err := enc.Encode(hs)
-	b64enc.Close()
+// formatVersion returns the earliest control file format version
+// older hsup sub-invocations need to understand to run hs.
+func (hs *Startup) formatVersion() int {
+	if hs.App.SlugFormat != "" || hs.App.SlugStripComponents != nil {
+		return 2
+	}
+	return 1
+}
+
+func (hs *Startup) MarshalJSON() ([]byte, error) {
+	driver, err := DriverName(hs.Driver)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&startupJSON{
+		FormatVersion: hs.formatVersion(),
+		App:           hs.App,
+		Action:        hs.Action.String(),
+		Driver:        driver,
+		OneShot:       hs.OneShot,
+		StartNumber:   hs.StartNumber,
+		SkipBuild:     hs.SkipBuild,
+		FormName:      hs.FormName,
+		ControlSocket: hs.ControlSocket,
+		Args:          hs.Args,
+		Binds:         hs.Binds,
+	})
+}
+
+func (hs *Startup) UnmarshalJSON(data []byte) error {
+	// Check the version before anything else: a newer format may
+	// not even decode into the current representation.
+	var v struct{ FormatVersion int }
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if v.FormatVersion < 1 || v.FormatVersion > StartupFormatVersion {
+		return &FormatVersionError{Version: v.FormatVersion}
+	}
+
+	var sj startupJSON
+	if err := json.Unmarshal(data, &sj); err != nil {
+		return err
+	}
+
+	action, err := parseAction(sj.Action)
 	if err != nil {
-		panic("could not encode gob:" + err.Error())
+		return err
+	}
+	driver, err := NewDriverByName(sj.Driver)
+	if err != nil {
+		return err
 	}
 
-	return buf.String()
+	*hs = Startup{
+		App:           sj.App,
+		OneShot:       sj.OneShot,
+		StartNumber:   sj.StartNumber,
+		Action:        action,
+		Driver:        driver,
+		SkipBuild:     sj.SkipBuild,
+		FormName:      sj.FormName,
+		ControlSocket: sj.ControlSocket,
+		Args:          sj.Args,
+		Binds:         sj.Binds,
+	}
+	return nil
 }
 
-func (hs *Startup) FromBase64Gob(payload string) {
-	d := gob.NewDecoder(base64.NewDecoder(base64.StdEncoding,
-		strings.NewReader(payload)))
-	if err := d.Decode(hs); err != nil {
-		panic("could not decode gob:" + err.Error())
+// ReadStartup decodes a control file written for a sub-invocation of
+// hsup.
+func ReadStartup(r io.Reader) (*Startup, error) {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	hs := &Startup{}
+	if err := json.Unmarshal(contents, hs); err != nil {
+		return nil, fmt.Errorf("could not read control file: %v", err)
 	}
+	return hs, nil
+}
+
+// WriteControlFile writes a control file for a sub-invocation of hsup
+// to path.  The file is only readable by its owner, as the
+// application environment tends to contain credentials.
+func (hs *Startup) WriteControlFile(path string) error {
+	contents, err := json.MarshalIndent(hs, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, contents, 0600)
 }
 
 func (hs *Startup) Procs() *Processes {
@@ -139,11 +306,15 @@ func (hs *Startup) Procs() *Processes {
 	}
 	procs := &Processes{
 		Rel: &Release{
-			appName: hs.App.Name,
-			config:  hs.App.Env,
-			slugURL: hs.App.Slug,
-			stack:   hs.App.Stack,
-			version: hs.App.Version,
+			appName:      hs.App.Name,
+			config:       hs.App.Env,
+			slugURL:      hs.App.Slug,
+			slugChecksum: hs.App.SlugChecksum,
+			slugFormat:   hs.App.slugFormat(),
+			slugStrip:    hs.App.slugStripComponents(),
+			stack:        hs.App.Stack,
+			stackVersion: hs.App.StackVersion,
+			version:      hs.App.Version,
 		},
 		Forms:      make([]Formation, len(hs.App.Processes)),
 		Dd:         hs.Driver,
@@ -157,7 +328,3 @@ func (hs *Startup) Procs() *Processes {
 
 	return procs
 }
-
-func init() {
-	gob.Register(&AbsPathDynoDriver{})
-}
@@ -0,0 +1,107 @@
+package hsup
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStartupJSONRoundTrip(t *testing.T) {
+	hs := Startup{
+		App: AppSerializable{
+			Version: 3,
+			Name:    "sushi",
+			Env:     map[string]string{"PORT": "5000"},
+			Slug:    "/tmp/slug.tgz",
+			Stack:   "cedar-14",
+			Processes: []FormationSerializable{
+				{FArgs: []string{"./web"}, FQuantity: 1, FType: "web"},
+			},
+		},
+		OneShot:     true,
+		StartNumber: 2,
+		Action:      Start,
+		Driver:      &AbsPathDynoDriver{},
+		FormName:    "web",
+	}
+
+	contents, err := json.Marshal(&hs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ReadStartup(bytes.NewReader(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(*result, hs) {
+		t.Fatalf("\nExpect %+v\nResult %+v", hs, *result)
+	}
+}
+
+func TestStartupJSONNamesDriverAndAction(t *testing.T) {
+	hs := Startup{Action: Run, Driver: &SimpleDynoDriver{}}
+	contents, err := json.Marshal(&hs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wire map[string]interface{}
+	json.Unmarshal(contents, &wire)
+	if wire["Driver"] != "simple" || wire["Action"] != "run" {
+		t.Fatalf("expected named driver and action, got %s", contents)
+	}
+	if wire["FormatVersion"] != float64(1) {
+		t.Fatalf("expected format version 1, got %s", contents)
+	}
+}
+
+func TestStartupJSONFormatVersionOfSlugFormats(t *testing.T) {
+	strip := 1
+	for _, app := range []AppSerializable{
+		{SlugFormat: SlugFormatTarZstd},
+		{SlugStripComponents: &strip},
+	} {
+		hs := Startup{App: app, Action: Start,
+			Driver: &AbsPathDynoDriver{}}
+		contents, err := json.Marshal(&hs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wire struct{ FormatVersion int }
+		json.Unmarshal(contents, &wire)
+		if wire.FormatVersion != 2 {
+			t.Fatalf("expected format version 2, got %s", contents)
+		}
+
+		result, err := ReadStartup(bytes.NewReader(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(result.App, app) {
+			t.Fatalf("expected %+v, got %+v", app, result.App)
+		}
+	}
+}
+
+func TestStartupJSONVersionErrors(t *testing.T) {
+	for _, doc := range []string{
+		`{"Action": "start", "Driver": "abspath"}`,
+		`{"FormatVersion": 99, "Action": "start", "Driver": "abspath"}`,
+	} {
+		_, err := ReadStartup(strings.NewReader(doc))
+		if err == nil || !strings.Contains(err.Error(), "version") {
+			t.Fatalf("expected a version error for %s, got %v",
+				doc, err)
+		}
+	}
+
+	_, err := ReadStartup(strings.NewReader(
+		`{"FormatVersion": 1, "Action": "start", "Driver": "bogus"}`))
+	if err == nil {
+		t.Fatal("expected an unknown driver to be an error")
+	}
+}
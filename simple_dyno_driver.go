@@ -39,6 +39,15 @@ func (dd *SimpleDynoDriver) Start(ex *Executor) (err error) {
 		ex.logsRelay.run()
 	}
 
+	// A slug that is a local directory holds the application
+	// code as is, e.g. when loaded by ProcfilePoller: run from
+	// within it, as foreman would.
+	if ex.Release.Where() == Local {
+		if fi, err := os.Stat(ex.Release.slugURL); err == nil && fi.IsDir() {
+			ex.cmd.Dir = ex.Release.slugURL
+		}
+	}
+
 	// Fill environment vector from Heroku configuration.
 	for k, v := range ex.Release.config {
 		ex.cmd.Env = append(ex.cmd.Env, k+"="+v)
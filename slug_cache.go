@@ -0,0 +1,311 @@
+package hsup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSlugCacheSize bounds the slug cache unless
+// HSUP_SLUG_CACHE_SIZE says otherwise.
+const DefaultSlugCacheSize int64 = 5 << 30
+
+var ErrInvalidChecksum = errors.New(
+	`invalid slug checksum: expected "sha256:<hex digest>"`)
+
+// ChecksumMismatchError is returned when a slug does not have the
+// checksum it was announced with, e.g. because its download was
+// truncated.
+type ChecksumMismatchError struct {
+	Slug     string
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("slug %q has checksum %s, expected %s",
+		e.Slug, e.Actual, e.Expected)
+}
+
+// parseChecksum splits a checksum of the form "sha256:<hex>" and
+// returns the normalized, lower case, hex digest.
+func parseChecksum(checksum string) (string, error) {
+	parts := strings.SplitN(checksum, ":", 2)
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "sha256" {
+		return "", ErrInvalidChecksum
+	}
+
+	digest := strings.ToLower(parts[1])
+	if b, err := hex.DecodeString(digest); err != nil ||
+		len(b) != sha256.Size {
+		return "", ErrInvalidChecksum
+	}
+	return digest, nil
+}
+
+func formatChecksum(digest string) string {
+	return "sha256:" + digest
+}
+
+// SlugCache keeps downloaded slugs in a directory, named by the SHA256
+// digest of their contents, so that releases sharing a slug download
+// it only once.  Once the cache grows beyond MaxBytes, the least
+// recently used slugs are removed.
+type SlugCache struct {
+	Dir      string
+	MaxBytes int64
+}
+
+// DefaultSlugCache returns the slug cache shared by all dyno drivers
+// on a host.  HSUP_SLUG_CACHE_DIR and HSUP_SLUG_CACHE_SIZE override
+// its location and size; without them, it lives in DefaultWorkDir,
+// or in the temporary directory if that is not writable.
+func DefaultSlugCache() (*SlugCache, error) {
+	sc := &SlugCache{
+		Dir:      os.Getenv("HSUP_SLUG_CACHE_DIR"),
+		MaxBytes: DefaultSlugCacheSize,
+	}
+
+	if size := os.Getenv("HSUP_SLUG_CACHE_SIZE"); size != "" {
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HSUP_SLUG_CACHE_SIZE "+
+				"%q: %v", size, err)
+		}
+		sc.MaxBytes = n
+	}
+
+	if sc.Dir != "" {
+		return sc, os.MkdirAll(sc.Dir, 0700)
+	}
+
+	sc.Dir = filepath.Join(DefaultWorkDir, "slugs")
+	if err := os.MkdirAll(sc.Dir, 0700); err != nil {
+		sc.Dir = filepath.Join(os.TempDir(), "hsup-slugs")
+		return sc, os.MkdirAll(sc.Dir, 0700)
+	}
+	return sc, nil
+}
+
+func (sc *SlugCache) path(digest string) string {
+	return filepath.Join(sc.Dir, "sha256-"+digest)
+}
+
+// Lookup returns the path of a cached slug with the given checksum,
+// if there is one.
+func (sc *SlugCache) Lookup(checksum string) (string, bool) {
+	digest, err := parseChecksum(checksum)
+	if err != nil {
+		return "", false
+	}
+
+	cached := sc.path(digest)
+	if _, err := os.Stat(cached); err != nil {
+		return "", false
+	}
+
+	// Record the use for eviction.
+	now := time.Now()
+	os.Chtimes(cached, now, now)
+	return cached, true
+}
+
+// Fetch returns the path of a local copy of the slug at url, verifying
+// it against checksum unless that is empty.  Without a checksum, the
+// slug is downloaded again every time, because its contents can't be
+// known in advance.
+func (sc *SlugCache) Fetch(url, checksum string) (string, error) {
+	var digest string
+	if checksum != "" {
+		var err error
+		if digest, err = parseChecksum(checksum); err != nil {
+			return "", err
+		}
+
+		if cached, ok := sc.Lookup(checksum); ok {
+			log.Printf("using cached slug %s", cached)
+			return cached, nil
+		}
+	}
+
+	log.Printf("fetching slug URL %q", url)
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not fetch slug %q: %s",
+			url, resp.Status)
+	}
+
+	// Download into a temporary file in the cache directory, so
+	// that concurrent fetches don't collide and only complete,
+	// verified slugs are ever visible under their digest.
+	tmp, err := ioutil.TempFile(sc.Dir, "tmp_")
+	if err != nil {
+		return "", err
+	}
+	renamed := false
+	defer func() {
+		tmp.Close()
+		if !renamed {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return "", fmt.Errorf("slug %q truncated: got %d of %d bytes",
+			url, n, resp.ContentLength)
+	}
+
+	actual := hex.EncodeToString(h.Sum(nil))
+	if digest != "" && actual != digest {
+		return "", &ChecksumMismatchError{
+			Slug:     url,
+			Expected: formatChecksum(digest),
+			Actual:   formatChecksum(actual),
+		}
+	}
+
+	if err := tmp.Chmod(0644); err != nil {
+		return "", err
+	}
+	cached := sc.path(actual)
+	if err := os.Rename(tmp.Name(), cached); err != nil {
+		return "", err
+	}
+	renamed = true
+
+	if err := sc.evict(cached); err != nil {
+		log.Printf("could not evict slugs from cache: %v", err)
+	}
+	return cached, nil
+}
+
+// evict removes the least recently used slugs until the cache fits in
+// MaxBytes, sparing keep.  The cache is shared by all hsup processes
+// on a host, so only one of them evicts at a time.
+func (sc *SlugCache) evict(keep string) error {
+	lock, err := LockFile(filepath.Join(sc.Dir, "evict.lock"),
+		"slug cache eviction")
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	entries, err := ioutil.ReadDir(sc.Dir)
+	if err != nil {
+		return err
+	}
+
+	var slugs []os.FileInfo
+	var total int64
+	for _, fi := range entries {
+		if !strings.HasPrefix(fi.Name(), "sha256-") {
+			continue
+		}
+		slugs = append(slugs, fi)
+		total += fi.Size()
+	}
+
+	sort.Sort(byModTime(slugs))
+	for _, fi := range slugs {
+		if total <= sc.MaxBytes {
+			break
+		}
+		path := filepath.Join(sc.Dir, fi.Name())
+		if path == keep {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		total -= fi.Size()
+	}
+
+	return nil
+}
+
+type byModTime []os.FileInfo
+
+func (s byModTime) Len() int           { return len(s) }
+func (s byModTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byModTime) Less(i, j int) bool { return s[i].ModTime().Before(s[j].ModTime()) }
+
+// VerifySlugFile checks a local slug against checksum.
+func VerifySlugFile(path, checksum string) error {
+	digest, err := parseChecksum(checksum)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != digest {
+		return &ChecksumMismatchError{
+			Slug:     path,
+			Expected: formatChecksum(digest),
+			Actual:   formatChecksum(actual),
+		}
+	}
+	return nil
+}
+
+// fetchSlug makes the slug of a release available on the local file
+// system, fetching it through the slug cache if needed, and verifies
+// its checksum.  Afterwards, release.slugPath is the local copy.
+func fetchSlug(release *Release) error {
+	if release.slugURL == "" {
+		return ErrNoSlugURL
+	}
+
+	switch release.Where() {
+	case Local:
+		if release.slugFormat == SlugFormatOCILayer {
+			return resolveOCILayer(release)
+		}
+		release.slugPath = strings.TrimPrefix(release.slugURL, "file://")
+		if release.slugChecksum == "" {
+			return nil
+		}
+		return VerifySlugFile(release.slugPath, release.slugChecksum)
+	case HTTP:
+		sc, err := DefaultSlugCache()
+		if err != nil {
+			return err
+		}
+		path, err := sc.Fetch(release.slugURL, release.slugChecksum)
+		if err != nil {
+			return err
+		}
+		release.slugPath = path
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package hsup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func sha256Checksum(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func slugServer(contents []byte, requests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			*requests++
+			w.Write(contents)
+		}))
+}
+
+func TestSlugCacheFetchesOnce(t *testing.T) {
+	name := newTmpDb(t)
+	defer os.RemoveAll(name)
+
+	slug := []byte("a slug")
+	var requests int
+	srv := slugServer(slug, &requests)
+	defer srv.Close()
+
+	sc := &SlugCache{Dir: name, MaxBytes: DefaultSlugCacheSize}
+	for i := 0; i < 2; i++ {
+		path, err := sc.Fetch(srv.URL, sha256Checksum(slug))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contents, _ := ioutil.ReadFile(path); string(contents) != string(slug) {
+			t.Fatalf("unexpected slug contents %q", contents)
+		}
+	}
+
+	if requests != 1 {
+		t.Fatalf("expected a single download, got %d", requests)
+	}
+}
+
+func TestFetchSlugKeepsURL(t *testing.T) {
+	cache := newTmpDb(t)
+	defer os.RemoveAll(cache)
+	os.Setenv("HSUP_SLUG_CACHE_DIR", cache)
+	defer os.Unsetenv("HSUP_SLUG_CACHE_DIR")
+
+	slug := []byte("a slug")
+	var requests int
+	srv := slugServer(slug, &requests)
+	defer srv.Close()
+
+	release := &Release{
+		slugURL:      srv.URL,
+		slugChecksum: sha256Checksum(slug),
+	}
+	if err := fetchSlug(release); err != nil {
+		t.Fatal(err)
+	}
+	if release.slugURL != srv.URL || release.Where() != HTTP {
+		t.Fatalf("expected the slug URL to be kept, got %q",
+			release.slugURL)
+	}
+	if contents, _ := ioutil.ReadFile(release.slugPath); string(contents) != string(slug) {
+		t.Fatalf("unexpected slug contents %q", contents)
+	}
+}
+
+func TestSlugCacheRejectsChecksumMismatch(t *testing.T) {
+	name := newTmpDb(t)
+	defer os.RemoveAll(name)
+
+	var requests int
+	srv := slugServer([]byte("truncat"), &requests)
+	defer srv.Close()
+
+	sc := &SlugCache{Dir: name, MaxBytes: DefaultSlugCacheSize}
+	_, err := sc.Fetch(srv.URL, sha256Checksum([]byte("truncated")))
+	if _, ok := err.(*ChecksumMismatchError); !ok {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+
+	// Nothing is left behind in the cache.
+	entries, _ := ioutil.ReadDir(name)
+	if len(entries) != 0 {
+		t.Fatalf("expected an empty cache, got %d entries", len(entries))
+	}
+}
+
+func TestSlugCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	name := newTmpDb(t)
+	defer os.RemoveAll(name)
+
+	sc := &SlugCache{Dir: name, MaxBytes: 10}
+	var paths []string
+	for _, slug := range []string{"first!", "second", "third!"} {
+		var requests int
+		srv := slugServer([]byte(slug), &requests)
+		path, err := sc.Fetch(srv.URL, "")
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	if _, err := os.Stat(paths[2]); err != nil {
+		t.Fatal("expected the latest slug to be kept")
+	}
+	if _, err := os.Stat(paths[0]); !os.IsNotExist(err) {
+		t.Fatal("expected the oldest slug to be evicted")
+	}
+}
+
+func TestVerifySlugFile(t *testing.T) {
+	name := newTmpDb(t)
+	defer os.RemoveAll(name)
+
+	path := filepath.Join(name, "slug.tgz")
+	ioutil.WriteFile(path, []byte("a slug"), 0644)
+
+	if err := VerifySlugFile(path, sha256Checksum([]byte("a slug"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySlugFile(path, sha256Checksum([]byte("other"))); err == nil {
+		t.Fatal("expected a checksum mismatch")
+	}
+	if err := VerifySlugFile(path, "md5:abc"); err != ErrInvalidChecksum {
+		t.Fatalf("expected an invalid checksum, got %v", err)
+	}
+}
@@ -0,0 +1,473 @@
+package hsup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/htcat/htcat"
+)
+
+// SlugStripComponents is the number of leading path components of slug
+// archive entries, "./app/", dropped when unpacking into /app.
+const SlugStripComponents = 2
+
+// Slug formats, see AppSerializable.SlugFormat.
+const (
+	SlugFormatTgz      = "tgz"
+	SlugFormatTarZstd  = "tar.zst"
+	SlugFormatTar      = "tar"
+	SlugFormatOCILayer = "oci-layer"
+)
+
+var slugFormats = []string{
+	SlugFormatTgz, SlugFormatTarZstd, SlugFormatTar, SlugFormatOCILayer,
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+func (as *AppSerializable) slugFormat() string {
+	if as.SlugFormat == "" {
+		return SlugFormatTgz
+	}
+	return as.SlugFormat
+}
+
+func (as *AppSerializable) slugStripComponents() int {
+	switch {
+	case as.SlugStripComponents != nil:
+		return *as.SlugStripComponents
+	case as.slugFormat() == SlugFormatOCILayer:
+		return 0
+	default:
+		return SlugStripComponents
+	}
+}
+
+// ociLayerPath returns the path of the blob with the given digest in
+// an OCI image layout directory.
+func ociLayerPath(layout, checksum string) (string, error) {
+	digest, err := parseChecksum(checksum)
+	if err != nil {
+		return "", err
+	}
+
+	layout = strings.TrimPrefix(layout, "file://")
+	if _, err := os.Stat(filepath.Join(layout, "oci-layout")); err != nil {
+		return "", fmt.Errorf("%q is not an OCI image layout: %v",
+			layout, err)
+	}
+	return filepath.Join(layout, "blobs", "sha256", digest), nil
+}
+
+// resolveOCILayer points a release with an OCI layer slug at the
+// verified layer blob, in the archive format it turns out to have.
+func resolveOCILayer(release *Release) error {
+	path, err := ociLayerPath(release.slugURL, release.slugChecksum)
+	if err != nil {
+		return err
+	}
+	if err := VerifySlugFile(path, release.slugChecksum); err != nil {
+		return err
+	}
+
+	format, err := sniffSlugFormat(path)
+	if err != nil {
+		return err
+	}
+	release.slugPath = path
+	release.slugFormat = format
+	return nil
+}
+
+// sniffSlugFormat tells the archive format of an OCI layer from its
+// first bytes, as layers may be gzip or zstd compressed or not at all.
+func sniffSlugFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(zstdMagic))
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	magic = magic[:n]
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return SlugFormatTgz, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		return SlugFormatTarZstd, nil
+	default:
+		return SlugFormatTar, nil
+	}
+}
+
+// PathTraversalError is returned for archive entries that would be
+// written outside of the extraction directory.
+type PathTraversalError struct {
+	Name string
+}
+
+func (e *PathTraversalError) Error() string {
+	return fmt.Sprintf("slug entry %q points outside of the "+
+		"extraction directory", e.Name)
+}
+
+// unpackSlug extracts the slug of a release into dir.  Slugs that are
+// neither local nor cached are streamed from their URL, using parallel
+// range requests where the server allows for them, without first
+// writing them to disk.
+func unpackSlug(release *Release, dir string) error {
+	if release.Where() == HTTP {
+		if _, ok := lookupCachedSlug(release.slugChecksum); !ok {
+			return streamSlug(release, dir)
+		}
+	}
+
+	if err := fetchSlug(release); err != nil {
+		return err
+	}
+
+	f, err := os.Open(release.slugPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return extractSlug(f, release.slugFormat, dir, release.slugStrip)
+}
+
+func lookupCachedSlug(checksum string) (string, bool) {
+	if checksum == "" {
+		return "", false
+	}
+	sc, err := DefaultSlugCache()
+	if err != nil {
+		return "", false
+	}
+	return sc.Lookup(checksum)
+}
+
+func streamSlug(release *Release, dir string) error {
+	u, err := url.Parse(release.slugURL)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("streaming slug URL %q", release.slugURL)
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		_, err := htcat.New(http.DefaultClient, u, 5).WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
+
+	h := sha256.New()
+	r := io.TeeReader(pr, h)
+	err = extractSlug(r, release.slugFormat, dir, release.slugStrip)
+	if err != nil {
+		return err
+	}
+
+	// Hash whatever follows the end of the archive, e.g. padding,
+	// so that the digest covers the whole download.
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return err
+	}
+
+	if release.slugChecksum == "" {
+		return nil
+	}
+	digest, err := parseChecksum(release.slugChecksum)
+	if err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != digest {
+		return &ChecksumMismatchError{
+			Slug:     release.slugURL,
+			Expected: formatChecksum(digest),
+			Actual:   formatChecksum(actual),
+		}
+	}
+	return nil
+}
+
+// extractSlug extracts a slug archive of the given format into dir,
+// see extractTar.
+func extractSlug(r io.Reader, format, dir string, strip int) (err error) {
+	var ar io.Reader
+	switch format {
+	case SlugFormatTgz:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		ar = zr
+	case SlugFormatTarZstd:
+		zr, zerr := newZstdReader(r)
+		if zerr != nil {
+			return zerr
+		}
+		defer func() {
+			if cerr := zr.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		ar = zr
+	case SlugFormatTar:
+		ar = r
+	default:
+		return fmt.Errorf("cannot extract slugs of format %q", format)
+	}
+
+	return extractTar(ar, dir, strip)
+}
+
+// zstdReader decompresses a stream with the zstd command, for want of
+// a Go implementation.  Drivers reject zstd compressed slugs when they
+// are submitted if they cannot be unpacked, see validateZstd.
+type zstdReader struct {
+	cmd *exec.Cmd
+	out io.ReadCloser
+}
+
+func newZstdReader(r io.Reader) (*zstdReader, error) {
+	cmd := exec.Command("zstd", "-d", "-c", "-q")
+	cmd.Stdin = r
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("tar.zst slugs require zstd: %v", err)
+	}
+	return &zstdReader{cmd: cmd, out: out}, nil
+}
+
+func (zr *zstdReader) Read(p []byte) (int, error) {
+	return zr.out.Read(p)
+}
+
+// Close waits for zstd to exit, after consuming any output past the
+// end of the archive so that it does not block writing it.
+func (zr *zstdReader) Close() error {
+	io.Copy(ioutil.Discard, zr.out)
+	return zr.cmd.Wait()
+}
+
+// extractTar extracts a tarball into dir, dropping the first strip
+// components of every entry name like tar's "--strip-components".
+// Permissions, modification times, symbolic and hard links are
+// preserved; ownership is not.  Entries that would end up outside of
+// dir, either directly or through a symbolic link, are rejected.
+func extractTar(r io.Reader, dir string, strip int) error {
+	// Directory permissions and times are applied last: adding
+	// entries would otherwise change the times, and read-only
+	// directories could not be filled.
+	var dirs []*tar.Header
+	var dirTargets []string
+	defer func() {
+		for i := len(dirs) - 1; i >= 0; i-- {
+			// A later entry may have replaced the directory
+			// with a symbolic link, which chmod would follow.
+			fi, err := os.Lstat(dirTargets[i])
+			if err != nil || !fi.IsDir() {
+				continue
+			}
+			os.Chmod(dirTargets[i], os.FileMode(dirs[i].Mode).Perm())
+			os.Chtimes(dirTargets[i], dirs[i].ModTime, dirs[i].ModTime)
+		}
+	}()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		rel, ok, err := stripEntryName(hdr.Name, strip)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		// Whiteouts in OCI layers delete files of lower layers,
+		// of which slugs have none.
+		if strings.HasPrefix(filepath.Base(rel), ".wh.") {
+			continue
+		}
+
+		if err := checkNoSymlinkParents(dir, rel); err != nil {
+			return err
+		}
+		target := filepath.Join(dir, rel)
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := replaceWithDir(target, rel); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			dirs = append(dirs, hdr)
+			dirTargets = append(dirTargets, target)
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+			if err := extractFile(tr, target, mode); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			os.Remove(target)
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeLink:
+			linkRel, ok, err := stripEntryName(hdr.Linkname, strip)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return &PathTraversalError{Name: hdr.Linkname}
+			}
+			if err := checkNoSymlinkParents(dir, linkRel); err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Link(filepath.Join(dir, linkRel), target); err != nil {
+				return err
+			}
+			continue
+		default:
+			// Devices, FIFOs and the like have no place in
+			// a slug.
+			log.Printf("skipping slug entry %q of type %q",
+				hdr.Name, hdr.Typeflag)
+			continue
+		}
+
+		if err := os.Chtimes(target, hdr.ModTime, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+}
+
+// replaceWithDir makes way for the directory entry rel at target:
+// MkdirAll would otherwise go through a symbolic link an earlier entry
+// left there, which is rejected, and fail on any other file, which is
+// removed.
+func replaceWithDir(target, rel string) error {
+	fi, err := os.Lstat(target)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	case fi.IsDir():
+		return nil
+	case fi.Mode()&os.ModeSymlink != 0:
+		return &PathTraversalError{Name: rel}
+	default:
+		return os.Remove(target)
+	}
+}
+
+func extractFile(r io.Reader, target string, mode os.FileMode) (err error) {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	// Replace rather than write through whatever is there, which
+	// could be a symbolic link.
+	os.Remove(target)
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	// Apply the mode exactly, regardless of the umask.
+	return f.Chmod(mode)
+}
+
+// stripEntryName drops the first strip components of an archive entry
+// name and returns the remaining relative path, or false if nothing
+// remains.
+func stripEntryName(name string, strip int) (string, bool, error) {
+	var parts []string
+	for _, p := range strings.Split(name, "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	if len(parts) <= strip {
+		return "", false, nil
+	}
+
+	rel := filepath.Clean(filepath.Join(parts[strip:]...))
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false, &PathTraversalError{Name: name}
+	}
+	if rel == "." {
+		return "", false, nil
+	}
+	return rel, true, nil
+}
+
+// checkNoSymlinkParents makes sure that no directory leading to rel
+// within dir is a symbolic link, which an earlier archive entry could
+// have pointed anywhere.
+func checkNoSymlinkParents(dir, rel string) error {
+	parts := strings.Split(rel, string(filepath.Separator))
+	path := dir
+	for _, p := range parts[:len(parts)-1] {
+		path = filepath.Join(path, p)
+		fi, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return &PathTraversalError{Name: rel}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+package hsup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type tarEntry struct {
+	hdr      tar.Header
+	contents string
+}
+
+func makeTar(t *testing.T, entries []tarEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.contents))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeTarGz(t *testing.T, entries []tarEntry) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(makeTar(t, entries))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+var testSlugEntries = []tarEntry{
+	{hdr: tar.Header{Name: "./app/", Typeflag: tar.TypeDir, Mode: 0755}},
+	{hdr: tar.Header{Name: "./app/bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+	{
+		hdr: tar.Header{Name: "./app/bin/web", Typeflag: tar.TypeReg,
+			Mode: 0750},
+		contents: "#!/bin/sh\necho hello\n",
+	},
+	{hdr: tar.Header{Name: "./app/web", Typeflag: tar.TypeSymlink,
+		Linkname: "bin/web"}},
+}
+
+func checkTestSlug(t *testing.T, dir string) {
+	fi, err := os.Stat(filepath.Join(dir, "bin", "web"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0750 {
+		t.Fatalf("expected mode 0750, got %v", fi.Mode())
+	}
+
+	link, err := os.Readlink(filepath.Join(dir, "web"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "bin/web" {
+		t.Fatalf("unexpected symlink target %q", link)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "web"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "#!/bin/sh\necho hello\n" {
+		t.Fatalf("unexpected contents %q", contents)
+	}
+}
+
+func TestExtractTarGz(t *testing.T) {
+	dir := newTmpDb(t)
+	defer os.RemoveAll(dir)
+
+	slug := makeTarGz(t, testSlugEntries)
+	err := extractSlug(bytes.NewReader(slug), SlugFormatTgz, dir,
+		SlugStripComponents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestSlug(t, dir)
+}
+
+func TestExtractTar(t *testing.T) {
+	dir := newTmpDb(t)
+	defer os.RemoveAll(dir)
+
+	// Without the "./app/" prefix.
+	var entries []tarEntry
+	for _, e := range testSlugEntries[1:] {
+		e.hdr.Name = strings.TrimPrefix(e.hdr.Name, "./app/")
+		entries = append(entries, e)
+	}
+
+	err := extractSlug(bytes.NewReader(makeTar(t, entries)),
+		SlugFormatTar, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestSlug(t, dir)
+}
+
+func TestExtractTarZstd(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd is not installed")
+	}
+
+	dir := newTmpDb(t)
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command("zstd", "-c", "-q")
+	cmd.Stdin = bytes.NewReader(makeTar(t, testSlugEntries))
+	slug, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = extractSlug(bytes.NewReader(slug), SlugFormatTarZstd, dir,
+		SlugStripComponents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestSlug(t, dir)
+}
+
+func TestUnpackSlugOCILayer(t *testing.T) {
+	layout := newTmpDb(t)
+	defer os.RemoveAll(layout)
+
+	var entries []tarEntry
+	for _, e := range testSlugEntries[1:] {
+		e.hdr.Name = strings.TrimPrefix(e.hdr.Name, "./")
+		entries = append(entries, e)
+	}
+	layer := makeTarGz(t, entries)
+	checksum := sha256Checksum(layer)
+
+	blobs := filepath.Join(layout, "blobs", "sha256")
+	if err := os.MkdirAll(blobs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	err := ioutil.WriteFile(filepath.Join(blobs,
+		strings.TrimPrefix(checksum, "sha256:")), layer, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(layout, "oci-layout"),
+		[]byte(`{"imageLayoutVersion": "1.0.0"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Layers are rooted at "/", so strip "app/" explicitly.
+	strip := 1
+	app := AppSerializable{
+		Slug:                layout,
+		SlugChecksum:        checksum,
+		SlugFormat:          SlugFormatOCILayer,
+		SlugStripComponents: &strip,
+	}
+	if err := app.Validate(Run, &AbsPathDynoDriver{}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := newTmpDb(t)
+	defer os.RemoveAll(dir)
+	hs := Startup{App: app}
+	if err := unpackSlug(hs.Procs().Rel, dir); err != nil {
+		t.Fatal(err)
+	}
+	checkTestSlug(t, dir)
+}
+
+func TestExtractTarGzRejectsTraversal(t *testing.T) {
+	for _, entries := range [][]tarEntry{
+		{{hdr: tar.Header{Name: "./app/../../evil",
+			Typeflag: tar.TypeReg, Mode: 0644}}},
+		{{hdr: tar.Header{Name: "./app/link", Typeflag: tar.TypeLink,
+			Linkname: "/etc/passwd"}}},
+		{
+			{hdr: tar.Header{Name: "./app/escape",
+				Typeflag: tar.TypeSymlink, Linkname: "/tmp"}},
+			{hdr: tar.Header{Name: "./app/escape/evil",
+				Typeflag: tar.TypeReg, Mode: 0644}},
+		},
+	} {
+		dir := newTmpDb(t)
+		defer os.RemoveAll(dir)
+
+		err := extractSlug(bytes.NewReader(makeTarGz(t, entries)),
+			SlugFormatTgz, dir, SlugStripComponents)
+		if _, ok := err.(*PathTraversalError); !ok {
+			t.Fatalf("expected a path traversal error for %q, got %v",
+				entries[len(entries)-1].hdr.Name, err)
+		}
+	}
+}
+
+func TestExtractTarGzKeepsDirectoriesBehindSymlinks(t *testing.T) {
+	outside := newTmpDb(t)
+	defer os.RemoveAll(outside)
+	if err := os.Chmod(outside, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		entries   []tarEntry
+		traversal bool
+	}{
+		// A directory entry through a symbolic link to outside.
+		{
+			entries: []tarEntry{
+				{hdr: tar.Header{Name: "./app/escape",
+					Typeflag: tar.TypeSymlink, Linkname: outside}},
+				{hdr: tar.Header{Name: "./app/escape/",
+					Typeflag: tar.TypeDir, Mode: 0777}},
+			},
+			traversal: true,
+		},
+		// A directory entry later replaced by such a link, which
+		// is fine as long as its mode is not applied through it.
+		{
+			entries: []tarEntry{
+				{hdr: tar.Header{Name: "./app/escape/",
+					Typeflag: tar.TypeDir, Mode: 0777}},
+				{hdr: tar.Header{Name: "./app/escape",
+					Typeflag: tar.TypeSymlink, Linkname: outside}},
+			},
+		},
+	} {
+		dir := newTmpDb(t)
+		defer os.RemoveAll(dir)
+
+		err := extractSlug(bytes.NewReader(makeTarGz(t, tt.entries)),
+			SlugFormatTgz, dir, SlugStripComponents)
+		if _, ok := err.(*PathTraversalError); ok != tt.traversal {
+			t.Fatalf("unexpected error %v", err)
+		}
+		fi, err := os.Stat(outside)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0700 {
+			t.Fatalf("expected %s to keep mode 0700, got %v",
+				outside, fi.Mode())
+		}
+	}
+}
+
+func TestUnpackSlugStreams(t *testing.T) {
+	cache := newTmpDb(t)
+	defer os.RemoveAll(cache)
+	os.Setenv("HSUP_SLUG_CACHE_DIR", cache)
+	defer os.Unsetenv("HSUP_SLUG_CACHE_DIR")
+
+	slug := makeTarGz(t, testSlugEntries)
+	var requests int
+	srv := slugServer(slug, &requests)
+	defer srv.Close()
+
+	dir := newTmpDb(t)
+	defer os.RemoveAll(dir)
+	release := &Release{
+		slugURL:      srv.URL,
+		slugChecksum: sha256Checksum(slug),
+		slugFormat:   SlugFormatTgz,
+		slugStrip:    SlugStripComponents,
+	}
+	if err := unpackSlug(release, dir); err != nil {
+		t.Fatal(err)
+	}
+	checkTestSlug(t, dir)
+
+	if entries, _ := ioutil.ReadDir(cache); len(entries) != 0 {
+		t.Fatalf("expected the slug not to be written to the cache, "+
+			"got %d entries", len(entries))
+	}
+}
+
+func TestUnpackSlugRejectsChecksumMismatch(t *testing.T) {
+	cache := newTmpDb(t)
+	defer os.RemoveAll(cache)
+	os.Setenv("HSUP_SLUG_CACHE_DIR", cache)
+	defer os.Unsetenv("HSUP_SLUG_CACHE_DIR")
+
+	var requests int
+	srv := slugServer(makeTarGz(t, testSlugEntries), &requests)
+	defer srv.Close()
+
+	dir := newTmpDb(t)
+	defer os.RemoveAll(dir)
+	release := &Release{
+		slugURL:      srv.URL,
+		slugChecksum: sha256Checksum([]byte("another slug")),
+		slugFormat:   SlugFormatTgz,
+		slugStrip:    SlugStripComponents,
+	}
+	err := unpackSlug(release, dir)
+	if _, ok := err.(*ChecksumMismatchError); !ok {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+}
@@ -5,7 +5,9 @@ package hsup
 import (
 	"bufio"
 	"compress/gzip"
+	"crypto/md5"
 	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -16,17 +18,17 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"syscall"
 
 	"github.com/htcat/htcat"
-	"gopkg.in/yaml.v2"
 )
 
-const (
-	// currently available versions of Heroku stack images
-	HerokuStacksManifestURL = "manifest.yml"
-)
+// HerokuStacksManifestURL is the default source of the stacks
+// manifest: the manifest.yml file seeded in the stacks directory, or
+// last fetched into it.  See StacksManifest.
+const HerokuStacksManifestURL = stacksManifestCache
 
 // HerokuStackImage models stack images as they are distributed by Heroku:
 // binary disk images, usually intended to be mounted on loopback devices.
@@ -37,75 +39,146 @@ const (
 // Support for Heroku stack images is currently only enabled when building for
 // Linux, because these images are currently only used by the libcontainer
 // driver.
+//
+// An image with a Path is a local one, mounted in place rather than
+// downloaded.
 type HerokuStackImage struct {
 	Name    string
 	Version string
-	URL     string `yaml:"url"`
-	Md5     string
-	Primary bool
+	URL     string `yaml:"url,omitempty"`
+	Md5     string `yaml:"md5,omitempty"`
+	Primary bool   `yaml:"primary,omitempty"`
+	Path    string `yaml:"path,omitempty"`
 
 	basedir string
 }
 
+// HerokuStacksFromManifest reads the stack images of the manifest of
+// a stacks directory, see DefaultStacksManifest.
 func HerokuStacksFromManifest(stacksDir string) ([]HerokuStackImage, error) {
-	manifest, err := fetchStacksManifestWithCache(stacksDir)
+	m, err := DefaultStacksManifest(stacksDir)
 	if err != nil {
 		return nil, err
 	}
-	var stacks []HerokuStackImage
-	if err := yaml.Unmarshal(manifest, &stacks); err != nil {
-		return nil, err
-	}
-	for i := range stacks {
-		stacks[i].basedir = stacksDir
-	}
-	return stacks, nil
+	return m.Stacks()
 }
 
-func fetchStacksManifestWithCache(stacksDir string) ([]byte, error) {
-	cached := filepath.Join(stacksDir, "manifest.yml")
-	if _, err := os.Stat(cached); err == nil {
-		return ioutil.ReadFile(cached)
-	}
-	manifest, err := fetchStacksManifest()
+// CurrentStackImagePath returns the directory of the latest version of
+// a stack image on the host.
+func CurrentStackImagePath(stacksDir, name string) (string, error) {
+	// TODO: check if it is really mounted
+	names, err := filepath.Glob(filepath.Join(stacksDir, name+"-*"))
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	err = ioutil.WriteFile(cached, manifest, 0644)
-	return manifest, err
-}
 
-func fetchStacksManifest() ([]byte, error) {
-	resp, err := http.Get(HerokuStacksManifestURL)
-	if err != nil {
-		return nil, err
+	var dirs []string
+	for _, n := range names {
+		// Skip images, locks and downloads in progress, which
+		// are files rather than mount points.
+		if fi, err := os.Stat(n); err == nil && fi.IsDir() {
+			dirs = append(dirs, n)
+		}
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf(
-			"invalid stacks manifest at %q",
-			HerokuStacksManifestURL,
-		)
+	if len(dirs) == 0 {
+		return "", errors.New("no matching stack image found")
 	}
-	return ioutil.ReadAll(resp.Body)
+
+	prefix := filepath.Join(stacksDir, name+"-")
+	sort.Sort(byStackVersion{dirs, func(dir string) string {
+		return strings.TrimPrefix(dir, prefix)
+	}})
+	return dirs[len(dirs)-1], nil
 }
 
-func CurrentStackImagePath(stacksDir, name string) (string, error) {
-	// TODO: check if it is really mounted
-	// TODO: order by version numbers and pick the last
-	names, err := filepath.Glob(filepath.Join(stacksDir, name+"-*"))
-	if err != nil {
-		return "", err
+// SelectStackImage picks the image of a stack to run on from the
+// manifest: the given version if there is one, or else the image
+// marked primary, or else the latest version.
+func SelectStackImage(stacks []HerokuStackImage, name, version string) (
+	*HerokuStackImage, error) {
+	var candidates []string
+	byVersion := make(map[string]*HerokuStackImage)
+	for i := range stacks {
+		img := &stacks[i]
+		if strings.TrimSpace(img.Name) != name {
+			continue
+		}
+		if version != "" && img.Version == version {
+			return img, nil
+		}
+		if version == "" && img.Primary {
+			return img, nil
+		}
+		candidates = append(candidates, img.Version)
+		byVersion[img.Version] = img
 	}
-	last := len(names) - 1
-	for i := range names {
-		n := names[last-i]
-		if !strings.HasSuffix(n, ".img") {
-			return n, nil
+
+	switch {
+	case version != "":
+		return nil, fmt.Errorf("stack %q has no image of version %q",
+			name, version)
+	case len(candidates) == 0:
+		return nil, fmt.Errorf("stack %q is not in the manifest", name)
+	}
+	sort.Sort(byStackVersion{candidates, nil})
+	return byVersion[candidates[len(candidates)-1]], nil
+}
+
+// compareStackVersions orders versions like "v9" and "v10" naturally:
+// runs of digits compare as numbers, everything else as text.
+func compareStackVersions(a, b string) int {
+	for a != "" && b != "" {
+		var ca, cb string
+		ca, a = versionChunk(a)
+		cb, b = versionChunk(b)
+
+		if isDigit(ca[0]) && isDigit(cb[0]) {
+			ca = strings.TrimLeft(ca, "0")
+			cb = strings.TrimLeft(cb, "0")
+			if len(ca) != len(cb) {
+				if len(ca) < len(cb) {
+					return -1
+				}
+				return 1
+			}
+		}
+		if c := strings.Compare(ca, cb); c != 0 {
+			return c
 		}
 	}
+	return strings.Compare(a, b)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
 
-	return "", errors.New("no matching stack image found")
+// versionChunk splits off the leading run of either digits or other
+// characters.
+func versionChunk(v string) (chunk, rest string) {
+	digits := isDigit(v[0])
+	i := 1
+	for i < len(v) && isDigit(v[i]) == digits {
+		i++
+	}
+	return v[:i], v[i:]
+}
+
+// byStackVersion sorts strings by the stack version extracted from
+// them, or by themselves if version is nil.
+type byStackVersion struct {
+	s       []string
+	version func(string) string
+}
+
+func (b byStackVersion) Len() int      { return len(b.s) }
+func (b byStackVersion) Swap(i, j int) { b.s[i], b.s[j] = b.s[j], b.s[i] }
+func (b byStackVersion) Less(i, j int) bool {
+	vi, vj := b.s[i], b.s[j]
+	if b.version != nil {
+		vi, vj = b.version(vi), b.version(vj)
+	}
+	return compareStackVersions(vi, vj) < 0
 }
 
 func (img *HerokuStackImage) Dir() string {
@@ -116,13 +189,42 @@ func (img *HerokuStackImage) Filename() string {
 	return img.Dir() + ".img"
 }
 
-//TODO: avoid multiple processes trying to mount the same stack image
-func (img *HerokuStackImage) mount() error {
+// imageFilename is the image to mount: Filename, or Path for a local
+// image.
+func (img *HerokuStackImage) imageFilename() string {
+	if img.Path != "" {
+		return img.Path
+	}
+	return img.Filename()
+}
+
+func (img *HerokuStackImage) lockFilename() string {
+	return img.Dir() + ".lock"
+}
+
+// mount fetches the stack image if needed and mounts it read-only onto
+// Dir.  Other hsup processes on the host wait for whichever of them
+// gets to do so first.
+func (img *HerokuStackImage) mount() (err error) {
 	var (
-		imgFile = img.Filename()
+		imgFile = img.imageFilename()
 		imgDir  = img.Dir()
 	)
+	lock, err := LockFile(img.lockFilename(),
+		fmt.Sprintf("stack image %s-%s", img.Name, img.Version))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if uerr := lock.Unlock(); err == nil {
+			err = uerr
+		}
+	}()
+
 	if _, err := os.Stat(imgFile); err != nil {
+		if img.Path != "" {
+			return err
+		}
 		if err := img.fetch(); err != nil {
 			return err
 		}
@@ -151,60 +253,484 @@ func (img *HerokuStackImage) mount() error {
 
 }
 
+// unpack copies the files of the stack image into its directory, once,
+// rather than mounting it, which hsup can only do as root.  debugfs,
+// from e2fsprogs, reads the image without mounting it.
+func (img *HerokuStackImage) unpack() (err error) {
+	var (
+		imgFile = img.imageFilename()
+		imgDir  = img.Dir()
+	)
+	lock, err := LockFile(img.lockFilename(),
+		fmt.Sprintf("stack image %s-%s", img.Name, img.Version))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if uerr := lock.Unlock(); err == nil {
+			err = uerr
+		}
+	}()
+
+	if _, err := os.Stat(imgDir); err == nil {
+		return nil // already unpacked
+	}
+	if _, err := os.Stat(imgFile); err != nil {
+		if img.Path != "" {
+			return err
+		}
+		if err := img.fetch(); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Unpacking stack image %q into %q", imgFile, imgDir)
+	tmp := imgDir + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+	// rdump dumps directories by name into its destination: the
+	// root directory is dumped entry by entry.
+	ls, err := exec.Command("debugfs", "-R", "ls -p /", imgFile).Output()
+	if err != nil {
+		return err
+	}
+	out, err := exec.Command("debugfs", "-R", fmt.Sprintf(
+		"rdump %s %s", strings.Join(debugfsEntries(ls), " "), tmp,
+	), imgFile).CombinedOutput()
+	if err != nil {
+		log.Println(string(out))
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, imgDir); err != nil {
+		return err
+	}
+	return img.addMissingDirectories()
+}
+
+// debugfsEntries returns the paths of the entries listed by debugfs
+// "ls -p /", one "/inode/mode/uid/gid/name/size/" line each.
+func debugfsEntries(ls []byte) []string {
+	var entries []string
+	for _, line := range strings.Split(string(ls), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "/")
+		if len(fields) < 7 {
+			continue
+		}
+		if name := fields[5]; name != "." && name != ".." && name != "" {
+			entries = append(entries, "/"+name)
+		}
+	}
+	return entries
+}
+
 // addMissingDirectories is required until https://github.com/heroku/stack-images/pull/13
 // gets merged.
 func (img *HerokuStackImage) addMissingDirectories() error {
 	return os.MkdirAll(filepath.Join(img.Dir(), "sys"), 0755)
 }
 
-//TODO: avoid multiple processes trying to fetch the same stack image
+// StackImageChecksumError is returned when a downloaded stack image
+// does not have the MD5 digest listed in the manifest.
+type StackImageChecksumError struct {
+	Name     string
+	Expected string
+	Actual   string
+}
+
+func (e *StackImageChecksumError) Error() string {
+	return fmt.Sprintf("stack image %q has MD5 %s, expected %s",
+		e.Name, e.Actual, e.Expected)
+}
+
+func (img *HerokuStackImage) partialFilename() string {
+	return img.Filename() + ".gz.part"
+}
+
+// fetch downloads the stack image and decompresses it.  The image only
+// appears under Filename once it is complete and verified, so that an
+// interrupted download is never mistaken for a usable image; the
+// download itself is resumed from where it stopped.  It is only
+// called with the lock of the stack image held, see mount.
 func (img *HerokuStackImage) fetch() error {
-	log.Printf("Downloading stack image %q. This may take a while...", img.Name)
-	// TODO check md5
-	pr, pw := io.Pipe()
-	defer pr.Close()
+	part := img.partialFilename()
+	if err := img.download(part); err != nil {
+		return err
+	}
+	if err := img.verify(part); err != nil {
+		// Start over next time: resuming would only append
+		// to the corrupt download.
+		os.Remove(part)
+		return err
+	}
+
+	tmp := img.Filename() + ".tmp"
+	if err := gunzipFile(part, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, img.Filename()); err != nil {
+		return err
+	}
+	log.Println("Stack image download finished")
+	return os.Remove(part)
+}
 
+func (img *HerokuStackImage) client(u *url.URL) *http.Client {
+	client := *http.DefaultClient
+	if u.Scheme == "https" {
+		client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{},
+		}
+	}
+	return &client
+}
+
+// download fetches the compressed stack image into part, appending to
+// whatever an earlier attempt left there.
+func (img *HerokuStackImage) download(part string) error {
 	u, err := url.Parse(img.URL)
 	if err != nil {
 		return err
 	}
 
-	// buffered channel: avoid blocking the writer goroutine
-	dlResult := make(chan error, 1)
-	go func() {
-		// close the pipe as soon as the download finishes so readers receive EOF
-		defer pw.Close()
-		client := *http.DefaultClient
-		if u.Scheme == "https" {
-			client.Transport = &http.Transport{
-				TLSClientConfig: &tls.Config{},
-			}
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme == "file" {
+		return img.copyFrom(u.Path, f, fi.Size())
+	}
+
+	if fi.Size() == 0 {
+		log.Printf("Downloading stack image %q. This may take a while...",
+			img.Name)
+		// buffer the download in case the disk can't keep up
+		w := bufio.NewWriter(f)
+		if _, err := htcat.New(img.client(u), u, 5).WriteTo(w); err != nil {
+			return err
 		}
-		// buffer the download in case gunzip can't keep up
-		w := bufio.NewWriter(pw)
-		_, err := htcat.New(&client, u, 5).WriteTo(w)
-		w.Flush()
-		dlResult <- err
-	}()
+		return w.Flush()
+	}
+
+	log.Printf("Resuming download of stack image %q at byte %d",
+		img.Name, fi.Size())
+	req, err := http.NewRequest("GET", img.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", fi.Size()))
+	resp, err := img.client(u).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Already complete.
+		return nil
+	case http.StatusOK:
+		// The server ignores ranges: start over.
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("could not fetch stack image %q: %s",
+			img.URL, resp.Status)
+	}
+
+	_, err = io.Copy(f, resp.Body)
+	return err
+}
+
+// copyFrom copies a local compressed stack image into part, from
+// offset on.
+func (img *HerokuStackImage) copyFrom(path string, part *os.File,
+	offset int64) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	log.Printf("Copying stack image %q from %q", img.Name, path)
+	if _, err := src.Seek(offset, os.SEEK_SET); err != nil {
+		return err
+	}
+	_, err = io.Copy(part, src)
+	return err
+}
 
-	r, err := gzip.NewReader(pr)
+// verify checks a downloaded, still compressed, stack image against
+// the MD5 digest of the manifest, if there is one.
+func (img *HerokuStackImage) verify(path string) error {
+	if img.Md5 == "" {
+		log.Printf("No MD5 for stack image %q, not verifying it",
+			img.Name)
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	actual := hex.EncodeToString(h.Sum(nil))
+	if expected := strings.ToLower(img.Md5); actual != expected {
+		return &StackImageChecksumError{
+			Name:     img.Name,
+			Expected: expected,
+			Actual:   actual,
+		}
+	}
+	return nil
+}
+
+func gunzipFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	r, err := gzip.NewReader(in)
 	if err != nil {
 		return err
 	}
 	defer r.Close()
 
-	imageFile, err := os.Create(img.Filename())
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
-	defer imageFile.Close()
-	if err := imageFile.Chmod(0644); err != nil {
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	if _, err := io.Copy(out, r); err != nil {
 		return err
 	}
+	return out.Sync()
+}
 
-	if _, err := io.Copy(imageFile, r); err != nil {
+// stackImageUseFile is written into the data directory of every
+// libcontainer dyno, naming the stack image it runs on.
+const stackImageUseFile = "stack-image"
+
+// useStackImage records that the dyno with the given data directory
+// runs on the stack image mounted at dir.  This happens with the lock
+// of the stack image held, so that it can't be garbage collected
+// meanwhile.
+func useStackImage(dir, dataPath string) (err error) {
+	lock, err := LockFile(dir+".lock", "stack image "+filepath.Base(dir))
+	if err != nil {
 		return err
 	}
-	log.Println("Stack image download finished")
-	return <-dlResult
+	defer func() {
+		if uerr := lock.Unlock(); err == nil {
+			err = uerr
+		}
+	}()
+
+	if contents, err := ioutil.ReadDir(dir); err != nil {
+		return err
+	} else if len(contents) == 0 {
+		return fmt.Errorf("stack image %q is not mounted", dir)
+	}
+	return ioutil.WriteFile(filepath.Join(dataPath, stackImageUseFile),
+		[]byte(dir), 0644)
+}
+
+// stackImagesInUse returns the stack image directories that dynos
+// currently run on.
+func stackImagesInUse(containersDir string) (map[string]bool, error) {
+	uses, err := filepath.Glob(filepath.Join(containersDir, "*",
+		stackImageUseFile))
+	if err != nil {
+		return nil, err
+	}
+
+	inUse := make(map[string]bool)
+	for _, use := range uses {
+		dir, err := ioutil.ReadFile(use)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		inUse[string(dir)] = true
+	}
+	return inUse, nil
+}
+
+// GCStackImages unmounts and deletes the stack images in a libcontainer
+// work directory that no dyno runs on, except for the one of each
+// stack that new dynos would be started on.  Only what hsup made of
+// the stacks of the manifest is removed: entries named after a version
+// of one of them, either image files or directories it locked, and
+// never what the manifest is read from.  It returns the names of the
+// images removed.
+func GCStackImages(workDir string) ([]string, error) {
+	var (
+		stacksDir     = filepath.Join(workDir, "stacks")
+		containersDir = filepath.Join(workDir, "containers")
+	)
+
+	m, err := DefaultStacksManifest(stacksDir)
+	if err != nil {
+		return nil, err
+	}
+	stacks, err := m.Stacks()
+	if err != nil {
+		return nil, err
+	}
+	keep := make(map[string]bool)
+	var names []string
+	for _, stack := range stacks {
+		name := strings.TrimSpace(stack.Name)
+		img, err := SelectStackImage(stacks, name, "")
+		if err != nil {
+			return nil, err
+		}
+		keep[img.Dir()] = true
+		names = append(names, name)
+	}
+	sources := m.sourcePaths(stacks)
+
+	entries, err := ioutil.ReadDir(stacksDir)
+	if err != nil {
+		return nil, err
+	}
+	candidates := make(map[string]bool)
+	for _, fi := range entries {
+		name := fi.Name()
+		for _, suffix := range []string{".img", ".img.gz.part",
+			".img.tmp"} {
+			name = strings.TrimSuffix(name, suffix)
+		}
+		dir := filepath.Join(stacksDir, name)
+		switch {
+		case !isStackImageName(name, names):
+		case name != fi.Name():
+			candidates[dir] = true
+		case fi.IsDir():
+			if _, err := os.Stat(dir + ".lock"); err == nil {
+				candidates[dir] = true
+			}
+		}
+	}
+
+	var removed []string
+	for dir := range candidates {
+		if keep[dir] {
+			continue
+		}
+		ok, err := removeStackImage(dir, containersDir, sources)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed = append(removed, filepath.Base(dir))
+		}
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
+
+// isStackImageName reports whether name is "STACK-VERSION" for one of
+// the stacks.
+func isStackImageName(name string, stacks []string) bool {
+	for _, stack := range stacks {
+		if strings.HasPrefix(name, stack+"-") &&
+			len(name) > len(stack)+1 {
+			return true
+		}
+	}
+	return false
+}
+
+// pathsOverlap reports whether a and b are the same path, or one is
+// within the other.
+func pathsOverlap(a, b string) bool {
+	a, b = filepath.Clean(a), filepath.Clean(b)
+	sep := string(filepath.Separator)
+	return a == b || strings.HasPrefix(a, b+sep) ||
+		strings.HasPrefix(b, a+sep)
+}
+
+// stackImagePaths returns what a stack image at dir is made of.
+func stackImagePaths(dir string) []string {
+	return []string{dir, dir + ".img", dir + ".img.gz.part",
+		dir + ".img.tmp"}
+}
+
+// removeStackImage unmounts and deletes the stack image at dir unless
+// a dyno uses it, or it is one of the sources of the manifest, and
+// reports whether it did.
+func removeStackImage(dir, containersDir string, sources []string) (
+	removed bool, err error) {
+	for _, path := range stackImagePaths(dir) {
+		if isSource(path, sources) {
+			return false, nil
+		}
+	}
+
+	lock, err := LockFile(dir+".lock", "stack image "+filepath.Base(dir))
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if uerr := lock.Unlock(); err == nil {
+			err = uerr
+		}
+	}()
+
+	inUse, err := stackImagesInUse(containersDir)
+	if err != nil || inUse[dir] {
+		return false, err
+	}
+
+	log.Printf("Removing stack image %q", dir)
+	// EINVAL means that the image is not mounted, and EPERM that
+	// hsup runs unprivileged, with unpacked images.
+	err = syscall.Unmount(dir, 0)
+	if err != nil && err != syscall.EINVAL && err != syscall.ENOENT &&
+		err != syscall.EPERM {
+		return false, err
+	}
+	for _, path := range stackImagePaths(dir) {
+		if err := os.RemoveAll(path); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// isSource reports whether path is, holds or is within one of the
+// sources of a stacks manifest.
+func isSource(path string, sources []string) bool {
+	for _, source := range sources {
+		if pathsOverlap(path, source) {
+			return true
+		}
+	}
+	return false
 }
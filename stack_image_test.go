@@ -0,0 +1,255 @@
+// +build linux
+
+package hsup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func gzipped(t *testing.T, contents []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(contents)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func stackImageServer(download []byte, ranges *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			*ranges = append(*ranges, r.Header.Get("Range"))
+			http.ServeContent(w, r, "cedar.img.gz", time.Time{},
+				bytes.NewReader(download))
+		}))
+}
+
+func TestStackImageFetchResumes(t *testing.T) {
+	dir := newTmpDb(t)
+	defer os.RemoveAll(dir)
+
+	contents := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(contents)
+	download := gzipped(t, contents)
+	sum := md5.Sum(download)
+
+	var ranges []string
+	srv := stackImageServer(download, &ranges)
+	defer srv.Close()
+
+	img := &HerokuStackImage{
+		Name:    "cedar-14",
+		Version: "v1",
+		URL:     srv.URL,
+		Md5:     hex.EncodeToString(sum[:]),
+		basedir: dir,
+	}
+
+	// An earlier, interrupted, download.
+	half := len(download) / 2
+	err := ioutil.WriteFile(img.partialFilename(), download[:half], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := img.fetch(); err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 1 || ranges[0] != fmt.Sprintf("bytes=%d-", half) {
+		t.Fatalf("expected the download to be resumed, got ranges %q",
+			ranges)
+	}
+
+	got, err := ioutil.ReadFile(img.Filename())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Fatal("unexpected stack image contents")
+	}
+	if _, err := os.Stat(img.partialFilename()); !os.IsNotExist(err) {
+		t.Fatal("expected the partial download to be removed")
+	}
+}
+
+func TestStackImageFetchRejectsBadMd5(t *testing.T) {
+	dir := newTmpDb(t)
+	defer os.RemoveAll(dir)
+
+	var ranges []string
+	srv := stackImageServer(gzipped(t, []byte("stack image")), &ranges)
+	defer srv.Close()
+
+	img := &HerokuStackImage{
+		Name:    "cedar-14",
+		Version: "v1",
+		URL:     srv.URL,
+		Md5:     strings.Repeat("0", 32),
+		basedir: dir,
+	}
+
+	err := img.fetch()
+	if _, ok := err.(*StackImageChecksumError); !ok {
+		t.Fatalf("expected a checksum error, got %v", err)
+	}
+	for _, path := range []string{img.Filename(), img.partialFilename()} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected %q not to exist", path)
+		}
+	}
+}
+
+func TestCompareStackVersions(t *testing.T) {
+	for _, c := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"v9", "v10", -1},
+		{"v10", "v9", 1},
+		{"v10", "v10", 0},
+		{"v010", "v10", 0},
+		{"20150101", "20141231", 1},
+		{"v1.2", "v1.10", -1},
+		{"v1", "v1.1", -1},
+		{"beta", "v1", -1},
+	} {
+		if actual := compareStackVersions(c.a, c.b); actual != c.expected {
+			t.Errorf("compare %q to %q: expected %d, got %d",
+				c.a, c.b, c.expected, actual)
+		}
+	}
+}
+
+func TestDebugfsEntries(t *testing.T) {
+	ls := []byte(
+		"/2/040755/0/0/./4096/\n" +
+			"/2/040755/0/0/../4096/\n" +
+			"/11/040700/0/0/lost+found/16384/\n" +
+			"/12/040755/0/0/bin/4096/\n" +
+			"/13/120777/0/0/lib64/9/\n")
+	expected := []string{"/lost+found", "/bin", "/lib64"}
+	if entries := debugfsEntries(ls); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expected %q, got %q", expected, entries)
+	}
+}
+
+func TestSelectStackImage(t *testing.T) {
+	stacks := []HerokuStackImage{
+		{Name: "cedar-14", Version: "v10"},
+		{Name: "cedar-14", Version: "v9"},
+		{Name: "cedar-14", Version: "v11"},
+		{Name: "cedar", Version: "v3", Primary: true},
+		{Name: "cedar", Version: "v4"},
+	}
+
+	for _, c := range []struct {
+		name, version, expected string
+	}{
+		{"cedar-14", "", "v11"},
+		{"cedar-14", "v9", "v9"},
+		{"cedar", "", "v3"},
+		{"cedar", "v4", "v4"},
+	} {
+		img, err := SelectStackImage(stacks, c.name, c.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Name != c.name || img.Version != c.expected {
+			t.Errorf("select %s %q: expected %s, got %s %s",
+				c.name, c.version, c.expected, img.Name,
+				img.Version)
+		}
+	}
+
+	if _, err := SelectStackImage(stacks, "cedar-14", "v1"); err == nil {
+		t.Fatal("expected an unknown version to be rejected")
+	}
+}
+
+func TestCurrentStackImagePathOrdersVersions(t *testing.T) {
+	dir := newTmpDb(t)
+	defer os.RemoveAll(dir)
+
+	for _, v := range []string{"v9", "v10", "v2"} {
+		os.Mkdir(filepath.Join(dir, "cedar-14-"+v), 0755)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "cedar-14-v11.img"), nil, 0644)
+
+	path, err := CurrentStackImagePath(dir, "cedar-14")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := filepath.Join(dir, "cedar-14-v10"); path != expected {
+		t.Fatalf("expected %q, got %q", expected, path)
+	}
+}
+
+func TestGCStackImages(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("unmounting stack images requires root")
+	}
+
+	work := newTmpDb(t)
+	defer os.RemoveAll(work)
+	stacks := filepath.Join(work, "stacks")
+	inUse := filepath.Join(work, "containers", "some-uuid")
+	os.MkdirAll(inUse, 0755)
+	os.MkdirAll(stacks, 0755)
+
+	err := ioutil.WriteFile(filepath.Join(stacks, "manifest.yml"),
+		[]byte("- name: cedar-14\n  version: v3\n"+
+			"- name: cedar-14\n  version: v2\n"+
+			"- name: cedar-14\n  version: v1\n"+
+			"- name: cedar-14\n  version: v0.5\n"+
+			"  path: cedar-14-src.img\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"v1", "v2", "v3"} {
+		base := filepath.Join(stacks, "cedar-14-"+v)
+		os.Mkdir(base, 0755)
+		ioutil.WriteFile(base+".img", nil, 0644)
+	}
+	ioutil.WriteFile(filepath.Join(stacks, "cedar-14-v0.img.gz.part"),
+		nil, 0644)
+	ioutil.WriteFile(filepath.Join(inUse, stackImageUseFile),
+		[]byte(filepath.Join(stacks, "cedar-14-v2")), 0644)
+
+	// An image unpacked by hsup, which locked it, a local image the
+	// manifest points at, and directories of the operator.
+	os.Mkdir(filepath.Join(stacks, "cedar-14-old"), 0755)
+	ioutil.WriteFile(filepath.Join(stacks, "cedar-14-old.lock"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(stacks, "cedar-14-src.img"), nil, 0644)
+	os.Mkdir(filepath.Join(stacks, "cedar-14-images"), 0755)
+	os.Mkdir(filepath.Join(stacks, "images"), 0755)
+
+	removed, err := GCStackImages(work)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"cedar-14-old", "cedar-14-v0", "cedar-14-v1"}
+	if !reflect.DeepEqual(removed, expected) {
+		t.Fatalf("unexpected removed stack images %v", removed)
+	}
+	for _, name := range []string{"cedar-14-v2.img", "cedar-14-v3.img",
+		"cedar-14-src.img", "cedar-14-images", "images"} {
+		if _, err := os.Stat(filepath.Join(stacks, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
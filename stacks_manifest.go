@@ -0,0 +1,387 @@
+// +build linux
+
+package hsup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// DefaultStacksManifestTTL is how long a stacks manifest fetched
+	// over HTTP is used before fetching it again.
+	DefaultStacksManifestTTL = 24 * time.Hour
+
+	// stacksManifestCache is where the last stacks manifest fetched
+	// over HTTP is kept in the stacks directory.  It doubles as the
+	// default, local, manifest.
+	stacksManifestCache = "manifest.yml"
+
+	// localStacksFile lists the stack images registered by path,
+	// see RegisterStackImage.
+	localStacksFile = "local.yml"
+)
+
+// StacksManifest lists the stack images dynos can run on.  Its Source
+// is either an HTTP(S) URL, fetched again once TTL expires, a
+// "file://" URL or path of a manifest file, or a directory of stack
+// images.  A path that is not absolute is relative to the stacks
+// directory Dir, where stack images are kept.  Local sources are read
+// every time, so that hosts without network access can be seeded with
+// stacks from local files.
+type StacksManifest struct {
+	Source string
+	TTL    time.Duration
+	Dir    string
+}
+
+// DefaultStacksManifest returns the stacks manifest of a stacks
+// directory.  HSUP_STACKS_MANIFEST and HSUP_STACKS_MANIFEST_TTL
+// override its source and TTL, a TTL of 0 meaning that a fetched
+// manifest is used forever.
+func DefaultStacksManifest(stacksDir string) (*StacksManifest, error) {
+	m := &StacksManifest{
+		Source: os.Getenv("HSUP_STACKS_MANIFEST"),
+		TTL:    DefaultStacksManifestTTL,
+		Dir:    stacksDir,
+	}
+	if m.Source == "" {
+		m.Source = HerokuStacksManifestURL
+	}
+
+	if ttl := os.Getenv("HSUP_STACKS_MANIFEST_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HSUP_STACKS_MANIFEST_TTL "+
+				"%q: %v", ttl, err)
+		}
+		m.TTL = d
+	}
+	return m, nil
+}
+
+// remote returns the URL of a manifest fetched over HTTP, or nil for
+// a local one.
+func (m *StacksManifest) remote() *url.URL {
+	u, err := url.Parse(m.Source)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil
+	}
+	return u
+}
+
+// localPath returns the path of a local manifest file or directory.
+func (m *StacksManifest) localPath() string {
+	path := strings.TrimPrefix(m.Source, "file://")
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(m.Dir, path)
+	}
+	return path
+}
+
+func (m *StacksManifest) cacheFilename() string {
+	return filepath.Join(m.Dir, stacksManifestCache)
+}
+
+// Stacks reads the stack images of the manifest, along with those
+// registered by path in the stacks directory.
+func (m *StacksManifest) Stacks() ([]HerokuStackImage, error) {
+	var (
+		stacks []HerokuStackImage
+		err    error
+	)
+	if u := m.remote(); u != nil {
+		stacks, err = m.readRemote(u, false)
+	} else {
+		stacks, err = m.readLocal()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	local, err := readStacksFile(filepath.Join(m.Dir, localStacksFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	stacks = mergeStacks(stacks, local)
+
+	for i := range stacks {
+		stacks[i].basedir = m.Dir
+	}
+	return stacks, nil
+}
+
+// Refresh fetches the manifest again even though its TTL has not
+// expired yet.  Local manifests are only checked.
+func (m *StacksManifest) Refresh() ([]HerokuStackImage, error) {
+	if u := m.remote(); u != nil {
+		if _, err := m.readRemote(u, true); err != nil {
+			return nil, err
+		}
+	}
+	return m.Stacks()
+}
+
+// readRemote returns the cached manifest unless it expired, or force
+// is set.  Unless forced, a manifest that can't be fetched falls back
+// to the cached one, however old.
+func (m *StacksManifest) readRemote(u *url.URL, force bool) (
+	[]HerokuStackImage, error) {
+	cached := m.cacheFilename()
+	fi, statErr := os.Stat(cached)
+	fresh := statErr == nil &&
+		(m.TTL == 0 || time.Since(fi.ModTime()) < m.TTL)
+	if fresh && !force {
+		return readStacksFile(cached)
+	}
+
+	manifest, err := fetchStacksManifest(u)
+	if err != nil {
+		if statErr != nil || force {
+			return nil, err
+		}
+		log.Printf("could not refresh stacks manifest, "+
+			"using the one fetched on %v: %v", fi.ModTime(), err)
+		return readStacksFile(cached)
+	}
+
+	var stacks []HerokuStackImage
+	if err := yaml.Unmarshal(manifest, &stacks); err != nil {
+		return nil, fmt.Errorf("invalid stacks manifest at %q: %v",
+			m.Source, err)
+	}
+
+	tmp := cached + ".tmp"
+	if err := ioutil.WriteFile(tmp, manifest, 0644); err != nil {
+		return nil, err
+	}
+	return stacks, os.Rename(tmp, cached)
+}
+
+func (m *StacksManifest) readLocal() ([]HerokuStackImage, error) {
+	path := m.localPath()
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return scanStackImages(path)
+	}
+
+	stacks, err := readStacksFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// Paths of local stack images are relative to the manifest.
+	for i := range stacks {
+		p := stacks[i].Path
+		if p != "" && !filepath.IsAbs(p) {
+			stacks[i].Path = filepath.Join(filepath.Dir(path), p)
+		}
+	}
+	return stacks, nil
+}
+
+func fetchStacksManifest(u *url.URL) ([]byte, error) {
+	resp, err := http.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(
+			"invalid stacks manifest at %q: %s",
+			u, resp.Status,
+		)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func readStacksFile(path string) ([]HerokuStackImage, error) {
+	manifest, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var stacks []HerokuStackImage
+	if err := yaml.Unmarshal(manifest, &stacks); err != nil {
+		return nil, fmt.Errorf("invalid stacks manifest %q: %v",
+			path, err)
+	}
+	return stacks, nil
+}
+
+// scanStackImages builds a manifest from the stack images in a
+// directory, named after their stack and version as in
+// "cedar-14-v10.img".  Images may be gzipped, with an optional MD5
+// digest in a ".md5" file next to them.
+func scanStackImages(dir string) ([]HerokuStackImage, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var stacks []HerokuStackImage
+	seen := make(map[string]bool)
+	for _, fi := range entries {
+		if fi.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, fi.Name())
+
+		var img HerokuStackImage
+		base := fi.Name()
+		switch {
+		case strings.HasSuffix(base, ".img"):
+			base = strings.TrimSuffix(base, ".img")
+			img.Path = path
+		case strings.HasSuffix(base, ".img.gz"):
+			base = strings.TrimSuffix(base, ".img.gz")
+			img.URL = "file://" + path
+			if sum, err := ioutil.ReadFile(path + ".md5"); err == nil {
+				if fields := strings.Fields(string(sum)); len(fields) > 0 {
+					img.Md5 = fields[0]
+				}
+			}
+		default:
+			continue
+		}
+
+		i := strings.LastIndex(base, "-")
+		if i <= 0 || i == len(base)-1 {
+			log.Printf("skipping stack image %q: not named "+
+				"STACK-VERSION", path)
+			continue
+		}
+		img.Name, img.Version = base[:i], base[i+1:]
+
+		// Prefer uncompressed images, which sort first.
+		if seen[base] {
+			continue
+		}
+		seen[base] = true
+		stacks = append(stacks, img)
+	}
+	return stacks, nil
+}
+
+// sourcePaths returns the local files and directories the manifest and
+// its stack images are read from, which are not hsup's to remove.
+func (m *StacksManifest) sourcePaths(stacks []HerokuStackImage) []string {
+	paths := []string{
+		m.cacheFilename(),
+		filepath.Join(m.Dir, localStacksFile),
+	}
+	if m.remote() == nil {
+		paths = append(paths, m.localPath())
+	}
+	for _, img := range stacks {
+		if img.Path != "" {
+			paths = append(paths, img.Path)
+		}
+		if u, err := url.Parse(img.URL); err == nil && u.Scheme == "file" {
+			paths = append(paths, u.Path, u.Path+".md5")
+		}
+	}
+	return paths
+}
+
+// mergeStacks adds the stack images of extra to stacks, replacing
+// those of the same name and version.
+func mergeStacks(stacks, extra []HerokuStackImage) []HerokuStackImage {
+	for _, img := range extra {
+		replaced := false
+		for i := range stacks {
+			if strings.TrimSpace(stacks[i].Name) == img.Name &&
+				stacks[i].Version == img.Version {
+				stacks[i] = img
+				replaced = true
+			}
+		}
+		if !replaced {
+			stacks = append(stacks, img)
+		}
+	}
+	return stacks
+}
+
+// RefreshStacksManifest fetches the stacks manifest of a libcontainer
+// work directory again, and returns the stack images it lists as
+// "name-version".
+func RefreshStacksManifest(workDir string) ([]string, error) {
+	m, err := DefaultStacksManifest(filepath.Join(workDir, "stacks"))
+	if err != nil {
+		return nil, err
+	}
+	stacks, err := m.Refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(stacks))
+	for i, img := range stacks {
+		names[i] = strings.TrimSpace(img.Name) + "-" + img.Version
+	}
+	return names, nil
+}
+
+// RegisterStackImage makes a locally built stack image available to
+// libcontainer dynos as the given version of a stack, in addition to
+// those of the manifest.  Uncompressed images are mounted in place;
+// gzipped ones, ending in ".gz", are decompressed into the stacks
+// directory first.
+func RegisterStackImage(workDir, name, version, path string) (err error) {
+	stacksDir := filepath.Join(workDir, "stacks")
+	if err := os.MkdirAll(stacksDir, 0755); err != nil {
+		return err
+	}
+
+	if path, err = filepath.Abs(path); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(path); err != nil {
+		return err
+	} else if fi.IsDir() {
+		return fmt.Errorf("stack image %q is a directory", path)
+	}
+	img := HerokuStackImage{Name: name, Version: version}
+	if strings.HasSuffix(path, ".gz") {
+		img.URL = "file://" + path
+	} else {
+		img.Path = path
+	}
+
+	localFile := filepath.Join(stacksDir, localStacksFile)
+	lock, err := LockFile(localFile+".lock", "local stack images")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if uerr := lock.Unlock(); err == nil {
+			err = uerr
+		}
+	}()
+
+	local, err := readStacksFile(localFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	out, err := yaml.Marshal(mergeStacks(local,
+		[]HerokuStackImage{img}))
+	if err != nil {
+		return err
+	}
+	tmp := localFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, out, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, localFile)
+}
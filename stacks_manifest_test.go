@@ -0,0 +1,169 @@
+// +build linux
+
+package hsup
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testStacksManifest = "- name: cedar-14\n  version: v1\n  url: http://example.com/cedar-14-v1.img.gz\n"
+
+func TestStacksManifestTTL(t *testing.T) {
+	dir := newTmpDb(t)
+	defer os.RemoveAll(dir)
+
+	hits, fail := 0, false
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			hits++
+			if fail {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(testStacksManifest))
+		}))
+	defer srv.Close()
+
+	m := &StacksManifest{Source: srv.URL, TTL: time.Hour, Dir: dir}
+	for i := 0; i < 2; i++ {
+		stacks, err := m.Stacks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stacks) != 1 || stacks[0].Name != "cedar-14" {
+			t.Fatalf("unexpected stacks %+v", stacks)
+		}
+	}
+	if hits != 1 {
+		t.Fatalf("expected the manifest to be cached, got %d fetches",
+			hits)
+	}
+
+	// Once expired, the manifest is fetched again, falling back to
+	// the cached one when that fails.
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(m.cacheFilename(), old, old)
+	fail = true
+	stacks, err := m.Stacks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hits != 2 || len(stacks) != 1 {
+		t.Fatalf("expected a stale manifest after %d fetches, got %+v",
+			hits, stacks)
+	}
+
+	if _, err := m.Refresh(); err == nil {
+		t.Fatal("expected a failed refresh to be reported")
+	}
+}
+
+func TestStacksManifestFromDirectory(t *testing.T) {
+	dir := newTmpDb(t)
+	defer os.RemoveAll(dir)
+	images := filepath.Join(dir, "images")
+	os.Mkdir(images, 0755)
+
+	for _, name := range []string{"cedar-14-v1.img", "cedar-14-v1.img.gz",
+		"cedar-14-v2.img.gz", "README"} {
+		ioutil.WriteFile(filepath.Join(images, name), nil, 0644)
+	}
+	ioutil.WriteFile(filepath.Join(images, "cedar-14-v2.img.gz.md5"),
+		[]byte("0123  cedar-14-v2.img.gz\n"), 0644)
+
+	m := &StacksManifest{Source: "file://" + images, Dir: dir}
+	stacks, err := m.Stacks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []HerokuStackImage{
+		{Name: "cedar-14", Version: "v1",
+			Path:    filepath.Join(images, "cedar-14-v1.img"),
+			basedir: dir},
+		{Name: "cedar-14", Version: "v2",
+			URL:     "file://" + filepath.Join(images, "cedar-14-v2.img.gz"),
+			Md5:     "0123",
+			basedir: dir},
+	}
+	if !reflect.DeepEqual(stacks, expected) {
+		t.Fatalf("unexpected stacks %+v", stacks)
+	}
+}
+
+func TestRegisterStackImage(t *testing.T) {
+	work := newTmpDb(t)
+	defer os.RemoveAll(work)
+	stacksDir := filepath.Join(work, "stacks")
+	os.MkdirAll(stacksDir, 0755)
+
+	// The default manifest is a file in the stacks directory.
+	err := ioutil.WriteFile(filepath.Join(stacksDir, "manifest.yml"),
+		[]byte(testStacksManifest), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := filepath.Join(work, "custom.img")
+	ioutil.WriteFile(img, nil, 0644)
+
+	for _, version := range []string{"custom", "custom", "v1"} {
+		if err := RegisterStackImage(work, "cedar-14", version, img); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stacks, err := HerokuStacksFromManifest(stacksDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stacks) != 2 {
+		t.Fatalf("expected registered images to replace their "+
+			"version, got %+v", stacks)
+	}
+	for _, stack := range stacks {
+		if stack.Path != img {
+			t.Fatalf("expected %s to be the local image, got %+v",
+				stack.Version, stack)
+		}
+	}
+}
+
+func TestStackImageFetchLocal(t *testing.T) {
+	dir := newTmpDb(t)
+	defer os.RemoveAll(dir)
+
+	contents := []byte("stack image")
+	download := gzipped(t, contents)
+	sum := md5.Sum(download)
+	src := filepath.Join(dir, "cedar-14-v1.img.gz")
+	if err := ioutil.WriteFile(src, download, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	img := &HerokuStackImage{
+		Name:    "cedar-14",
+		Version: "v1",
+		URL:     "file://" + src,
+		Md5:     hex.EncodeToString(sum[:]),
+		basedir: dir,
+	}
+	if err := img.fetch(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(img.Filename())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Fatal("unexpected stack image contents")
+	}
+}
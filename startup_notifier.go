@@ -0,0 +1,17 @@
+package hsup
+
+// StartupNotifier emits the processes of a single, already decoded
+// Startup.  It is used by sub-invocations of hsup, which are handed a
+// control file by the hsup that launched them.
+type StartupNotifier struct {
+	Hs *Startup
+}
+
+func (sn *StartupNotifier) Notify() <-chan *Processes {
+	out := make(chan *Processes)
+	go func() {
+		out <- sn.Hs.Procs()
+	}()
+
+	return out
+}
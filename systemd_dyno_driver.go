@@ -0,0 +1,477 @@
+// +build linux
+
+package hsup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	systemd "github.com/coreos/go-systemd/dbus"
+	"github.com/godbus/dbus"
+)
+
+const (
+	// systemdPollInterval is how often the state of the unit of a
+	// dyno is checked while waiting for it to exit.
+	systemdPollInterval = 500 * time.Millisecond
+
+	// systemdStopTimeout is how long dynos get to exit once sent
+	// SIGTERM, before being sent SIGKILL.
+	systemdStopTimeout = 10 * time.Second
+)
+
+// Codes of how the main process of a unit exited, as in ExecMainCode.
+const (
+	cldExited = 1
+	cldKilled = 2
+	cldDumped = 3
+)
+
+// systemdConn is the part of the systemd D-Bus API dynos are run
+// through, as implemented by a connection to the system bus.
+type systemdConn interface {
+	StartTransientUnit(name string, mode string,
+		properties ...systemd.Property) (string, error)
+	StopUnit(name string, mode string) (string, error)
+	KillUnit(name string, signal int32) error
+	ResetFailedUnit(name string) error
+	GetUnitProperties(unit string) (map[string]interface{}, error)
+	GetUnitTypeProperties(unit string, unitType string) (
+		map[string]interface{}, error)
+}
+
+// systemdBus is a connection to systemd on the system bus, calling the
+// methods of its manager that go-systemd lacks, or whose errors it
+// drops, directly.
+type systemdBus struct {
+	*systemd.Conn
+	manager *dbus.Object
+}
+
+func newSystemdBus() (*systemdBus, error) {
+	conn, err := systemd.New()
+	if err != nil {
+		return nil, err
+	}
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	return &systemdBus{
+		Conn: conn,
+		manager: bus.Object("org.freedesktop.systemd1",
+			"/org/freedesktop/systemd1"),
+	}, nil
+}
+
+// KillUnit sends a signal to the processes of a unit.
+func (b *systemdBus) KillUnit(name string, signal int32) error {
+	return b.manager.Call("org.freedesktop.systemd1.Manager.KillUnit",
+		0, name, "all", signal).Store()
+}
+
+// ResetFailedUnit resets the failed state of a unit, which unloads it.
+func (b *systemdBus) ResetFailedUnit(name string) error {
+	return b.manager.Call(
+		"org.freedesktop.systemd1.Manager.ResetFailedUnit", 0, name,
+	).Store()
+}
+
+// SystemdDynoDriver runs dynos as transient systemd services, without
+// containers: each runs as a dynamic user, with a private /tmp, the
+// memory and CPU of its dyno size, and its output in the journal under
+// the name of the dyno.  Slugs are unpacked once per release, like
+// with the libcontainer driver.  Each dyno copies it into a state
+// directory of its own, which systemd hands over to its dynamic user,
+// mounted on /app, unless AppReadOnly mounts the slug read-only on /app
+// instead.
+//
+// Services remain after their main process exits, until Wait reads
+// its exit status and releases them.
+type SystemdDynoDriver struct {
+	workDir       string
+	containersDir string
+
+	conn systemdConn
+
+	// sizes are the dyno sizes of process types, and defaultSize that
+	// of the others, if any.
+	sizes       map[string]DynoSize
+	defaultSize *DynoSize
+
+	// AppReadOnly mounts the slug read-only on /app, rather than a
+	// copy of it per dyno.
+	AppReadOnly bool
+
+	// stateDir is where systemd keeps the state directories of units.
+	stateDir string
+
+	// buildMu serializes builds of releases again, see builtPaths.
+	buildMu sync.Mutex
+}
+
+// NewSystemdDynoDriver connects to systemd on the system bus, and
+// reads its configuration from SYSTEMD_DYNO_SIZE, SYSTEMD_DYNO_SIZES
+// and SYSTEMD_DYNO_APP_READONLY.
+func NewSystemdDynoDriver(workDir string) (*SystemdDynoDriver, error) {
+	conn, err := newSystemdBus()
+	if err != nil {
+		return nil, err
+	}
+	return newSystemdDynoDriver(workDir, conn)
+}
+
+func newSystemdDynoDriver(workDir string, conn systemdConn) (
+	*SystemdDynoDriver, error) {
+	dd := &SystemdDynoDriver{
+		workDir:       workDir,
+		containersDir: filepath.Join(workDir, "containers"),
+		conn:          conn,
+		stateDir:      "/var/lib",
+	}
+	if err := os.MkdirAll(dd.containersDir, 0755); err != nil {
+		return nil, err
+	}
+	var err error
+	dd.sizes, dd.defaultSize, err = readDynoSizes("SYSTEMD_DYNO_SIZE",
+		"SYSTEMD_DYNO_SIZES")
+	if err != nil {
+		return nil, err
+	}
+	if readOnly := os.Getenv("SYSTEMD_DYNO_APP_READONLY"); readOnly != "" {
+		if dd.AppReadOnly, err = strconv.ParseBool(readOnly); err != nil {
+			return nil, fmt.Errorf(
+				"invalid SYSTEMD_DYNO_APP_READONLY %q", readOnly)
+		}
+	}
+	return dd, nil
+}
+
+// dynoSize returns the size of dynos of a process type, or nil when
+// their resources are not limited.
+func (dd *SystemdDynoDriver) dynoSize(processType string) *DynoSize {
+	if size, ok := dd.sizes[processType]; ok {
+		return &size
+	}
+	return dd.defaultSize
+}
+
+func (dd *SystemdDynoDriver) ValidateApp(app *AppSerializable,
+	verr *ValidationError) {
+	validateSlug(app, verr)
+	validateZstd(app, verr)
+}
+
+func (dd *SystemdDynoDriver) Build(release *Release) error {
+	if release.slugURL == "" {
+		return nil
+	}
+	if err := fetchSlug(release); err != nil {
+		return err
+	}
+	layer, err := unpackReleaseLayer(dd.workDir, release, -1)
+	if err != nil {
+		return err
+	}
+	release.slugLayer = layer
+	return nil
+}
+
+// systemdUnitName returns the name of the unit of a dyno, unique
+// across restarts, in the characters systemd escapes the same way as
+// go-systemd does in object paths.
+func systemdUnitName(ex *Executor) string {
+	name := fmt.Sprintf("hsup-%s-%s-%d", ex.Release.appName, ex.Name(),
+		time.Now().UnixNano())
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z',
+			r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		default:
+			return '-'
+		}
+	}, name) + ".service"
+}
+
+func (dd *SystemdDynoDriver) Start(ex *Executor) (err error) {
+	if ex.IPInfo, err = DefaultIPInfo(ex); err != nil {
+		return err
+	}
+
+	unit := systemdUnitName(ex)
+	dataPath := filepath.Join(dd.containersDir, unit)
+	if err := os.MkdirAll(dataPath, 0755); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dataPath)
+		}
+	}()
+
+	envFile := filepath.Join(dataPath, "env")
+	if err := writeSystemdEnvFile(envFile, ex.Release.config); err != nil {
+		return err
+	}
+	props := dd.properties(ex, envFile)
+	_, layer, err := builtPaths(dd, &dd.buildMu, ex.Release)
+	if err != nil {
+		return err
+	}
+	if layer != "" {
+		if err := useReleaseLayer(layer, dataPath); err != nil {
+			return err
+		}
+		props = append(props, dd.appProperties(unit, layer)...)
+	}
+
+	result, err := dd.conn.StartTransientUnit(unit, "fail", props...)
+	if err != nil {
+		return err
+	}
+	ex.systemdUnit = unit
+	if result != "done" {
+		dd.release(unit)
+		return fmt.Errorf("could not start unit %s: %s", unit, result)
+	}
+	return nil
+}
+
+// writeSystemdEnvFile writes the config vars of a dyno into an
+// environment file only root can read, rather than into the properties
+// of its unit, which any user can read through D-Bus.
+func writeSystemdEnvFile(path string, config map[string]string) error {
+	keys := make([]string, 0, len(config))
+	for k := range config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`,
+		"`", "\\`")
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%s=\"%s\"\n", k, quote.Replace(config[k]))
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0600)
+}
+
+// systemdEnvironmentFile is an entry of EnvironmentFiles.
+type systemdEnvironmentFile struct {
+	Path         string
+	IgnoreErrors bool
+}
+
+// properties returns the properties of the unit of a dyno, reading its
+// config vars from envFile.
+func (dd *SystemdDynoDriver) properties(ex *Executor,
+	envFile string) []systemd.Property {
+	var pr profileRunner
+	env := []string{
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"HOME=/app",
+		"DYNO=" + ex.Name(),
+	}
+
+	props := []systemd.Property{
+		systemd.PropDescription(fmt.Sprintf("hsup dyno %s of %s",
+			ex.Name(), ex.Release.Name())),
+		systemd.PropExecStart(pr.InlineArgs(ex.Args), true),
+		systemd.PropRemainAfterExit(true),
+		systemdProperty("Environment", env),
+		systemdProperty("EnvironmentFiles", []systemdEnvironmentFile{
+			{Path: envFile},
+		}),
+		systemdProperty("WorkingDirectory", "/app"),
+		systemdProperty("DynamicUser", true),
+		systemdProperty("PrivateTmp", true),
+		systemdProperty("StandardOutput", "journal"),
+		systemdProperty("StandardError", "journal"),
+		systemdProperty("SyslogIdentifier", ex.Name()),
+		systemdProperty("TimeoutStopUSec",
+			uint64(systemdStopTimeout/time.Microsecond)),
+	}
+	if size := dd.dynoSize(ex.ProcessType); size != nil {
+		props = append(props,
+			systemdProperty("MemoryAccounting", true),
+			systemdProperty("MemoryMax", uint64(size.Memory)),
+			systemdProperty("CPUAccounting", true),
+			systemdProperty("CPUQuotaPerSecUSec",
+				uint64(size.cpuQuotaPerSecond()/time.Microsecond)),
+		)
+	}
+	return props
+}
+
+// systemdStateDirectory returns the name of the state directory of a
+// unit, relative to the state directory of systemd.
+func systemdStateDirectory(unit string) string {
+	return strings.TrimSuffix(unit, ".service")
+}
+
+// appProperties returns the properties of the unit of a dyno putting
+// the slug of the release layer on /app.  The copy is made by the
+// dynamic user itself, before starting the dyno, so that it owns it.
+func (dd *SystemdDynoDriver) appProperties(unit, layer string) []systemd.Property {
+	app := filepath.Join(layer, "app")
+	if dd.AppReadOnly {
+		return []systemd.Property{systemdBindReadOnly(app, "/app")}
+	}
+
+	stateDir := systemdStateDirectory(unit)
+	copyApp := systemd.PropExecStart(
+		[]string{"/bin/cp", "-a", app + "/.", "/app"}, true)
+	copyApp.Name = "ExecStartPre"
+	return []systemd.Property{
+		systemdProperty("StateDirectory", []string{stateDir}),
+		systemdProperty("BindPaths", []systemdBindMount{{
+			Source:      filepath.Join(dd.stateDir, stateDir),
+			Destination: "/app",
+		}}),
+		copyApp,
+	}
+}
+
+func systemdProperty(name string, value interface{}) systemd.Property {
+	return systemd.Property{Name: name, Value: dbus.MakeVariant(value)}
+}
+
+// systemdBindMount is an entry of BindPaths and BindReadOnlyPaths.
+type systemdBindMount struct {
+	Source        string
+	Destination   string
+	IgnoreMissing bool
+	Flags         uint64
+}
+
+func systemdBindReadOnly(source, destination string) systemd.Property {
+	return systemdProperty("BindReadOnlyPaths", []systemdBindMount{
+		{Source: source, Destination: destination},
+	})
+}
+
+// mainExited reports whether the main process of a unit exited, and
+// its exit status if so.
+func (dd *SystemdDynoDriver) mainExited(unit string) (exited bool,
+	s *ExitStatus, err error) {
+	props, err := dd.conn.GetUnitProperties(unit)
+	if err != nil {
+		return false, nil, err
+	}
+	active, _ := props["ActiveState"].(string)
+	sub, _ := props["SubState"].(string)
+	if active != "failed" && active != "inactive" && sub != "exited" {
+		return false, nil, nil
+	}
+
+	service, err := dd.conn.GetUnitTypeProperties(unit, "Service")
+	if err != nil {
+		return true, nil, err
+	}
+	code, _ := service["ExecMainCode"].(int32)
+	status, _ := service["ExecMainStatus"].(int32)
+	switch code {
+	case cldExited:
+		return true, &ExitStatus{Code: int(status)}, nil
+	case cldKilled, cldDumped:
+		return true, &ExitStatus{Code: 128 + int(status)}, nil
+	default:
+		return true, nil, fmt.Errorf("unit %s is %s with no exit "+
+			"status", unit, active)
+	}
+}
+
+// release stops a unit whose main process exited, or resets it if it
+// failed, so that systemd unloads it.
+func (dd *SystemdDynoDriver) release(unit string) {
+	props, err := dd.conn.GetUnitProperties(unit)
+	if err != nil {
+		log.Printf("could not release unit %s: %v", unit, err)
+		return
+	}
+	if props["ActiveState"] == "failed" {
+		err = dd.conn.ResetFailedUnit(unit)
+	} else {
+		_, err = dd.conn.StopUnit(unit, "replace")
+	}
+	if err != nil {
+		log.Printf("could not release unit %s: %v", unit, err)
+	}
+}
+
+func (dd *SystemdDynoDriver) Wait(ex *Executor) (s *ExitStatus) {
+	unit := ex.systemdUnit
+	for {
+		exited, status, err := dd.mainExited(unit)
+		if err != nil {
+			s = &ExitStatus{Err: err}
+			break
+		}
+		if exited {
+			s = status
+			break
+		}
+		time.Sleep(systemdPollInterval)
+	}
+
+	dd.release(unit)
+	if err := os.RemoveAll(
+		filepath.Join(dd.containersDir, unit),
+	); err != nil {
+		log.Printf("datapath remove all error: %#+v", err)
+	}
+
+	// systemd keeps state directories, those of dynamic users in
+	// private, linked to from the state directory.
+	stateDir := systemdStateDirectory(unit)
+	for _, path := range []string{
+		filepath.Join(dd.stateDir, "private", stateDir),
+		filepath.Join(dd.stateDir, stateDir),
+	} {
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("state directory remove all error: %#+v",
+				err)
+		}
+	}
+	return s
+}
+
+func (dd *SystemdDynoDriver) Stop(ex *Executor) error {
+	unit := ex.systemdUnit
+
+	// Begin graceful shutdown via SIGTERM, unless the dyno exited
+	// already.
+	if err := dd.conn.KillUnit(unit, int32(syscall.SIGTERM)); err != nil {
+		if exited, _, _ := dd.mainExited(unit); exited {
+			return nil
+		}
+		return err
+	}
+	timeout := time.After(systemdStopTimeout)
+	for {
+		exited, _, err := dd.mainExited(unit)
+		if err != nil {
+			return err
+		}
+		if exited {
+			return nil
+		}
+		select {
+		case <-timeout:
+			log.Println("sigkill", unit)
+			return dd.conn.KillUnit(unit, int32(syscall.SIGKILL))
+		case <-time.After(systemdPollInterval):
+		}
+	}
+}
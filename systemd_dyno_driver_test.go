@@ -0,0 +1,327 @@
+// +build linux
+
+package hsup
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+
+	systemd "github.com/coreos/go-systemd/dbus"
+)
+
+// fakeSystemd stands in for systemd on the system bus, running units
+// whose main processes exit when told to.
+type fakeSystemd struct {
+	mu    sync.Mutex
+	units map[string]*fakeUnit
+	kills []int32
+}
+
+type fakeUnit struct {
+	props       map[string]interface{}
+	active, sub string
+	code        int32
+	status      int32
+}
+
+func newFakeSystemd() *fakeSystemd {
+	return &fakeSystemd{units: make(map[string]*fakeUnit)}
+}
+
+func (f *fakeSystemd) StartTransientUnit(name string, mode string,
+	properties ...systemd.Property) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.units[name]; ok {
+		return "", errors.New("unit " + name + " already exists")
+	}
+	u := &fakeUnit{
+		props:  make(map[string]interface{}),
+		active: "active",
+		sub:    "running",
+	}
+	for _, p := range properties {
+		u.props[p.Name] = p.Value.Value()
+	}
+	f.units[name] = u
+	return "done", nil
+}
+
+func (f *fakeSystemd) StopUnit(name string, mode string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.units, name)
+	return "done", nil
+}
+
+func (f *fakeSystemd) KillUnit(name string, signal int32) error {
+	f.mu.Lock()
+	f.kills = append(f.kills, signal)
+	f.mu.Unlock()
+	f.exit(name, cldKilled, signal)
+	return nil
+}
+
+func (f *fakeSystemd) ResetFailedUnit(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if u, ok := f.units[name]; !ok || u.active != "failed" {
+		return errors.New("unit " + name + " has not failed")
+	}
+	delete(f.units, name)
+	return nil
+}
+
+func (f *fakeSystemd) unit(name string) (*fakeUnit, error) {
+	u, ok := f.units[name]
+	if !ok {
+		return nil, errors.New("unknown unit " + name)
+	}
+	return u, nil
+}
+
+func (f *fakeSystemd) GetUnitProperties(unit string) (
+	map[string]interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, err := f.unit(unit)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"ActiveState": u.active,
+		"SubState":    u.sub,
+	}, nil
+}
+
+func (f *fakeSystemd) GetUnitTypeProperties(unit string, unitType string) (
+	map[string]interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, err := f.unit(unit)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"ExecMainCode":   u.code,
+		"ExecMainStatus": u.status,
+	}, nil
+}
+
+// exit makes the main process of a unit exit, the unit remaining
+// after it.
+func (f *fakeSystemd) exit(name string, code, status int32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u := f.units[name]
+	u.code, u.status = code, status
+	if code == cldExited && status == 0 {
+		u.active, u.sub = "active", "exited"
+	} else {
+		u.active, u.sub = "failed", "failed"
+	}
+}
+
+func newTestSystemdDriver(t *testing.T) (*SystemdDynoDriver, *fakeSystemd) {
+	workDir, err := ioutil.TempDir("", "systemd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := newFakeSystemd()
+	dd, err := newSystemdDynoDriver(workDir, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dd, fake
+}
+
+func TestSystemdDynoDriverRunsUnits(t *testing.T) {
+	dd, fake := newTestSystemdDriver(t)
+	defer os.RemoveAll(dd.workDir)
+	size := DynoSizes["standard-2x"]
+	dd.defaultSize = &size
+
+	ex := &Executor{
+		Args:        []string{"./bin/web"},
+		ProcessID:   1,
+		ProcessType: "web",
+		Release: &Release{
+			appName: "my_app",
+			config: map[string]string{
+				"PORT":   "8080",
+				"SECRET": `a "b" $c\`,
+			},
+		},
+	}
+	if err := dd.Start(ex); err != nil {
+		t.Fatal(err)
+	}
+	u, ok := fake.units[ex.systemdUnit]
+	if !ok {
+		t.Fatalf("expected unit %s to be started", ex.systemdUnit)
+	}
+	if path := systemd.ObjectPath(
+		"/org/freedesktop/systemd1/unit/" + ex.systemdUnit,
+	); !path.IsValid() {
+		t.Fatalf("invalid unit name %q", ex.systemdUnit)
+	}
+
+	execStart := reflect.ValueOf(u.props["ExecStart"]).Index(0)
+	args := execStart.FieldByName("Args").Interface().([]string)
+	if expected := []string{"/bin/bash", "-c", profileScript,
+		"profile-runner", "./bin/web"}; !reflect.DeepEqual(args, expected) {
+		t.Fatalf("expected ExecStart %q, got %q", expected, args)
+	}
+	for name, expected := range map[string]interface{}{
+		"DynamicUser":        true,
+		"PrivateTmp":         true,
+		"RemainAfterExit":    true,
+		"StandardOutput":     "journal",
+		"SyslogIdentifier":   "web.1",
+		"MemoryMax":          uint64(1 << 30),
+		"CPUQuotaPerSecUSec": uint64(2000000),
+	} {
+		if actual := u.props[name]; actual != expected {
+			t.Errorf("expected %s %v, got %v", name, expected, actual)
+		}
+	}
+	for _, kv := range u.props["Environment"].([]string) {
+		if kv == "PORT=8080" {
+			t.Errorf("expected config vars out of %q",
+				u.props["Environment"])
+		}
+	}
+	files := u.props["EnvironmentFiles"].([]systemdEnvironmentFile)
+	if len(files) != 1 {
+		t.Fatalf("expected an environment file, got %v", files)
+	}
+	fi, err := os.Stat(files[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("expected the environment file to be private, got %v",
+			fi.Mode())
+	}
+	env, err := ioutil.ReadFile(files[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `PORT="8080"` + "\n" + `SECRET="a \"b\" \$c\\"` + "\n"
+	if string(env) != expected {
+		t.Errorf("expected environment file %q, got %q", expected, env)
+	}
+
+	fake.exit(ex.systemdUnit, cldExited, 3)
+	if s := dd.Wait(ex); s == nil || s.Code != 3 || s.Err != nil {
+		t.Fatalf("expected exit status 3, got %+v", s)
+	}
+	if _, ok := fake.units[ex.systemdUnit]; ok {
+		t.Fatal("expected the unit to be released")
+	}
+}
+
+func TestSystemdDynoDriverStop(t *testing.T) {
+	dd, fake := newTestSystemdDriver(t)
+	defer os.RemoveAll(dd.workDir)
+
+	ex := &Executor{
+		Args:        []string{"./bin/worker"},
+		ProcessID:   1,
+		ProcessType: "worker",
+		Release: &Release{
+			appName: "myapp",
+			config:  map[string]string{"PORT": "8080"},
+		},
+	}
+	if err := dd.Start(ex); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.units[ex.systemdUnit].props["MemoryMax"]; ok {
+		t.Fatal("unexpected memory limit without a dyno size")
+	}
+	if err := dd.Stop(ex); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fake.kills, []int32{int32(syscall.SIGTERM)}) {
+		t.Fatalf("expected SIGTERM only, got %v", fake.kills)
+	}
+	if s := dd.Wait(ex); s == nil || s.Code != 128+int(syscall.SIGTERM) {
+		t.Fatalf("expected exit status of SIGTERM, got %+v", s)
+	}
+	if len(fake.units) != 0 {
+		t.Fatalf("expected the unit to be reset, got %v", fake.units)
+	}
+}
+
+func TestSystemdDynoDriverApp(t *testing.T) {
+	dd, fake := newTestSystemdDriver(t)
+	defer os.RemoveAll(dd.workDir)
+	dd.stateDir = filepath.Join(dd.workDir, "state")
+	layer := filepath.Join(dd.workDir, releaseLayersDir, "some-layer")
+	if err := os.MkdirAll(filepath.Join(layer, "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	start := func() (*Executor, *fakeUnit) {
+		ex := &Executor{
+			Args:        []string{"./bin/web"},
+			ProcessID:   1,
+			ProcessType: "web",
+			Release: &Release{
+				appName:   "myapp",
+				config:    map[string]string{"PORT": "8080"},
+				slugLayer: layer,
+			},
+		}
+		if err := dd.Start(ex); err != nil {
+			t.Fatal(err)
+		}
+		return ex, fake.units[ex.systemdUnit]
+	}
+
+	ex, u := start()
+	stateDir := systemdStateDirectory(ex.systemdUnit)
+	if dirs := u.props["StateDirectory"]; !reflect.DeepEqual(dirs,
+		[]string{stateDir}) {
+		t.Fatalf("expected a state directory, got %v", dirs)
+	}
+	binds := u.props["BindPaths"].([]systemdBindMount)
+	if len(binds) != 1 || binds[0].Destination != "/app" ||
+		binds[0].Source != filepath.Join(dd.stateDir, stateDir) {
+		t.Fatalf("expected the state directory on /app, got %+v", binds)
+	}
+	pre := reflect.ValueOf(u.props["ExecStartPre"]).Index(0)
+	args := pre.FieldByName("Args").Interface().([]string)
+	if expected := []string{"/bin/cp", "-a",
+		filepath.Join(layer, "app") + "/.", "/app"}; !reflect.DeepEqual(
+		args, expected) {
+		t.Fatalf("expected ExecStartPre %q, got %q", expected, args)
+	}
+
+	private := filepath.Join(dd.stateDir, "private", stateDir)
+	if err := os.MkdirAll(private, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fake.exit(ex.systemdUnit, cldExited, 0)
+	dd.Wait(ex)
+	if _, err := os.Stat(private); !os.IsNotExist(err) {
+		t.Fatalf("expected the state directory to be removed: %v", err)
+	}
+
+	dd.AppReadOnly = true
+	ex, u = start()
+	if _, ok := u.props["StateDirectory"]; ok {
+		t.Fatal("unexpected state directory with a read-only /app")
+	}
+	binds = u.props["BindReadOnlyPaths"].([]systemdBindMount)
+	if len(binds) != 1 || binds[0].Source != filepath.Join(layer, "app") {
+		t.Fatalf("expected the slug read-only on /app, got %+v", binds)
+	}
+}
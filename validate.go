@@ -0,0 +1,324 @@
+package hsup
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	processTypeRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+	envNameRe     = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// slugProbeTimeout bounds how long probing a slug URL may hold up the
+// poller, well below the interval control directories are polled at.
+const slugProbeTimeout = 2 * time.Second
+
+// AppValidator is implemented by dyno drivers that can reject an
+// application before it is accepted from a control directory, e.g.
+// because it names a stack the driver cannot run.  Problems are
+// recorded on verr rather than returned, so they can be reported
+// together with any others.
+type AppValidator interface {
+	ValidateApp(app *AppSerializable, verr *ValidationError)
+}
+
+// ValidationReason is a single problem found with a control file.
+// Field is a path into the submitted document, such as
+// "Processes[1].Type", and is empty when the problem concerns the
+// document as a whole.
+type ValidationReason struct {
+	Field   string `json:",omitempty"`
+	Problem string
+}
+
+// ValidationError enumerates everything wrong with a control file,
+// so that one round trip is enough to fix them all.  It is rendered
+// as JSON into the "last_error" file of a control directory.
+type ValidationError struct {
+	Reasons []ValidationReason
+}
+
+func (ve *ValidationError) Add(field, format string, args ...interface{}) {
+	ve.Reasons = append(ve.Reasons, ValidationReason{
+		Field:   field,
+		Problem: fmt.Sprintf(format, args...),
+	})
+}
+
+func (ve *ValidationError) Error() string {
+	msgs := make([]string, len(ve.Reasons))
+	for i, r := range ve.Reasons {
+		if r.Field == "" {
+			msgs[i] = r.Problem
+		} else {
+			msgs[i] = r.Field + ": " + r.Problem
+		}
+	}
+	return "invalid control file: " + strings.Join(msgs, "; ")
+}
+
+// errOrNil returns nil when no reasons have been recorded.  As with
+// combine, returning a nil *ValidationError as an error would not
+// compare equal to nil.
+func (ve *ValidationError) errOrNil() error {
+	if len(ve.Reasons) == 0 {
+		return nil
+	}
+	return ve
+}
+
+// decodeError turns a JSON decoding failure into a ValidationError,
+// keeping whatever position information encoding/json reports.
+func decodeError(err error) *ValidationError {
+	verr := &ValidationError{}
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		verr.Add("", "malformed JSON at byte offset %d: %v",
+			e.Offset, e)
+	case *json.UnmarshalTypeError:
+		verr.Add(e.Field, "expected a JSON value of type %v, "+
+			"got %v", e.Type, e.Value)
+	default:
+		verr.Add("", "%v", err)
+	}
+	return verr
+}
+
+// Validate checks an application for problems that would otherwise
+// only show up once hsup tries to run it.  Checks that depend on the
+// dyno driver, such as which stacks are supported, are delegated to
+// drivers implementing AppValidator.
+func (as *AppSerializable) Validate(action Action, dd DynoDriver) error {
+	verr := &ValidationError{}
+
+	if as.Version < 0 {
+		verr.Add("Version", "must not be negative, got %d",
+			as.Version)
+	}
+
+	if action == Start && len(as.Processes) == 0 {
+		verr.Add("Processes", "at least one process type is "+
+			"required to start an application")
+	}
+
+	seen := make(map[string]bool)
+	for i, p := range as.Processes {
+		field := fmt.Sprintf("Processes[%d]", i)
+		switch {
+		case p.FType == "":
+			verr.Add(field+".Type", "must not be empty")
+		case !processTypeRe.MatchString(p.FType):
+			verr.Add(field+".Type", "%q must consist of "+
+				"letters, digits, '-' and '_' and start "+
+				"with a letter or digit", p.FType)
+		case seen[p.FType]:
+			verr.Add(field+".Type", "%q is defined more than once",
+				p.FType)
+		}
+		seen[p.FType] = true
+
+		if p.FQuantity < 0 {
+			verr.Add(field+".Quantity", "must not be negative, "+
+				"got %d", p.FQuantity)
+		}
+		if len(p.FArgs) == 0 {
+			verr.Add(field+".Args", "a command is required")
+		}
+	}
+
+	for name, value := range as.Env {
+		if !envNameRe.MatchString(name) {
+			verr.Add("Env", "%q is not a valid environment "+
+				"variable name", name)
+		}
+		if name == "PORT" {
+			if _, err := strconv.Atoi(value); err != nil {
+				verr.Add("Env.PORT", "must be an integer, "+
+					"got %q", value)
+			}
+		}
+	}
+
+	if as.SlugChecksum != "" {
+		if _, err := parseChecksum(as.SlugChecksum); err != nil {
+			verr.Add("SlugChecksum", "%v", err)
+		}
+	}
+
+	validFormat := false
+	for _, f := range slugFormats {
+		validFormat = validFormat || as.slugFormat() == f
+	}
+	if !validFormat {
+		verr.Add("SlugFormat", "%q is not one of %s", as.SlugFormat,
+			strings.Join(slugFormats, ", "))
+	}
+	if as.slugFormat() == SlugFormatOCILayer && as.SlugChecksum == "" {
+		verr.Add("SlugChecksum", "the digest of the layer is "+
+			"required for OCI layer slugs")
+	}
+	if n := as.SlugStripComponents; n != nil && *n < 0 {
+		verr.Add("SlugStripComponents", "must not be negative, "+
+			"got %d", *n)
+	}
+
+	if as.LogplexURL != "" {
+		if u, err := url.Parse(as.LogplexURL); err != nil {
+			verr.Add("LogplexURL", "%v", err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			verr.Add("LogplexURL", "must be an http or https "+
+				"URL, got %q", as.LogplexURL)
+		}
+	}
+
+	if av, ok := dd.(AppValidator); ok {
+		av.ValidateApp(as, verr)
+	}
+
+	return verr.errOrNil()
+}
+
+// validateApp validates an application submitted to a control
+// directory against the action and dyno driver hsup was started with.
+func (hs *Startup) validateApp(app interface{}) error {
+	return app.(*AppSerializable).Validate(hs.Action, hs.Driver)
+}
+
+// validateSlug checks that a slug is specified and can be reached.
+// It is shared by the drivers that fetch and unpack slugs.
+func validateSlug(as *AppSerializable, verr *ValidationError) {
+	if as.Slug == "" {
+		verr.Add("Slug", "a slug location is required")
+		return
+	}
+
+	rel := Release{slugURL: as.Slug}
+	switch {
+	case as.slugFormat() == SlugFormatOCILayer:
+		if rel.Where() != Local {
+			verr.Add("Slug", "OCI layer slugs must be in a local "+
+				"image layout directory, got %q", as.Slug)
+			return
+		}
+		if as.SlugChecksum == "" {
+			return
+		}
+		path, err := ociLayerPath(as.Slug, as.SlugChecksum)
+		if err == nil {
+			_, err = os.Stat(path)
+		}
+		if err != nil {
+			verr.Add("Slug", "%v", err)
+		}
+	case rel.Where() == Local:
+		path := strings.TrimPrefix(as.Slug, "file://")
+		fi, err := os.Stat(path)
+		if err != nil {
+			verr.Add("Slug", "%v", err)
+		} else if fi.IsDir() {
+			verr.Add("Slug", "%q is a directory, expected a "+
+				"slug archive", path)
+		}
+	case rel.Where() == HTTP:
+		if os.Getenv("HSUP_SLUG_PROBE") == "0" {
+			return
+		}
+		if err := probeURL(as.Slug); err != nil {
+			verr.Add("Slug", "%v", err)
+		}
+	}
+}
+
+// slugIsZstd reports whether a slug is zstd compressed, as tar.zst
+// slugs and OCI layers may be.
+func slugIsZstd(as *AppSerializable) bool {
+	switch as.slugFormat() {
+	case SlugFormatTarZstd:
+		return true
+	case SlugFormatOCILayer:
+		path, err := ociLayerPath(as.Slug, as.SlugChecksum)
+		if err != nil {
+			return false
+		}
+		format, err := sniffSlugFormat(path)
+		return err == nil && format == SlugFormatTarZstd
+	default:
+		return false
+	}
+}
+
+// validateZstd checks that zstd compressed slugs can be decompressed
+// by the drivers that unpack slugs where hsup runs, which is with the
+// zstd command.
+func validateZstd(as *AppSerializable, verr *ValidationError) {
+	if !slugIsZstd(as) {
+		return
+	}
+	if _, err := exec.LookPath("zstd"); err != nil {
+		verr.Add("SlugFormat", "zstd compressed slugs need the zstd "+
+			"command, which is not installed")
+	}
+}
+
+// probeURL checks that a URL can be downloaded.  A ranged GET is used
+// rather than HEAD, because pre-signed object storage URLs are often
+// only valid for GET requests.
+//
+// Only a client error, e.g. a missing object or an expired signature,
+// is reported: network errors, timeouts and server errors may well be
+// transient, and are logged rather than rejecting the application,
+// whose slug is fetched again when it is built.
+func probeURL(u string) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	client := &http.Client{Timeout: slugProbeTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("could not probe slug, accepting it anyway: %v",
+			err)
+		return nil
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return fmt.Errorf("%q is not reachable: %s", u, resp.Status)
+	case resp.StatusCode >= 500:
+		log.Printf("could not probe slug %q, accepting it anyway: %s",
+			u, resp.Status)
+	}
+	return nil
+}
+
+// validateStack checks a stack name against the ones a driver
+// supports.
+func validateStack(as *AppSerializable, supported []string,
+	verr *ValidationError) {
+	if as.Stack == "" {
+		verr.Add("Stack", "a stack is required")
+		return
+	}
+
+	for _, s := range supported {
+		if s == as.Stack {
+			return
+		}
+	}
+
+	verr.Add("Stack", "%q is not supported by this dyno driver, "+
+		"expected one of: %s", as.Stack, strings.Join(supported, ", "))
+}
@@ -0,0 +1,215 @@
+package hsup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func validApp() *AppSerializable {
+	return &AppSerializable{
+		Version: 1,
+		Env:     map[string]string{"PORT": "5000", "LANG": "en_US.UTF-8"},
+		Stack:   "cedar-14",
+		Processes: []FormationSerializable{
+			{FArgs: []string{"./web"}, FQuantity: 1, FType: "web"},
+		},
+	}
+}
+
+func reasonFields(err error) map[string]bool {
+	fields := make(map[string]bool)
+	if verr, ok := err.(*ValidationError); ok {
+		for _, r := range verr.Reasons {
+			fields[r.Field] = true
+		}
+	}
+	return fields
+}
+
+func TestValidateAcceptsValidApp(t *testing.T) {
+	if err := validApp().Validate(Start, &SimpleDynoDriver{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	app := validApp()
+	app.Version = -1
+	app.Env["BAD-NAME"] = "x"
+	app.Env["PORT"] = "web"
+	app.SlugFormat = "zip"
+	strip := -1
+	app.SlugStripComponents = &strip
+	app.Processes = append(app.Processes,
+		FormationSerializable{FQuantity: -2, FType: "web"},
+		FormationSerializable{FArgs: []string{"x"}, FType: "no spaces"},
+	)
+
+	err := app.Validate(Start, &SimpleDynoDriver{})
+	if err == nil {
+		t.Fatal("expected validation to fail")
+	}
+
+	fields := reasonFields(err)
+	for _, f := range []string{
+		"Version",
+		"Env",
+		"Env.PORT",
+		"SlugFormat",
+		"SlugStripComponents",
+		"Processes[1].Type",
+		"Processes[1].Quantity",
+		"Processes[1].Args",
+		"Processes[2].Type",
+	} {
+		if !fields[f] {
+			t.Errorf("expected a reason for %q in %v", f, err)
+		}
+	}
+}
+
+func TestValidateProcessesRequiredOnlyForStart(t *testing.T) {
+	app := validApp()
+	app.Processes = nil
+
+	if !reasonFields(app.Validate(Start, &SimpleDynoDriver{}))["Processes"] {
+		t.Fatal("expected start without processes to be rejected")
+	}
+
+	if err := app.Validate(Run, &SimpleDynoDriver{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateSlugAndStack(t *testing.T) {
+	name := newTmpDb(t)
+	defer os.RemoveAll(name)
+
+	app := validApp()
+	app.Slug = filepath.Join(name, "missing.tgz")
+	app.Stack = "bamboo"
+	fields := reasonFields(app.Validate(Start, &DockerDynoDriver{}))
+	if !fields["Slug"] || !fields["Stack"] {
+		t.Fatalf("expected slug and stack reasons, got %v", fields)
+	}
+
+	app.Slug = filepath.Join(name, "slug.tgz")
+	app.Stack = "cedar-14"
+	ioutil.WriteFile(app.Slug, []byte("slug"), 0400)
+	if err := app.Validate(Start, &DockerDynoDriver{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateZstdSlug(t *testing.T) {
+	name := newTmpDb(t)
+	defer os.RemoveAll(name)
+
+	app := validApp()
+	app.Slug = filepath.Join(name, "slug.tar.zst")
+	app.SlugFormat = SlugFormatTarZstd
+	ioutil.WriteFile(app.Slug, []byte("slug"), 0400)
+
+	// Slugs are unpacked in the stack image by the docker driver.
+	if !reasonFields(app.Validate(Start, &DockerDynoDriver{}))["SlugFormat"] {
+		t.Fatal("expected zstd slugs to be rejected by docker")
+	}
+
+	// And where hsup runs by the abspath driver.
+	_, lookErr := exec.LookPath("zstd")
+	rejected := reasonFields(app.Validate(Start, &AbsPathDynoDriver{}))["SlugFormat"]
+	if rejected != (lookErr != nil) {
+		t.Fatalf("expected zstd slugs to be rejected only without "+
+			"zstd, got %v (%v)", rejected, lookErr)
+	}
+}
+
+func TestValidateHTTPSlug(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/slug.tgz":
+				w.Write([]byte("slug"))
+			case "/busy.tgz":
+				http.Error(w, "busy", http.StatusServiceUnavailable)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer srv.Close()
+
+	app := validApp()
+	app.Slug = srv.URL + "/slug.tgz"
+	if err := app.Validate(Start, &AbsPathDynoDriver{}); err != nil {
+		t.Fatal(err)
+	}
+
+	app.Slug = srv.URL + "/gone.tgz"
+	if !reasonFields(app.Validate(Start, &AbsPathDynoDriver{}))["Slug"] {
+		t.Fatal("expected an unreachable slug to be rejected")
+	}
+
+	// Server errors may be transient, and do not reject the slug.
+	app.Slug = srv.URL + "/busy.tgz"
+	if err := app.Validate(Start, &AbsPathDynoDriver{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRejectionWritesReasons(t *testing.T) {
+	name := newTmpDb(t)
+	defer os.RemoveAll(name)
+
+	c := newConf(newControlDir, name)
+	c.validate = func(app interface{}) error {
+		return app.(*AppSerializable).Validate(Start, &SimpleDynoDriver{})
+	}
+	ioutil.WriteFile(c.newPath(), []byte(`{"Version": 1, "Procesess": []}`),
+		0400)
+
+	update, err := c.Notify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update {
+		t.Fatal("Expect no update from a rejected file")
+	}
+
+	contents, err := ioutil.ReadFile(c.errPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var verr ValidationError
+	if err := json.Unmarshal(contents, &verr); err != nil {
+		t.Fatalf("last_error is not JSON: %v\n%s", err, contents)
+	}
+	if len(verr.Reasons) != 1 {
+		t.Fatalf("expected the unknown field to be reported, got %s",
+			contents)
+	}
+
+	// A well-formed document that fails validation is rejected
+	// with the validation reasons.
+	ioutil.WriteFile(c.newPath(), []byte(`{"Version": 1}`), 0400)
+	if _, err := c.Notify(); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err = ioutil.ReadFile(c.errPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	verr = ValidationError{}
+	json.Unmarshal(contents, &verr)
+	if len(verr.Reasons) != 1 || verr.Reasons[0].Field != "Processes" {
+		t.Fatalf("expected missing processes to be reported, got %s",
+			contents)
+	}
+}